@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/cli"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/controller"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/utils"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -19,54 +28,281 @@ func main() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 
-	mode := flag.String("mode", "standard", "Operation mode (standard, get-api-key)")
+	mode := flag.String("mode", "standard", "Operation mode (standard, replay, diagnostics, validate-config, config-schema, get-api-key, validate-api-key, list-api-keys, revoke-api-key, "+strings.Join(cli.Modes(), ", ")+")")
 
 	host := flag.String("host", "test", "DigitalSTROM server host")
 	port := flag.Int("port", 8080, "DigitalSTROM server port")
 	username := flag.String("username", "dssadmin", "DigitalSTROM user name")
 	password := flag.String("password", "", "DigitalSTROM password")
 	integrationName := flag.String("integrationName", "digitalstrom-to-mqtt", "Name of the integration. It will appear in digitalSTROM system panel")
+	apiKey := flag.String("apiKey", "", "DigitalSTROM API key, overrides the config")
+	apiKeyId := flag.String("apiKeyId", "", "Id, masked id as listed or name of the API key to revoke")
+	writeConfig := flag.String("writeConfig", "", "Config file in which the new API key is saved (e.g. config.yaml)")
+	writeSecret := flag.String("writeSecret", "", "File in which the new API key is saved alone, e.g. to be used as a secret")
+
+	cliOptions := cli.Options{}
+	flag.StringVar(&cliOptions.Format, "format", "table", "Output format of the list modes (table, json)")
+	flag.StringVar(&cliOptions.Device, "device", "", "Id, dsid or name of the device for the set mode")
+	flag.StringVar(&cliOptions.OutputId, "outputId", "", "Output to set for the set mode, the first one of the device by default")
+	flag.StringVar(&cliOptions.Value, "value", "", "Value to set for the set mode")
+	flag.StringVar(&cliOptions.Action, "action", "", "Action to invoke for the set mode instead of a value (e.g. app.moveUp)")
+	flag.StringVar(&cliOptions.File, "file", "", "File written by the dump and diagnostics modes or capture file read by the replay mode")
 
 	flag.Parse()
 
 	if *mode == "standard" {
-		modeStandard()
+		modeStandard("")
+	} else if *mode == "replay" {
+		if cliOptions.File == "" {
+			log.Fatal().Msg("The replay mode requires the capture file given with -file")
+		}
+		modeStandard(cliOptions.File)
+	} else if *mode == "diagnostics" {
+		modeDiagnostics(cliOptions.File)
+	} else if *mode == "validate-config" {
+		modeValidateConfig()
+	} else if *mode == "config-schema" {
+		modeConfigSchema()
 	} else if *mode == "get-api-key" {
-		modeGetApiKey(*host, *port, *username, *password, *integrationName)
+		modeGetApiKey(*host, *port, *username, *password, *integrationName, *writeConfig, *writeSecret)
+	} else if *mode == "validate-api-key" {
+		modeValidateApiKey(readDigitalstromConfig(*host, *port, *apiKey))
+	} else if *mode == "list-api-keys" {
+		modeListApiKeys(*host, *port, *username, *password, cliOptions.Format)
+	} else if *mode == "revoke-api-key" {
+		modeRevokeApiKey(*host, *port, *username, *password, *apiKeyId)
+	} else if slices.Contains(cli.Modes(), *mode) {
+		modeCli(*mode, readDigitalstromConfig(*host, *port, *apiKey), cliOptions)
 	} else {
 		log.Error().Str("mode", *mode).Msg("Unknown mode")
 		flag.PrintDefaults()
 	}
 }
 
-func modeGetApiKey(host string, port int, user string, password string, integrationName string) {
+func modeGetApiKey(host string, port int, user string, password string, integrationName string, writeConfig string, writeSecret string) {
 	apiKey, err := digitalstrom.GetApiKey(host, port, user, password, integrationName)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Unable to get API key.")
-	} else {
+	}
+	if writeConfig == "" && writeSecret == "" {
 		log.Info().
 			Str("DIGITALSTROM_API_KEY", apiKey).
 			Msg("API key successfully retrieved. Please save it in the config file, this cannot be retrieved a second time. You will have to create a new API key.")
+		return
+	}
+	if writeConfig != "" {
+		if err := config.WriteApiKey(writeConfig, apiKey); err != nil {
+			log.Fatal().Err(err).Str("DIGITALSTROM_API_KEY", apiKey).Msg("API key retrieved but not saved, please save it manually.")
+		}
+		log.Info().Str("file", writeConfig).Msg("API key successfully retrieved and saved in the config file.")
+	}
+	if writeSecret != "" {
+		if err := os.WriteFile(writeSecret, []byte(apiKey+"\n"), 0600); err != nil {
+			log.Fatal().Err(err).Str("DIGITALSTROM_API_KEY", apiKey).Msg("API key retrieved but not saved, please save it manually.")
+		}
+		log.Info().Str("file", writeSecret).Msg("API key successfully retrieved and saved in the secret file.")
+	}
+}
+
+// Reports all the problems of the config and exits with an error if any.
+func modeValidateConfig() {
+	problems := config.Validate()
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found in the config.\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Println("The config is valid.")
+}
+
+func modeConfigSchema() {
+	schema, err := config.JSONSchema()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to generate the JSON Schema of the config.")
+	}
+	os.Stdout.Write(schema)
+}
+
+func modeValidateApiKey(dsConfig *config.ConfigDigitalstrom) {
+	if dsConfig.ApiKey == "" {
+		log.Fatal().Msg("No API key configured, set DIGITALSTROM_API_KEY or use -apiKey.")
+	}
+	dsClient := digitalstrom.NewClient(digitalstrom.NewClientOptions().
+		SetHost(dsConfig.Host).
+		SetPort(dsConfig.Port).
+		SetApiKey(dsConfig.ApiKey))
+	err := dsClient.Ping()
+	if errors.Is(err, digitalstrom.ErrUnauthorized) {
+		log.Fatal().Err(err).Msg("The API key is rejected by the dSS, it is invalid or was revoked. Create a new one with -mode=get-api-key.")
+	} else if errors.Is(err, digitalstrom.ErrUnreachable) {
+		log.Fatal().Err(err).Str("host", dsConfig.Host).Int("port", dsConfig.Port).Msg("The dSS is unreachable, the API key could not be checked.")
+	} else if err != nil {
+		log.Fatal().Err(err).Msg("Unable to check the API key.")
 	}
+	log.Info().Str("host", dsConfig.Host).Msg("The API key is valid.")
 }
 
-func modeStandard() {
+func modeListApiKeys(host string, port int, user string, password string, format string) {
+	tokens, err := digitalstrom.ListApiKeys(host, port, user, password)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to list the API keys.")
+	}
+	// The ids are the keys themselves, only printed masked.
+	masked := make([]digitalstrom.ApplicationToken, 0, len(tokens))
+	for _, token := range tokens {
+		masked = append(masked, digitalstrom.ApplicationToken{Id: token.MaskedId(), Name: token.Name})
+	}
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(masked); err != nil {
+			log.Fatal().Err(err).Msg("Unable to print the API keys.")
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME")
+	for _, token := range masked {
+		fmt.Fprintf(w, "%s\t%s\n", token.Id, token.Name)
+	}
+	w.Flush()
+}
+
+func modeRevokeApiKey(host string, port int, user string, password string, apiKeyId string) {
+	if apiKeyId == "" {
+		log.Fatal().Msg("The id, masked id or name of the API key to revoke must be given with -apiKeyId.")
+	}
+	token, err := digitalstrom.RevokeApiKey(host, port, user, password, apiKeyId)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to revoke the API key.")
+	}
+	log.Info().Str("id", token.MaskedId()).Str("name", token.Name).Msg("API key revoked.")
+}
+
+// Reads the digitalSTROM config, overridden by the flags given explicitly.
+func readDigitalstromConfig(host string, port int, apiKey string) *config.ConfigDigitalstrom {
+	dsConfig, err := config.ReadDigitalstromConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error found when reading the config.")
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			dsConfig.Host = host
+		case "port":
+			dsConfig.Port = port
+		case "apiKey":
+			dsConfig.ApiKey = apiKey
+		}
+	})
+	return dsConfig
+}
+
+func modeCli(mode string, dsConfig *config.ConfigDigitalstrom, options cli.Options) {
+	devicesConfig, err := config.ReadDevicesConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid config.")
+	}
+	c, err := cli.NewCli(dsConfig, devicesConfig, options)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid arguments.")
+	}
+	if err := c.Run(mode); err != nil {
+		log.Fatal().Err(err).Str("mode", mode).Msg("Command failed.")
+	}
+}
+
+func modeDiagnostics(file string) {
+	// Keep the logs to include them in the bundle.
+	logs := &bytes.Buffer{}
+	log.Logger = log.Output(zerolog.MultiLevelWriter(
+		zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339},
+		zerolog.ConsoleWriter{Out: logs, TimeFormat: time.RFC3339, NoColor: true}))
+	zerolog.SetGlobalLevel(zerolog.DebugLevel)
+
 	config, err := config.ReadConfig()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Error found when reading the config.")
 	}
+	secrets := config.Secrets()
+	log.Logger = log.Output(zerolog.MultiLevelWriter(
+		zerolog.ConsoleWriter{Out: utils.NewRedactingWriter(os.Stderr, secrets...), TimeFormat: time.RFC3339},
+		zerolog.ConsoleWriter{Out: utils.NewRedactingWriter(logs, secrets...), TimeFormat: time.RFC3339, NoColor: true}))
+	if file == "" {
+		file = "digitalstrom-mqtt-diagnostics-" + time.Now().Format("20060102-150405") + ".zip"
+	}
+	if err := controller.Diagnose(config, file, logs); err != nil {
+		log.Fatal().Err(err).Msg("Unable to write the diagnostics.")
+	}
+	log.Info().Str("file", file).Msg("Diagnostics written.")
+}
 
-	if config.LogLevel == "TRACE" {
+// Sets the log level and keeps the secrets out of the logs, whatever the log
+// level.
+func applyLogConfig(logLevel string, secrets ...string) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: utils.NewRedactingWriter(os.Stderr, secrets...), TimeFormat: time.RFC3339})
+
+	if logLevel == "TRACE" {
 		zerolog.SetGlobalLevel(zerolog.TraceLevel)
-	} else if config.LogLevel == "DEBUG" {
+	} else if logLevel == "DEBUG" {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	} else if config.LogLevel == "INFO" {
+	} else if logLevel == "INFO" {
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	} else if config.LogLevel == "WARN" {
+	} else if logLevel == "WARN" {
 		zerolog.SetGlobalLevel(zerolog.WarnLevel)
-	} else if config.LogLevel == "ERROR" {
+	} else if logLevel == "ERROR" {
 		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
 	}
+}
+
+// Triggers a reload when the config file changes. Returns the function to
+// stop watching.
+func watchConfig(reloadSignal chan os.Signal) func() error {
+	stopWatching, err := config.Watch(func() {
+		select {
+		case reloadSignal <- syscall.SIGHUP:
+		default:
+		}
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("The config file is not watched, send SIGHUP to reload it.")
+		return func() error { return nil }
+	}
+	return stopWatching
+}
+
+// Reads the config again and applies the settings which can be changed while
+// running. An invalid config is ignored.
+func reloadConfig(ctrl *controller.Controller, replayFile string) {
+	log.Info().Msg("Reloading the config.")
+	updated, err := config.ReadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid config, keeping the current one.")
+		return
+	}
+	updated.Digitalstrom.ReplayFile = replayFile
+	// Both the secrets in use and the updated ones are redacted, the former
+	// are only replaced after a restart.
+	applyLogConfig(updated.LogLevel, append(ctrl.Config().Secrets(), updated.Secrets()...)...)
+	restart, err := ctrl.Reload(updated)
+	if err != nil {
+		log.Error().Err(err).Msg("Error when applying the updated config.")
+	}
+	if len(restart) > 0 {
+		log.Warn().Strs("settings", restart).Msg("Some changed settings are only applied after a restart.")
+	}
+}
+
+// Runs the bridge, against the dSS or the given capture file.
+func modeStandard(replayFile string) {
+	config, err := config.ReadConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error found when reading the config.")
+	}
+	config.Digitalstrom.ReplayFile = replayFile
+	applyLogConfig(config.LogLevel, config.Secrets()...)
 
 	log.Info().Msg("Starting DigitalStrom MQTT!")
 
@@ -76,10 +312,22 @@ func modeStandard() {
 		log.Fatal().Err(err).Msg("Error on starting the controller")
 	}
 
+	// Reload the config when the file changes or on SIGHUP.
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	defer watchConfig(reloadSignal)()
+
 	// Subscribe for interruption happening during execution.
 	exitSignal := make(chan os.Signal, 2)
 	signal.Notify(exitSignal, os.Interrupt, syscall.SIGTERM)
-	<-exitSignal
+	for running := true; running; {
+		select {
+		case <-reloadSignal:
+			reloadConfig(ctrl, replayFile)
+		case <-exitSignal:
+			running = false
+		}
+	}
 
 	// Gracefulle stop all the modules loops and logic.
 	if err := ctrl.Stop(); err != nil {
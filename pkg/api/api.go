@@ -0,0 +1,359 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/controller/modules"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// Controller gives access to the actions of the bridge that are not part of
+// the digitalSTROM client or registry.
+type Controller interface {
+	// Sets the value of an output like a command received from MQTT and
+	// returns its result.
+	SetOutputValue(ctx context.Context, deviceId string, functionBlockId string, outputId string, value float64) (modules.CommandResult, error)
+	// Returns an error when the actions of the device are refused by the
+	// config, e.g. for a read-only device.
+	CheckDeviceAction(device digitalstrom.Device) error
+	// Reloads the structure of the apartment from the dSS.
+	ReloadRegistry() error
+	// Publishes again the Home Assistant discovery messages.
+	PublishDiscovery() error
+}
+
+// Api is the local REST API used to inspect and control the bridge. It is
+// served by the health check server.
+type Api struct {
+	dsClient   digitalstrom.Client
+	dsRegistry digitalstrom.Registry
+	controller Controller
+	token      string
+}
+
+func NewApi(dsClient digitalstrom.Client, dsRegistry digitalstrom.Registry, controller Controller, token string) *Api {
+	return &Api{
+		dsClient:   dsClient,
+		dsRegistry: dsRegistry,
+		controller: controller,
+		token:      token,
+	}
+}
+
+// Handler returns the HTTP handler serving the API, to be mounted under
+// /api.
+func (a *Api) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(a.authenticate)
+	r.Get("/devices", a.getDevices)
+	r.Get("/devices/{deviceId}", a.getDevice)
+	r.Put("/devices/{deviceId}/outputs/{outputId}", a.setOutputValue)
+	r.Post("/devices/{deviceId}/actions/{actionId}", a.invokeAction)
+	r.Get("/zones", a.getZones)
+	r.Get("/controllers", a.getControllers)
+	r.Get("/meterings", a.getMeterings)
+	r.Post("/registry/reload", a.reloadRegistry)
+	r.Post("/discovery/publish", a.publishDiscovery)
+	return r
+}
+
+// Rejects the requests without the right bearer token. The config requires
+// a token when the API is enabled, all the requests are rejected without.
+func (a *Api) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.token == "" || !found || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing bearer token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type zoneResponse struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type outputResponse struct {
+	Id              string  `json:"id"`
+	FunctionBlockId string  `json:"functionBlockId"`
+	TechnicalName   string  `json:"technicalName"`
+	Type            string  `json:"type"`
+	Mode            string  `json:"mode"`
+	Min             float64 `json:"min"`
+	Max             float64 `json:"max"`
+	Resolution      float64 `json:"resolution"`
+	Value           float64 `json:"value"`
+	TargetValue     float64 `json:"targetValue"`
+	Status          string  `json:"status"`
+}
+
+type deviceResponse struct {
+	Id            string           `json:"id"`
+	Dsid          string           `json:"dsid"`
+	Name          string           `json:"name"`
+	Present       bool             `json:"present"`
+	Zone          zoneResponse     `json:"zone"`
+	TechnicalName string           `json:"technicalName"`
+	Outputs       []outputResponse `json:"outputs"`
+}
+
+type controllerResponse struct {
+	Id            string `json:"id"`
+	Name          string `json:"name"`
+	TechnicalName string `json:"technicalName"`
+}
+
+type meteringResponse struct {
+	Id            string  `json:"id"`
+	TechnicalName string  `json:"technicalName"`
+	Unit          string  `json:"unit"`
+	OriginType    string  `json:"originType"`
+	OriginId      string  `json:"originId"`
+	OriginName    string  `json:"originName"`
+	Value         float64 `json:"value"`
+}
+
+type setOutputValueRequest struct {
+	Value *float64 `json:"value"`
+}
+
+func (a *Api) getDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := a.dsRegistry.GetDevices()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	response := []deviceResponse{}
+	for _, device := range devices {
+		response = append(response, a.deviceResponse(device))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (a *Api) getDevice(w http.ResponseWriter, r *http.Request) {
+	device, err := a.dsRegistry.GetDevice(chi.URLParam(r, "deviceId"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.deviceResponse(device))
+}
+
+func (a *Api) deviceResponse(device digitalstrom.Device) deviceResponse {
+	response := deviceResponse{
+		Id:      device.DeviceId,
+		Dsid:    device.Attributes.Dsid,
+		Name:    device.Attributes.Name,
+		Present: device.Attributes.Present,
+		Zone:    zoneResponse{Id: device.Attributes.Zone},
+		Outputs: []outputResponse{},
+	}
+	if zone, err := a.dsRegistry.GetZone(device.Attributes.Zone); err == nil {
+		response.Zone.Name = zone.Attributes.Name
+	}
+
+	functionBlocks, err := a.dsRegistry.GetFunctionBlocksOfDevice(device.DeviceId)
+	if err != nil || len(functionBlocks) == 0 {
+		return response
+	}
+	response.TechnicalName = functionBlocks[0].Attributes.TechnicalName
+	for _, functionBlock := range functionBlocks {
+		values := map[string]digitalstrom.OutputValue{}
+		if outputValues, err := a.dsRegistry.GetOutputValuesOfFunctionBlock(device.DeviceId, functionBlock.FunctionBlockId); err == nil {
+			for _, value := range outputValues {
+				values[value.OutputId] = value
+			}
+		}
+		for _, output := range functionBlock.Attributes.Outputs {
+			response.Outputs = append(response.Outputs, newOutputResponse(functionBlock, output, values[output.OutputId]))
+		}
+	}
+	return response
+}
+
+func newOutputResponse(functionBlock digitalstrom.FunctionBlock, output digitalstrom.Output, value digitalstrom.OutputValue) outputResponse {
+	return outputResponse{
+		Id:              output.OutputId,
+		FunctionBlockId: functionBlock.FunctionBlockId,
+		TechnicalName:   output.Attributes.TechnicalName,
+		Type:            string(output.Attributes.Type),
+		Mode:            string(output.Attributes.Mode),
+		Min:             output.Attributes.Min,
+		Max:             output.Attributes.Max,
+		Resolution:      output.Attributes.Resolution,
+		Value:           value.Value,
+		TargetValue:     value.TargetValue,
+		Status:          string(value.Status),
+	}
+}
+
+func (a *Api) setOutputValue(w http.ResponseWriter, r *http.Request) {
+	deviceId := chi.URLParam(r, "deviceId")
+	outputId := chi.URLParam(r, "outputId")
+
+	var request setOutputValueRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Value == nil {
+		writeError(w, http.StatusBadRequest, errors.New("expected a body like {\"value\": 50}"))
+		return
+	}
+
+	log.Info().
+		Str("deviceId", deviceId).
+		Str("outputId", outputId).
+		Float64("value", *request.Value).
+		Msg("Setting value from API.")
+	// The function block is only needed for the devices having several
+	// outputs with the same id.
+	result, err := a.controller.SetOutputValue(r.Context(), deviceId, r.URL.Query().Get("functionBlockId"), outputId, *request.Value)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if !result.Success {
+		writeError(w, resultStatus(result.Code), errors.New(result.Message))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns the HTTP status of a failed command given the code of its result.
+func resultStatus(code string) int {
+	switch code {
+	case "invalid_payload", "out_of_range":
+		return http.StatusBadRequest
+	case "read_only":
+		return http.StatusForbidden
+	case "unknown_device", "no_function_block":
+		return http.StatusNotFound
+	case "superseded":
+		return http.StatusConflict
+	case "timeout":
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func (a *Api) invokeAction(w http.ResponseWriter, r *http.Request) {
+	device, err := a.dsRegistry.GetDevice(chi.URLParam(r, "deviceId"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err := a.controller.CheckDeviceAction(device); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	invocation := digitalstrom.DeviceActionInvocation(a.dsRegistry, device, chi.URLParam(r, "actionId"))
+
+	log.Info().
+		Str("deviceId", device.DeviceId).
+		Str("actionId", invocation.ActionId).
+		Msg("Invoking action from API.")
+	if err := a.dsClient.InvokeScenario(invocation); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Api) getZones(w http.ResponseWriter, r *http.Request) {
+	zones, err := a.dsRegistry.GetZones()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	response := []zoneResponse{}
+	for _, zone := range zones {
+		response = append(response, zoneResponse{Id: zone.ZoneId, Name: zone.Attributes.Name})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (a *Api) getControllers(w http.ResponseWriter, r *http.Request) {
+	controllers, err := a.dsRegistry.GetControllers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	response := []controllerResponse{}
+	for _, controller := range controllers {
+		response = append(response, controllerResponse{
+			Id:            controller.ControllerId,
+			Name:          controller.Attributes.Name,
+			TechnicalName: controller.Attributes.TechName,
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (a *Api) getMeterings(w http.ResponseWriter, r *http.Request) {
+	meterings, err := a.dsRegistry.GetMeterings()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	values := map[string]float64{}
+	if status, err := a.dsClient.GetMeteringStatus(); err == nil {
+		for _, value := range status.Values {
+			values[value.Id] = value.Attributes.Value
+		}
+	} else {
+		log.Warn().Err(err).Msg("Unable to fetch the metering values for the API.")
+	}
+
+	response := []meteringResponse{}
+	for _, metering := range meterings {
+		origin := metering.Attributes.Origin
+		item := meteringResponse{
+			Id:            metering.MeteringId,
+			TechnicalName: metering.Attributes.TechnicalName,
+			Unit:          metering.Attributes.Unit,
+			OriginType:    string(origin.Type),
+			OriginId:      origin.MeteringOriginId,
+			Value:         values[metering.MeteringId],
+		}
+		if controller, err := a.dsRegistry.GetControllerById(origin.MeteringOriginId); err == nil {
+			item.OriginName = controller.Attributes.Name
+		}
+		response = append(response, item)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (a *Api) reloadRegistry(w http.ResponseWriter, r *http.Request) {
+	if err := a.controller.ReloadRegistry(); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Api) publishDiscovery(w http.ResponseWriter, r *http.Request) {
+	if err := a.controller.PublishDiscovery(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error().Err(err).Msg("Error writing API response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	withoutToken := (&Api{}).authenticate(handler)
+	expectStatus(t, withoutToken, "", http.StatusUnauthorized)
+	expectStatus(t, withoutToken, "Bearer ", http.StatusUnauthorized)
+
+	withToken := (&Api{token: "secret"}).authenticate(handler)
+	expectStatus(t, withToken, "", http.StatusUnauthorized)
+	expectStatus(t, withToken, "Bearer wrong", http.StatusUnauthorized)
+	expectStatus(t, withToken, "secret", http.StatusUnauthorized)
+	expectStatus(t, withToken, "Bearer secret", http.StatusNoContent)
+}
+
+func TestResultStatus(t *testing.T) {
+	expected := map[string]int{
+		"read_only":      http.StatusForbidden,
+		"out_of_range":   http.StatusBadRequest,
+		"unknown_device": http.StatusNotFound,
+		"timeout":        http.StatusGatewayTimeout,
+		"dss_error":      http.StatusBadGateway,
+	}
+	for code, status := range expected {
+		if got := resultStatus(code); got != status {
+			t.Errorf("Code '%s': expected status %d but got %d", code, status, got)
+		}
+	}
+}
+
+func expectStatus(t *testing.T, handler http.Handler, authorization string, status int) {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodGet, "/devices", nil)
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != status {
+		t.Errorf("Authorization '%s': expected status %d but got %d", authorization, status, recorder.Code)
+	}
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/controller/modules"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/homeassistant"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/mqtt"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed static
+var static embed.FS
+
+// DashboardController gives access to the state of the bridge displayed in
+// the dashboard.
+type DashboardController interface {
+	// Returns the Home Assistant discovery messages as published.
+	DiscoveryMessages() ([]homeassistant.DiscoveryMessage, error)
+	// Returns the MQTT topics used by the devices.
+	DeviceTopics() ([]modules.Topic, error)
+	// Returns the last commands received from MQTT.
+	CommandHistory() []modules.CommandRecord
+	// Returns the result of the last ping of the dSS by the health check,
+	// which is cached.
+	PingDigitalstrom(ctx context.Context) error
+}
+
+// Dashboard is a read-only web page showing the state of the bridge, its
+// devices and their MQTT topics. Output changes are pushed to the page with
+// server-sent events.
+type Dashboard struct {
+	api        *Api
+	mqttClient mqtt.Client
+	controller DashboardController
+
+	clients      map[chan outputChangeEvent]struct{}
+	clientsMutex sync.Mutex
+}
+
+type outputChangeEvent struct {
+	DeviceId        string  `json:"deviceId"`
+	FunctionBlockId string  `json:"functionBlockId"`
+	OutputId        string  `json:"outputId"`
+	OldValue        float64 `json:"oldValue"`
+	NewValue        float64 `json:"newValue"`
+}
+
+type connectionStatus struct {
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+}
+
+type statusResponse struct {
+	Digitalstrom     connectionStatus `json:"digitalstrom"`
+	Websocket        connectionStatus `json:"websocket"`
+	Mqtt             connectionStatus `json:"mqtt"`
+	LastNotification *time.Time       `json:"lastNotification,omitempty"`
+}
+
+type dashboardDevice struct {
+	deviceResponse
+	Type   string          `json:"type"`
+	Topics []modules.Topic `json:"topics"`
+}
+
+func NewDashboard(dsClient digitalstrom.Client, dsRegistry digitalstrom.Registry, mqttClient mqtt.Client, controller DashboardController) *Dashboard {
+	return &Dashboard{
+		api:        NewApi(dsClient, dsRegistry, nil, ""),
+		mqttClient: mqttClient,
+		controller: controller,
+		clients:    map[chan outputChangeEvent]struct{}{},
+	}
+}
+
+// Start subscribes to the changes of the registry to forward them to the
+// connected pages.
+func (d *Dashboard) Start() error {
+	return d.api.dsRegistry.Subscribe("dashboard", func(event digitalstrom.Event) {
+		if changed, ok := event.(digitalstrom.OutputChanged); ok {
+			d.broadcast(outputChangeEvent{
+				DeviceId:        changed.DeviceId,
+				FunctionBlockId: changed.FunctionBlockId,
+				OutputId:        changed.OutputId,
+				OldValue:        changed.OldValue,
+				NewValue:        changed.NewValue,
+			})
+		}
+	})
+}
+
+func (d *Dashboard) Stop() error {
+	return d.api.dsRegistry.Unsubscribe("dashboard")
+}
+
+// Handler returns the HTTP handler serving the dashboard, to be mounted under
+// /ui.
+func (d *Dashboard) Handler() http.Handler {
+	r := chi.NewRouter()
+	content, err := fs.Sub(static, "static")
+	if err != nil {
+		log.Panic().Err(err).Msg("Dashboard content not embedded")
+	}
+	r.Get("/api/status", d.getStatus)
+	r.Get("/api/devices", d.getDevices)
+	r.Get("/api/commands", d.getCommands)
+	r.Get("/api/discovery", d.getDiscovery)
+	r.Get("/events", d.events)
+	files := http.FileServer(http.FS(content))
+	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
+		file := chi.URLParam(r, "*")
+		if file == "" && !strings.HasSuffix(r.URL.Path, "/") {
+			// The page uses URLs relative to the dashboard, e.g. api/status,
+			// which would resolve to the REST API from /ui.
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		// The files are served relative to where the dashboard is mounted.
+		prefix := strings.TrimSuffix(r.URL.Path, file)
+		http.StripPrefix(strings.TrimSuffix(prefix, "/"), files).ServeHTTP(w, r)
+	})
+	return r
+}
+
+func (d *Dashboard) getStatus(w http.ResponseWriter, r *http.Request) {
+	response := statusResponse{
+		Digitalstrom: connectionStatus{Connected: true},
+		Websocket:    connectionStatus{Connected: d.api.dsClient.WebsocketConnected()},
+		Mqtt:         connectionStatus{Connected: d.mqttClient.RawClient().IsConnectionOpen()},
+	}
+	if err := d.controller.PingDigitalstrom(r.Context()); err != nil {
+		response.Digitalstrom = connectionStatus{Connected: false, Error: err.Error()}
+	}
+	if last := d.api.dsClient.LastNotification(); !last.IsZero() {
+		response.LastNotification = &last
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (d *Dashboard) getDevices(w http.ResponseWriter, r *http.Request) {
+	devices, err := d.api.dsRegistry.GetDevices()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	topics, err := d.controller.DeviceTopics()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	topicsByDevice := map[string][]modules.Topic{}
+	for _, topic := range topics {
+		topicsByDevice[topic.DeviceId] = append(topicsByDevice[topic.DeviceId], topic)
+	}
+
+	response := []dashboardDevice{}
+	for _, device := range devices {
+		item := dashboardDevice{
+			deviceResponse: d.api.deviceResponse(device),
+			Type:           string(digitalstrom.DeviceTypeUnknown),
+			Topics:         topicsByDevice[device.DeviceId],
+		}
+		if functionBlocks, err := d.api.dsRegistry.GetFunctionBlocksOfDevice(device.DeviceId); err == nil && len(functionBlocks) > 0 {
+			item.Type = string(d.api.dsRegistry.GetDeviceType(functionBlocks[0]))
+		}
+		if item.Topics == nil {
+			item.Topics = []modules.Topic{}
+		}
+		response = append(response, item)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (d *Dashboard) getCommands(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.controller.CommandHistory())
+}
+
+func (d *Dashboard) getDiscovery(w http.ResponseWriter, r *http.Request) {
+	messages, err := d.controller.DiscoveryMessages()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, messages)
+}
+
+// Streams the output changes as server-sent events.
+func (d *Dashboard) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := d.addClient()
+	defer d.removeClient(events)
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: output\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+func (d *Dashboard) addClient() chan outputChangeEvent {
+	d.clientsMutex.Lock()
+	defer d.clientsMutex.Unlock()
+	events := make(chan outputChangeEvent, 64)
+	d.clients[events] = struct{}{}
+	return events
+}
+
+func (d *Dashboard) removeClient(events chan outputChangeEvent) {
+	d.clientsMutex.Lock()
+	defer d.clientsMutex.Unlock()
+	delete(d.clients, events)
+}
+
+// Sends the event to all the connected pages. Pages too slow to consume their
+// events miss them rather than blocking the registry.
+func (d *Dashboard) broadcast(event outputChangeEvent) {
+	d.clientsMutex.Lock()
+	defer d.clientsMutex.Unlock()
+	for events := range d.clients {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
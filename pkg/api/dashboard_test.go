@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestDashboardIsServedUnderItsPrefix(t *testing.T) {
+	router := chi.NewRouter()
+	router.Mount("/ui", (&Dashboard{}).Handler())
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	// The relative URLs of the page need the trailing slash.
+	response := get("/ui")
+	if response.Code != http.StatusMovedPermanently || response.Header().Get("Location") != "/ui/" {
+		t.Errorf("Expected a redirection to /ui/, got %d to '%s'", response.Code, response.Header().Get("Location"))
+	}
+
+	response = get("/ui/")
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "<html") {
+		t.Errorf("Expected the page, got %d", response.Code)
+	}
+}
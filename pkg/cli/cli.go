@@ -0,0 +1,370 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/controller/modules"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/rs/zerolog/log"
+)
+
+// Modes returns the modes handled by the CLI.
+func Modes() []string {
+	return []string{"list-devices", "list-zones", "list-scenarios", "status", "set", "dump"}
+}
+
+// Options are the command line flags used by the CLI modes.
+type Options struct {
+	// Either "table" or "json".
+	Format string
+	// Id, dsid or name of the device for the "set" mode.
+	Device string
+	// Output to set for the "set" mode, named like in the topics (e.g.
+	// "<functionBlockId>/brightness" for a dual relay), the first output of
+	// the device when empty.
+	OutputId string
+	// Value to set for the "set" mode, like the payload of a command topic.
+	Value string
+	// Action to invoke for the "set" mode (e.g. app.moveUp), instead of a
+	// value.
+	Action string
+	// File written by the "dump" mode, stdout when empty.
+	File string
+}
+
+// Cli explores an installation from the shell, without starting the bridge.
+type Cli struct {
+	dsClient   digitalstrom.Client
+	dsRegistry digitalstrom.Registry
+	// Settings of the devices checked by the "set" mode.
+	devicesConfig *config.Config
+	options       Options
+	out           io.Writer
+}
+
+func NewCli(dsConfig *config.ConfigDigitalstrom, devicesConfig *config.Config, options Options) (*Cli, error) {
+	if dsConfig.Host == "" {
+		return nil, errors.New("digitalSTROM host missing, set it in the config or with -host")
+	}
+	if dsConfig.ApiKey == "" {
+		return nil, errors.New("digitalSTROM API key missing, set it in the config or with -apiKey")
+	}
+	if options.Format != "table" && options.Format != "json" {
+		return nil, fmt.Errorf("unknown format '%s', expected 'table' or 'json'", options.Format)
+	}
+	dsOptions := digitalstrom.NewClientOptions().
+		SetHost(dsConfig.Host).
+		SetPort(dsConfig.Port).
+		SetApiKey(dsConfig.ApiKey)
+	dsClient := digitalstrom.NewClient(dsOptions)
+	return &Cli{
+		dsClient:      dsClient,
+		dsRegistry:    digitalstrom.NewRegistry(dsClient),
+		devicesConfig: devicesConfig,
+		options:       options,
+		out:           os.Stdout,
+	}, nil
+}
+
+// Run executes the given mode.
+func (c *Cli) Run(mode string) error {
+	if mode == "dump" {
+		// The raw structure does not need the registry.
+		return c.dump()
+	}
+	if err := c.dsRegistry.Start(); err != nil {
+		return fmt.Errorf("error loading the installation: %w", err)
+	}
+	switch mode {
+	case "list-devices":
+		return c.listDevices()
+	case "list-zones":
+		return c.listZones()
+	case "list-scenarios":
+		return c.listScenarios()
+	case "status":
+		return c.status()
+	case "set":
+		return c.set()
+	}
+	return fmt.Errorf("unknown mode '%s'", mode)
+}
+
+type deviceRow struct {
+	Id      string   `json:"id"`
+	Dsid    string   `json:"dsid"`
+	Name    string   `json:"name"`
+	Zone    string   `json:"zone"`
+	Type    string   `json:"type"`
+	Present bool     `json:"present"`
+	Outputs []string `json:"outputs"`
+}
+
+type zoneRow struct {
+	Id           string   `json:"id"`
+	Name         string   `json:"name"`
+	Floor        string   `json:"floor"`
+	Applications []string `json:"applications"`
+	Devices      int      `json:"devices"`
+}
+
+type scenarioRow struct {
+	Id          string `json:"id"`
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	ActionId    string `json:"actionId"`
+	Context     string `json:"context"`
+	Zone        string `json:"zone"`
+	Application string `json:"application"`
+}
+
+type statusRow struct {
+	DeviceId    string  `json:"deviceId"`
+	Device      string  `json:"device"`
+	OutputId    string  `json:"outputId"`
+	Value       float64 `json:"value"`
+	TargetValue float64 `json:"targetValue"`
+	Status      string  `json:"status"`
+}
+
+func (c *Cli) listDevices() error {
+	devices, err := c.dsRegistry.GetDevices()
+	if err != nil {
+		return err
+	}
+	rows := []deviceRow{}
+	for _, device := range devices {
+		row := deviceRow{
+			Id:      device.DeviceId,
+			Dsid:    device.Attributes.Dsid,
+			Name:    device.Attributes.Name,
+			Zone:    c.zoneName(device.Attributes.Zone),
+			Type:    string(digitalstrom.DeviceTypeUnknown),
+			Present: device.Attributes.Present,
+			Outputs: []string{},
+		}
+		if functionBlocks, err := c.dsRegistry.GetFunctionBlocksOfDevice(device.DeviceId); err == nil && len(functionBlocks) > 0 {
+			row.Type = string(c.dsRegistry.GetDeviceType(functionBlocks[0]))
+		}
+		if outputs, err := c.dsRegistry.GetOutputsOfDevice(device.DeviceId); err == nil {
+			for _, output := range outputs {
+				row.Outputs = append(row.Outputs, output.OutputId)
+			}
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Zone+rows[i].Name < rows[j].Zone+rows[j].Name
+	})
+
+	return c.print(rows, []string{"ID", "DSID", "NAME", "ZONE", "TYPE", "PRESENT", "OUTPUTS"}, func(w io.Writer) {
+		for _, row := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\t%s\n",
+				row.Id, row.Dsid, row.Name, row.Zone, row.Type, row.Present, strings.Join(row.Outputs, ","))
+		}
+	})
+}
+
+func (c *Cli) listZones() error {
+	zones, err := c.dsRegistry.GetZones()
+	if err != nil {
+		return err
+	}
+	devices, err := c.dsRegistry.GetDevices()
+	if err != nil {
+		return err
+	}
+	devicesPerZone := map[string]int{}
+	for _, device := range devices {
+		devicesPerZone[device.Attributes.Zone]++
+	}
+	rows := []zoneRow{}
+	for _, zone := range zones {
+		rows = append(rows, zoneRow{
+			Id:           zone.ZoneId,
+			Name:         zone.Attributes.Name,
+			Floor:        zone.Attributes.Floor,
+			Applications: zone.Attributes.Applications,
+			Devices:      devicesPerZone[zone.ZoneId],
+		})
+	}
+
+	return c.print(rows, []string{"ID", "NAME", "FLOOR", "DEVICES", "APPLICATIONS"}, func(w io.Writer) {
+		for _, row := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n",
+				row.Id, row.Name, row.Floor, row.Devices, strings.Join(row.Applications, ","))
+		}
+	})
+}
+
+func (c *Cli) listScenarios() error {
+	scenarios, err := c.dsClient.GetScenarios()
+	if err != nil {
+		return err
+	}
+	rows := []scenarioRow{}
+	for _, scenario := range scenarios {
+		rows = append(rows, scenarioRow{
+			Id:          scenario.ScenarioId,
+			Type:        string(scenario.Type),
+			Name:        scenario.Attributes.Name,
+			ActionId:    scenario.Attributes.ActionId,
+			Context:     scenario.Attributes.Context,
+			Zone:        c.zoneName(scenario.Attributes.Zone),
+			Application: string(scenario.Attributes.Application),
+		})
+	}
+
+	return c.print(rows, []string{"ID", "TYPE", "NAME", "ACTION", "CONTEXT", "ZONE", "APPLICATION"}, func(w io.Writer) {
+		for _, row := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				row.Id, row.Type, row.Name, row.ActionId, row.Context, row.Zone, row.Application)
+		}
+	})
+}
+
+func (c *Cli) status() error {
+	devices, err := c.dsRegistry.GetDevices()
+	if err != nil {
+		return err
+	}
+	rows := []statusRow{}
+	for _, device := range devices {
+		values, err := c.dsRegistry.GetOutputValuesOfDevice(device.DeviceId)
+		if err != nil {
+			continue
+		}
+		for _, value := range values {
+			rows = append(rows, statusRow{
+				DeviceId:    device.DeviceId,
+				Device:      device.Attributes.Name,
+				OutputId:    value.OutputId,
+				Value:       value.Value,
+				TargetValue: value.TargetValue,
+				Status:      string(value.Status),
+			})
+		}
+	}
+
+	return c.print(rows, []string{"DEVICE", "NAME", "OUTPUT", "VALUE", "TARGET", "STATUS"}, func(w io.Writer) {
+		for _, row := range rows {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%g\t%g\t%s\n",
+				row.DeviceId, row.Device, row.OutputId, row.Value, row.TargetValue, row.Status)
+		}
+	})
+}
+
+func (c *Cli) set() error {
+	if c.options.Device == "" {
+		return errors.New("-device is required")
+	}
+	if (c.options.Value == "") == (c.options.Action == "") {
+		return errors.New("exactly one of -value or -action is required")
+	}
+	device, err := c.findDevice(c.options.Device)
+	if err != nil {
+		return err
+	}
+
+	// Checked like the commands received by the bridge. There is no need
+	// for the queue of the bridge as a single command is sent.
+	if c.options.Action != "" {
+		if err := modules.CheckDeviceAction(c.dsRegistry, c.devicesConfig, device); err != nil {
+			return err
+		}
+		invocation := digitalstrom.DeviceActionInvocation(c.dsRegistry, device, c.options.Action)
+		log.Info().Str("device", device.Attributes.Name).Str("action", c.options.Action).Msg("Invoking action.")
+		return c.dsClient.InvokeScenario(invocation)
+	}
+
+	value, err := strconv.ParseFloat(c.options.Value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value '%s': %w", c.options.Value, err)
+	}
+	target, err := modules.CheckOutputValue(c.dsRegistry, c.devicesConfig, device.DeviceId, c.options.OutputId, value)
+	if err != nil {
+		return err
+	}
+	log.Info().
+		Str("device", device.Attributes.Name).
+		Str("outputId", target.OutputId).
+		Float64("value", target.Value).
+		Msg("Setting value.")
+	return c.dsClient.DeviceSetOutputValues(device.DeviceId, []digitalstrom.OutputTarget{target})
+}
+
+func (c *Cli) dump() error {
+	raw, err := c.dsClient.GetApartmentRaw()
+	if err != nil {
+		return fmt.Errorf("error getting the apartment: %w", err)
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, raw, "", "  "); err != nil {
+		return fmt.Errorf("error parsing the apartment: %w", err)
+	}
+	indented.WriteString("\n")
+
+	if c.options.File == "" {
+		_, err := indented.WriteTo(c.out)
+		return err
+	}
+	if err := os.WriteFile(c.options.File, indented.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing '%s': %w", c.options.File, err)
+	}
+	log.Info().Str("file", c.options.File).Msg("Apartment written.")
+	return nil
+}
+
+// Finds a device by id, dsid or name.
+func (c *Cli) findDevice(query string) (digitalstrom.Device, error) {
+	if device, err := c.dsRegistry.GetDevice(query); err == nil {
+		return device, nil
+	}
+	devices, err := c.dsRegistry.GetDevices()
+	if err != nil {
+		return digitalstrom.Device{}, err
+	}
+	matches := []digitalstrom.Device{}
+	for _, device := range devices {
+		if device.Attributes.Dsid == query || strings.EqualFold(device.Attributes.Name, query) {
+			matches = append(matches, device)
+		}
+	}
+	if len(matches) == 0 {
+		return digitalstrom.Device{}, fmt.Errorf("no device found matching '%s'", query)
+	}
+	if len(matches) > 1 {
+		return digitalstrom.Device{}, fmt.Errorf("%d devices match '%s', use the device id instead", len(matches), query)
+	}
+	return matches[0], nil
+}
+
+func (c *Cli) zoneName(zoneId string) string {
+	if zone, err := c.dsRegistry.GetZone(zoneId); err == nil && zone.Attributes.Name != "" {
+		return zone.Attributes.Name
+	}
+	return zoneId
+}
+
+// Prints the rows either as JSON or as a table with the given header.
+func (c *Cli) print(rows interface{}, header []string, printRows func(w io.Writer)) error {
+	if c.options.Format == "json" {
+		encoder := json.NewEncoder(c.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	printRows(w)
+	return w.Flush()
+}
@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+)
+
+const apartment = `{"data": {
+  "id": "apartment",
+  "included": {
+    "dsDevices": [
+      {"id": "d1", "attributes": {"name": "Lamp", "dsid": "dsid1", "zone": "z1", "present": true, "submodules": ["s1"]}},
+      {"id": "d2", "attributes": {"name": "Blind", "dsid": "dsid2", "zone": "z1", "present": false, "submodules": ["s2"]}}
+    ],
+    "submodules": [
+      {"id": "s1", "attributes": {"functionBlocks": ["f1"], "application": "lights"}},
+      {"id": "s2", "attributes": {"functionBlocks": ["f2"], "application": "shades"}}
+    ],
+    "functionBlocks": [
+      {"id": "f1", "attributes": {"technicalName": "GE-KM200", "outputs": [{"id": "brightness", "attributes": {"min": 0, "max": 100}}]}},
+      {"id": "f2", "attributes": {"technicalName": "GR-KL200", "outputs": [{"id": "shadePositionOutside"}]}}
+    ],
+    "zones": [{"id": "z1", "attributes": {"name": "Kitchen"}}]
+  }
+}}`
+
+// Fake dSS recording the requests modifying the installation.
+func newFakeDss(t *testing.T, requests *[]string) *Cli {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/apartment":
+			io.WriteString(w, apartment)
+		case "/api/v1/apartment/meterings":
+			io.WriteString(w, `{"data": {"meterings": []}}`)
+		case "/api/v1/apartment/status":
+			io.WriteString(w, `{"data": {"included": {"dsDevices": []}}}`)
+		default:
+			body, _ := io.ReadAll(r.Body)
+			*requests = append(*requests, r.Method+" "+r.URL.Path+" "+string(body))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	serverUrl, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverUrl.Port())
+	c, err := NewCli(&config.ConfigDigitalstrom{Host: serverUrl.Hostname(), Port: port, ApiKey: "key"}, &config.Config{}, Options{Format: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestListDevices(t *testing.T) {
+	c := newFakeDss(t, &[]string{})
+	out := &bytes.Buffer{}
+	c.out = out
+	if err := c.Run("list-devices"); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []deviceRow
+	if err := json.Unmarshal(out.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 devices but got %d", len(rows))
+	}
+	if rows[0].Name != "Blind" || rows[0].Zone != "Kitchen" || rows[0].Type != "blind" || rows[0].Present {
+		t.Errorf("Unexpected first device: %+v", rows[0])
+	}
+	if rows[1].Name != "Lamp" || rows[1].Type != "light" || rows[1].Outputs[0] != "brightness" {
+		t.Errorf("Unexpected second device: %+v", rows[1])
+	}
+}
+
+func TestSetByName(t *testing.T) {
+	requests := []string{}
+	c := newFakeDss(t, &requests)
+	c.options.Device = "lamp"
+	c.options.Value = "42"
+	if err := c.Run("set"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 || !strings.HasPrefix(requests[0], "PATCH /api/v1/apartment/dsDevices/d1/status") ||
+		!strings.Contains(requests[0], `"path":"/functionBlocks/f1/outputs/brightness/value","value":"42"`) {
+		t.Errorf("Unexpected requests: %v", requests)
+	}
+}
+
+func TestSetChecksTheCommand(t *testing.T) {
+	enabled := true
+	readOnly := &config.Config{Overrides: config.Overrides{Devices: []config.DeviceOverride{
+		{Name: "Lamp", Override: config.Override{ReadOnly: &enabled}},
+	}}}
+	tests := []struct {
+		options       Options
+		devicesConfig *config.Config
+		err           string
+	}{
+		{Options{Device: "lamp", Value: "150"}, &config.Config{}, "out of range"},
+		{Options{Device: "lamp", Value: "42"}, readOnly, "read-only"},
+		{Options{Device: "lamp", Action: "app.on"}, readOnly, "read-only"},
+	}
+	for _, test := range tests {
+		requests := []string{}
+		c := newFakeDss(t, &requests)
+		c.options = test.options
+		c.devicesConfig = test.devicesConfig
+		if err := c.Run("set"); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%+v: expected a '%s' error but got %v", test.options, test.err, err)
+		}
+		if len(requests) != 0 {
+			t.Errorf("%+v: unexpected requests: %v", test.options, requests)
+		}
+	}
+}
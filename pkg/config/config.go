@@ -1,7 +1,16 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
@@ -14,6 +23,10 @@ type ConfigDigitalstrom struct {
 	// Deprecated: use apiKey instead
 	Password string
 	ApiKey   string
+	// File in which the traffic with the dSS is recorded.
+	CaptureFile string
+	// Capture file replayed instead of connecting to a dSS.
+	ReplayFile string
 }
 type ConfigMqtt struct {
 	MqttUrl             string
@@ -22,26 +35,101 @@ type ConfigMqtt struct {
 	TopicPrefix         string
 	NormalizeDeviceName bool
 	Retain              bool
+	Deduplicate         bool
 }
 type ConfigHomeAssistant struct {
 	DiscoveryEnabled     bool
 	DiscoveryTopicPrefix string
 	RemoveRegexpFromName string
 	DigitalStromHost     string
+	DeviceDiscovery      bool
 }
 type HealthCheckConfig struct {
-	Port int
+	Port                 int
+	ExportValues         bool
+	NotificationMaxAge   int
+	WebsocketMaxDowntime int
+}
+type ApiConfig struct {
+	Enabled          bool
+	Token            string
+	DashboardEnabled bool
 }
 type Config struct {
 	Digitalstrom         ConfigDigitalstrom
 	Mqtt                 ConfigMqtt
 	HomeAssistant        ConfigHomeAssistant
 	HealthCheck          HealthCheckConfig
+	Api                  ApiConfig
 	RefreshAtStart       bool
 	LogLevel             string
 	InvertBlindsPosition bool
 	MeteringsEnabled     bool
 	MeteringsInterval    int
+	// Directory of the files written by the bridge, e.g. the state of the
+	// energy counters.
+	DataDir            string
+	MeteringsStateFile string
+	MeteringsDeadbands map[string]Deadband
+	PublishMaxSilence  int
+	// How the state of an output is published after a command: optimistic,
+	// confirm or none.
+	CommandStateMode string
+	// Delay in seconds for the dSS to confirm a command in confirm mode.
+	CommandConfirmTimeout int
+	// Number of devices for which commands are sent in parallel.
+	CommandWorkers int
+	// Maximum number of commands sent to the dSS per second, 0 for no limit.
+	CommandRateLimit int
+	// Settings per zone and per device, only available in the config file.
+	Overrides Overrides
+}
+
+const redacted = "REDACTED"
+
+// Redacted returns a copy of the config with the secrets (API key, passwords
+// and tokens) replaced, safe to be logged or shared.
+func (c Config) Redacted() Config {
+	redact := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return redacted
+	}
+	c.Digitalstrom.ApiKey = redact(c.Digitalstrom.ApiKey)
+	c.Digitalstrom.Password = redact(c.Digitalstrom.Password)
+	c.Mqtt.Password = redact(c.Mqtt.Password)
+	c.Api.Token = redact(c.Api.Token)
+	return c
+}
+
+// Secrets returns the secrets of the config, e.g. to redact them from the
+// logs.
+func (c Config) Secrets() []string {
+	return []string{c.Digitalstrom.ApiKey, c.Digitalstrom.Password, c.Mqtt.Password, c.Api.Token}
+}
+
+// Minimum change of a value required before publishing it again. The change
+// is either absolute or relative to the last published value.
+type Deadband struct {
+	Value   float64
+	Percent bool
+}
+
+// Returns whether the change between the previous and current values is big
+// enough to go through the deadband.
+func (d Deadband) Exceeded(previous float64, current float64) bool {
+	delta := math.Abs(current - previous)
+	if d.Percent {
+		if previous == 0 {
+			return delta > 0
+		}
+		return delta*100/math.Abs(previous) >= d.Value
+	}
+	if d.Value == 0 {
+		return delta > 0
+	}
+	return delta >= d.Value
 }
 
 const (
@@ -53,6 +141,7 @@ const (
 	envKeyDigitalstromUsername              string = "digitalstrom_username"
 	envKeyDigitalstromPassword              string = "digitalstrom_password"
 	envKeyDigitalstromApiKey                string = "digitalstrom_api_key"
+	envKeyDigitalstromCaptureFile           string = "digitalstrom_capture_file"
 	envKeyMqttUrl                           string = "mqtt_url"
 	envKeyMqttUsername                      string = "mqtt_username"
 	envKeyMqttPassword                      string = "mqtt_password"
@@ -60,15 +149,35 @@ const (
 	envKeyMqttTopicPrefix                   string = "mqtt_topic_prefix"
 	envKeyMqttNormalizeTopicName            string = "mqtt_normalize_device_name"
 	envKeyMqttRetain                        string = "mqtt_retain"
+	envKeyMqttDeduplicate                   string = "mqtt_deduplicate"
 	envKeyInvertBlindsPosition              string = "invert_blinds_position"
 	envKeyMeteringsEnabled                  string = "meterings_enabled"
 	envKeyMeteringsInterval                 string = "meterings_interval_seconds"
+	envKeyMeteringsStateFile                string = "meterings_state_file"
+	envKeyDataDir                           string = "data_dir"
+	envKeyMeteringsDeadband                 string = "meterings_deadband"
+	envKeyPublishMaxSilence                 string = "publish_max_silence_seconds"
 	envKeyRefreshAtStart                    string = "refresh_at_start"
 	envKeyLogLevel                          string = "log_level"
 	envKeyHomeAssistantDiscoveryEnabled     string = "home_assistant_discovery_enabled"
 	envKeyHomeAssistantDiscoveryPrefix      string = "home_assistant_discovery_prefix"
 	envKeyHomeAssistantRemoveRegexpFromName string = "home_assistant_remove_regexp_from_name"
+	envKeyHomeAssistantDeviceDiscovery      string = "home_assistant_device_discovery"
 	envKeyHealthCheckPort                   string = "healthcheck_port"
+	envKeyMetricsExportValues               string = "metrics_export_values"
+	envKeyHealthCheckNotificationMaxAge     string = "healthcheck_notification_max_age_seconds"
+	envKeyHealthCheckWebsocketMaxDowntime   string = "healthcheck_websocket_max_downtime_seconds"
+	envKeyApiEnabled                        string = "api_enabled"
+	envKeyApiToken                          string = "api_token"
+	envKeyDashboardEnabled                  string = "dashboard_enabled"
+	envKeyCommandStateMode                  string = "command_state_mode"
+	envKeyCommandConfirmTimeout             string = "command_confirm_timeout_seconds"
+	envKeyCommandWorkers                    string = "command_workers"
+	envKeyCommandRateLimit                  string = "command_rate_limit"
+	// Sections of the config file without environment variable.
+	envKeyZones   string = "zones"
+	envKeyDevices string = "devices"
+	envKeyOutputs string = "outputs"
 )
 
 var defaultConfig = map[string]interface{}{
@@ -77,6 +186,7 @@ var defaultConfig = map[string]interface{}{
 	envKeyDigitalstromUsername:              deprecated,
 	envKeyDigitalstromPassword:              deprecated,
 	envKeyDigitalstromApiKey:                undefined,
+	envKeyDigitalstromCaptureFile:           "",
 	envKeyMqttUrl:                           undefined,
 	envKeyMqttUsername:                      "",
 	envKeyMqttPassword:                      "",
@@ -84,19 +194,52 @@ var defaultConfig = map[string]interface{}{
 	envKeyMqttTopicFormat:                   deprecated,
 	envKeyMqttNormalizeTopicName:            true,
 	envKeyMqttRetain:                        true,
+	envKeyMqttDeduplicate:                   false,
 	envKeyRefreshAtStart:                    true,
 	envKeyLogLevel:                          "INFO",
 	envKeyInvertBlindsPosition:              false,
 	envKeyMeteringsEnabled:                  true,
 	envKeyMeteringsInterval:                 10,
+	envKeyMeteringsStateFile:                "meterings-state.json",
+	envKeyDataDir:                           ".",
+	envKeyMeteringsDeadband:                 "",
+	envKeyPublishMaxSilence:                 300,
 	envKeyHomeAssistantDiscoveryEnabled:     true,
 	envKeyHomeAssistantDiscoveryPrefix:      "homeassistant",
 	envKeyHomeAssistantRemoveRegexpFromName: "",
+	envKeyHomeAssistantDeviceDiscovery:      false,
 	envKeyHealthCheckPort:                   8080,
+	envKeyMetricsExportValues:               false,
+	envKeyHealthCheckNotificationMaxAge:     0,
+	envKeyHealthCheckWebsocketMaxDowntime:   600,
+	envKeyApiEnabled:                        false,
+	envKeyApiToken:                          "",
+	envKeyDashboardEnabled:                  false,
+	envKeyCommandStateMode:                  "optimistic",
+	envKeyCommandConfirmTimeout:             5,
+	envKeyCommandWorkers:                    4,
+	envKeyCommandRateLimit:                  10,
 }
 
-// FromEnv returns a Config from env variables
-func ReadConfig() (*Config, error) {
+var commandStateModes = []string{"optimistic", "confirm", "none"}
+
+// Keys of the config holding secrets. Each of them can alternatively be read
+// from the file given by the same key suffixed with "_file", e.g.
+// DIGITALSTROM_API_KEY_FILE.
+var secretKeys = []string{
+	envKeyDigitalstromApiKey,
+	envKeyMqttPassword,
+	envKeyApiToken,
+}
+
+// Reference to an environment variable in a config value.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Loads the config file and the env variables into viper, then resolves the
+// environment references and the secrets stored in files.
+func loadConfig() error {
+	// Start from scratch as the resolved values are stored in viper.
+	viper.Reset()
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	// Set the current directory where the binary is being run.
@@ -113,6 +256,100 @@ func ReadConfig() (*Config, error) {
 		log.Info().Err(err).Msg("No config file found, using environment variables only")
 	}
 
+	if err := interpolateEnv(); err != nil {
+		return err
+	}
+	return readSecretFiles()
+}
+
+// Replaces the ${VAR} references in the string values with the content of
+// the environment variables.
+func interpolateEnv() error {
+	keys := viper.AllKeys()
+	for key := range defaultConfig {
+		keys = append(keys, key, key+"_file")
+	}
+	for _, key := range keys {
+		value, ok := viper.Get(key).(string)
+		if !ok || !strings.Contains(value, "${") {
+			continue
+		}
+		var missing []string
+		expanded := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+			name := envReference.FindStringSubmatch(reference)[1]
+			content, found := os.LookupEnv(name)
+			if !found {
+				missing = append(missing, name)
+			}
+			return content
+		})
+		if len(missing) > 0 {
+			return fmt.Errorf("environment variable %s referenced by %s is not set", strings.Join(missing, ", "), key)
+		}
+		viper.Set(key, expanded)
+	}
+	return nil
+}
+
+// Reads the secrets given as files (e.g. Docker or Kubernetes secrets).
+func readSecretFiles() error {
+	for _, key := range secretKeys {
+		fileKey := key + "_file"
+		file := viper.GetString(fileKey)
+		if file == "" {
+			continue
+		}
+		if viper.IsSet(key) && viper.GetString(key) != "" {
+			return fmt.Errorf("both %s and %s are set, only one is allowed", key, fileKey)
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %w", fileKey, err)
+		}
+		viper.Set(key, strings.TrimSpace(string(content)))
+	}
+	return nil
+}
+
+// ReadDigitalstromConfig returns only the digitalSTROM part of the config,
+// without requiring the other fields to be set. This is used by the modes
+// talking to the dSS without starting the bridge.
+func ReadDigitalstromConfig() (*ConfigDigitalstrom, error) {
+	if err := loadConfig(); err != nil {
+		return nil, err
+	}
+	return &ConfigDigitalstrom{
+		Host:   viper.GetString(envKeyDigitalstromHost),
+		Port:   viper.GetInt(envKeyDigitalstromPort),
+		ApiKey: viper.GetString(envKeyDigitalstromApiKey),
+	}, nil
+}
+
+// ReadDevicesConfig returns a config with only the settings of the devices,
+// i.e. their overrides and the inversion of the blinds position, without
+// requiring the other fields to be set. This is used by the CLI to check the
+// commands like the bridge.
+func ReadDevicesConfig() (*Config, error) {
+	if err := loadConfig(); err != nil {
+		return nil, err
+	}
+	overrides, err := readOverrides()
+	if err != nil {
+		return nil, err
+	}
+	return &Config{
+		InvertBlindsPosition: viper.GetBool(envKeyInvertBlindsPosition),
+		Overrides:            overrides,
+	}, nil
+}
+
+// FromEnv returns a Config from env variables
+func ReadConfig() (*Config, error) {
+	err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	// Check for deprecated and undefined fields.
 	for fieldName, defaultValue := range defaultConfig {
 		if defaultValue == deprecated && viper.IsSet(fieldName) {
@@ -125,11 +362,12 @@ func ReadConfig() (*Config, error) {
 
 	config := &Config{
 		Digitalstrom: ConfigDigitalstrom{
-			Host:     viper.GetString(envKeyDigitalstromHost),
-			Port:     viper.GetInt(envKeyDigitalstromPort),
-			Username: viper.GetString(envKeyDigitalstromUsername),
-			Password: viper.GetString(envKeyDigitalstromPassword),
-			ApiKey:   viper.GetString(envKeyDigitalstromApiKey),
+			Host:        viper.GetString(envKeyDigitalstromHost),
+			Port:        viper.GetInt(envKeyDigitalstromPort),
+			Username:    viper.GetString(envKeyDigitalstromUsername),
+			Password:    viper.GetString(envKeyDigitalstromPassword),
+			ApiKey:      viper.GetString(envKeyDigitalstromApiKey),
+			CaptureFile: viper.GetString(envKeyDigitalstromCaptureFile),
 		},
 		Mqtt: ConfigMqtt{
 			MqttUrl:             viper.GetString(envKeyMqttUrl),
@@ -138,30 +376,142 @@ func ReadConfig() (*Config, error) {
 			TopicPrefix:         viper.GetString(envKeyMqttTopicPrefix),
 			NormalizeDeviceName: viper.GetBool(envKeyMqttNormalizeTopicName),
 			Retain:              viper.GetBool(envKeyMqttRetain),
+			Deduplicate:         viper.GetBool(envKeyMqttDeduplicate),
 		},
 		HomeAssistant: ConfigHomeAssistant{
 			DiscoveryEnabled:     viper.GetBool(envKeyHomeAssistantDiscoveryEnabled),
 			DiscoveryTopicPrefix: viper.GetString(envKeyHomeAssistantDiscoveryPrefix),
 			RemoveRegexpFromName: viper.GetString(envKeyHomeAssistantRemoveRegexpFromName),
 			DigitalStromHost:     viper.GetString(envKeyDigitalstromHost),
+			DeviceDiscovery:      viper.GetBool(envKeyHomeAssistantDeviceDiscovery),
 		},
 		HealthCheck: HealthCheckConfig{
-			Port: viper.GetInt(envKeyHealthCheckPort),
+			Port:                 viper.GetInt(envKeyHealthCheckPort),
+			ExportValues:         viper.GetBool(envKeyMetricsExportValues),
+			NotificationMaxAge:   viper.GetInt(envKeyHealthCheckNotificationMaxAge),
+			WebsocketMaxDowntime: viper.GetInt(envKeyHealthCheckWebsocketMaxDowntime),
 		},
-		RefreshAtStart:       viper.GetBool(envKeyRefreshAtStart),
-		LogLevel:             viper.GetString(envKeyLogLevel),
-		InvertBlindsPosition: viper.GetBool(envKeyInvertBlindsPosition),
-		MeteringsEnabled:     viper.GetBool(envKeyMeteringsEnabled),
-		MeteringsInterval:    viper.GetInt(envKeyMeteringsInterval),
+		Api: ApiConfig{
+			Enabled:          viper.GetBool(envKeyApiEnabled),
+			Token:            viper.GetString(envKeyApiToken),
+			DashboardEnabled: viper.GetBool(envKeyDashboardEnabled),
+		},
+		RefreshAtStart:        viper.GetBool(envKeyRefreshAtStart),
+		LogLevel:              viper.GetString(envKeyLogLevel),
+		InvertBlindsPosition:  viper.GetBool(envKeyInvertBlindsPosition),
+		MeteringsEnabled:      viper.GetBool(envKeyMeteringsEnabled),
+		MeteringsInterval:     viper.GetInt(envKeyMeteringsInterval),
+		DataDir:               viper.GetString(envKeyDataDir),
+		MeteringsStateFile:    viper.GetString(envKeyMeteringsStateFile),
+		PublishMaxSilence:     viper.GetInt(envKeyPublishMaxSilence),
+		CommandStateMode:      viper.GetString(envKeyCommandStateMode),
+		CommandConfirmTimeout: viper.GetInt(envKeyCommandConfirmTimeout),
+		CommandWorkers:        viper.GetInt(envKeyCommandWorkers),
+		CommandRateLimit:      viper.GetInt(envKeyCommandRateLimit),
 	}
 
 	if config.MeteringsInterval < 1 {
 		return nil, fmt.Errorf("%s must be at least 1", envKeyMeteringsInterval)
 	}
+	if config.PublishMaxSilence < 0 {
+		return nil, fmt.Errorf("%s must not be negative", envKeyPublishMaxSilence)
+	}
+	if !slices.Contains(commandStateModes, config.CommandStateMode) {
+		return nil, fmt.Errorf("%s must be one of %s", envKeyCommandStateMode, strings.Join(commandStateModes, ", "))
+	}
+	if config.CommandConfirmTimeout < 1 {
+		return nil, fmt.Errorf("%s must be at least 1", envKeyCommandConfirmTimeout)
+	}
+	if config.CommandWorkers < 1 {
+		return nil, fmt.Errorf("%s must be at least 1", envKeyCommandWorkers)
+	}
+	if config.CommandRateLimit < 0 {
+		return nil, fmt.Errorf("%s must not be negative", envKeyCommandRateLimit)
+	}
+	// The API can change the outputs, it is not served without a token.
+	if config.Api.Enabled && config.Api.Token == "" {
+		return nil, fmt.Errorf("%s is required when %s is true", envKeyApiToken, envKeyApiEnabled)
+	}
+	if _, err := regexp.Compile(config.HomeAssistant.RemoveRegexpFromName); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", envKeyHomeAssistantRemoveRegexpFromName, err)
+	}
+	// A relative state file is stored in the data directory.
+	if config.MeteringsStateFile != "" && !filepath.IsAbs(config.MeteringsStateFile) {
+		config.MeteringsStateFile = filepath.Join(config.DataDir, config.MeteringsStateFile)
+	}
+	config.MeteringsDeadbands, err = parseDeadbands(viper.GetString(envKeyMeteringsDeadband))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", envKeyMeteringsDeadband, err)
+	}
+	config.Overrides, err = readOverrides()
+	if err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
 
+// Parses a list of deadbands per unit, e.g. "W=5,Wh=1%".
+func parseDeadbands(value string) (map[string]Deadband, error) {
+	deadbands := map[string]Deadband{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		unit, band, found := strings.Cut(entry, "=")
+		unit = strings.TrimSpace(unit)
+		band = strings.TrimSpace(band)
+		if !found || unit == "" || band == "" {
+			return nil, fmt.Errorf("expected 'unit=value' or 'unit=value%%' but got '%s'", entry)
+		}
+		deadband := Deadband{}
+		if strings.HasSuffix(band, "%") {
+			deadband.Percent = true
+			band = strings.TrimSuffix(band, "%")
+		}
+		v, err := strconv.ParseFloat(band, 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid deadband value for unit '%s': '%s'", unit, band)
+		}
+		deadband.Value = v
+		deadbands[unit] = deadband
+	}
+	return deadbands, nil
+}
+
+// String returns the config with its secrets redacted, so that it can be
+// logged.
 func (c *Config) String() string {
-	return fmt.Sprintf("%+v\n", c.Digitalstrom)
+	redacted := c.Redacted()
+	return fmt.Sprintf("%+v\n", redacted.Digitalstrom)
+}
+
+// WriteApiKey sets the digitalSTROM API key in the given YAML config file,
+// replacing the existing key if any and keeping the rest of the file as is.
+// The file is created when it does not exist.
+func WriteApiKey(file string, apiKey string) error {
+	content, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+	// The key as written, with its indentation, and the trailing comment
+	// are kept.
+	keyLine := regexp.MustCompile(`(?im)^([ \t]*` + envKeyDigitalstromApiKey + `[ \t]*:[ \t]*)[^#\r\n]*?([ \t]+#.*)?$`)
+	updated := string(content)
+	if keyLine.MatchString(updated) {
+		updated = keyLine.ReplaceAllStringFunc(updated, func(line string) string {
+			parts := keyLine.FindStringSubmatch(line)
+			return parts[1] + apiKey + parts[2]
+		})
+	} else {
+		if len(updated) > 0 && !strings.HasSuffix(updated, "\n") {
+			updated += "\n"
+		}
+		updated += envKeyDigitalstromApiKey + ": " + apiKey + "\n"
+	}
+	if err := os.WriteFile(file, []byte(updated), 0600); err != nil {
+		return fmt.Errorf("unable to write config file: %w", err)
+	}
+	return nil
 }
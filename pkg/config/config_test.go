@@ -1,9 +1,14 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,6 +28,7 @@ func TestReadConfig(t *testing.T) {
 	assert.Equal(t, "digitalstrom", c.Mqtt.TopicPrefix, "MQTT prefix is wrong.")
 	assert.True(t, c.MeteringsEnabled, "Meterings should be enabled by default.")
 	assert.Equal(t, 10, c.MeteringsInterval, "Meterings interval is wrong.")
+	assert.False(t, c.Api.DashboardEnabled, "Dashboard should be disabled by default.")
 }
 
 func TestReadConfigWithMeteringsEnv(t *testing.T) {
@@ -42,6 +48,41 @@ func TestReadConfigWithMeteringsEnv(t *testing.T) {
 	assert.Equal(t, 300, c.MeteringsInterval, "Meterings interval setting is wrong.")
 }
 
+func TestReadConfigWithDataDir(t *testing.T) {
+	os.Setenv("DIGITALSTROM_HOST", "test_ip")
+	os.Setenv("DIGITALSTROM_API_KEY", "foo")
+	os.Setenv("DATA_DIR", "/data")
+	defer os.Clearenv()
+
+	c, err := ReadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "/data/meterings-state.json", c.MeteringsStateFile)
+
+	os.Setenv("METERINGS_STATE_FILE", "/var/lib/meterings.json")
+	c, err = ReadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "/var/lib/meterings.json", c.MeteringsStateFile)
+}
+
+func TestReadConfigWithApiWithoutToken(t *testing.T) {
+	os.Setenv("DIGITALSTROM_HOST", "test_ip")
+	os.Setenv("DIGITALSTROM_API_KEY", "foo")
+	defer os.Clearenv()
+
+	c, err := ReadConfig()
+	assert.NoError(t, err)
+	assert.False(t, c.Api.Enabled, "The API should be disabled by default.")
+
+	os.Setenv("API_ENABLED", "true")
+	_, err = ReadConfig()
+	assert.EqualError(t, err, "api_token is required when api_enabled is true")
+
+	os.Setenv("API_TOKEN", "secret")
+	c, err = ReadConfig()
+	assert.NoError(t, err)
+	assert.True(t, c.Api.Enabled)
+}
+
 func TestReadConfigWithInvalidMeteringsInterval(t *testing.T) {
 	os.Setenv("DIGITALSTROM_HOST", "test_ip")
 	os.Setenv("DIGITALSTROM_API_KEY", "foo")
@@ -80,3 +121,321 @@ func TestReadConfigWithDeprecatedFields(t *testing.T) {
 	assert.EqualError(t, err, "deprecated field found in config: digitalstrom_password")
 	os.Clearenv()
 }
+
+func TestReadConfigWithMeteringsDeadband(t *testing.T) {
+	os.Setenv("DIGITALSTROM_HOST", "test_ip")
+	os.Setenv("DIGITALSTROM_API_KEY", "foo")
+	os.Setenv("METERINGS_DEADBAND", "W=5, Wh=1.5%")
+	defer os.Clearenv()
+
+	c, err := ReadConfig()
+	if err != nil {
+		t.Fail()
+		t.Logf("Error found: %s", err.Error())
+	}
+
+	assert.Equal(t, Deadband{Value: 5}, c.MeteringsDeadbands["W"])
+	assert.Equal(t, Deadband{Value: 1.5, Percent: true}, c.MeteringsDeadbands["Wh"])
+	assert.Equal(t, 300, c.PublishMaxSilence, "Max silence is wrong.")
+}
+
+func TestReadConfigWithInvalidMeteringsDeadband(t *testing.T) {
+	os.Setenv("DIGITALSTROM_HOST", "test_ip")
+	os.Setenv("DIGITALSTROM_API_KEY", "foo")
+	os.Setenv("METERINGS_DEADBAND", "W")
+	defer os.Clearenv()
+
+	_, err := ReadConfig()
+	assert.EqualError(t, err, "invalid meterings_deadband: expected 'unit=value' or 'unit=value%' but got 'W'")
+}
+
+func TestDeadbandExceeded(t *testing.T) {
+	assert.False(t, Deadband{}.Exceeded(10, 10))
+	assert.True(t, Deadband{}.Exceeded(10, 10.1))
+	assert.False(t, Deadband{Value: 5}.Exceeded(100, 104))
+	assert.True(t, Deadband{Value: 5}.Exceeded(100, 95))
+	assert.False(t, Deadband{Value: 10, Percent: true}.Exceeded(200, 215))
+	assert.True(t, Deadband{Value: 10, Percent: true}.Exceeded(200, 220))
+	assert.True(t, Deadband{Value: 10, Percent: true}.Exceeded(0, 1))
+}
+
+func TestWriteApiKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+
+	assert.NoError(t, WriteApiKey(file, "first"))
+	content, _ := os.ReadFile(file)
+	assert.Equal(t, "digitalstrom_api_key: first\n", string(content))
+
+	os.WriteFile(file, []byte("# dSS\nDIGITALSTROM_HOST: 192.168.1.1\nDIGITALSTROM_API_KEY: old # rotated yearly\nMQTT_URL: tcp://broker:1883"), 0600)
+	assert.NoError(t, WriteApiKey(file, "second"))
+	content, _ = os.ReadFile(file)
+	assert.Equal(t, "# dSS\nDIGITALSTROM_HOST: 192.168.1.1\nDIGITALSTROM_API_KEY: second # rotated yearly\nMQTT_URL: tcp://broker:1883", string(content))
+
+	os.WriteFile(file, []byte("digitalstrom_api_key:old\n"), 0600)
+	assert.NoError(t, WriteApiKey(file, "with$1dollar"))
+	content, _ = os.ReadFile(file)
+	assert.Equal(t, "digitalstrom_api_key:with$1dollar\n", string(content))
+}
+
+func TestReadConfigWithSecretFile(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "api_token")
+	os.WriteFile(secret, []byte("from_file\n"), 0600)
+	os.Setenv("DIGITALSTROM_HOST", "test_ip")
+	os.Setenv("DIGITALSTROM_API_KEY", "foo")
+	os.Setenv("API_TOKEN_FILE", secret)
+	defer os.Clearenv()
+
+	c, err := ReadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "from_file", c.Api.Token)
+}
+
+func TestReadConfigWithSecretAndSecretFile(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "api_key")
+	os.WriteFile(secret, []byte("from_file"), 0600)
+	os.Setenv("DIGITALSTROM_HOST", "test_ip")
+	os.Setenv("DIGITALSTROM_API_KEY", "foo")
+	os.Setenv("DIGITALSTROM_API_KEY_FILE", secret)
+	defer os.Clearenv()
+
+	_, err := ReadConfig()
+	assert.EqualError(t, err, "both digitalstrom_api_key and digitalstrom_api_key_file are set, only one is allowed")
+}
+
+func TestReadConfigWithEnvReference(t *testing.T) {
+	os.Setenv("DIGITALSTROM_HOST", "${DSS_HOST}")
+	os.Setenv("DSS_HOST", "test_ip")
+	os.Setenv("DIGITALSTROM_API_KEY", "foo")
+	defer os.Clearenv()
+
+	c, err := ReadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "test_ip", c.Digitalstrom.Host)
+}
+
+func TestReadConfigWithMissingEnvReference(t *testing.T) {
+	os.Setenv("DIGITALSTROM_HOST", "test_ip")
+	os.Setenv("DIGITALSTROM_API_KEY", "${DSS_API_KEY}")
+	defer os.Clearenv()
+
+	_, err := ReadConfig()
+	assert.EqualError(t, err, "environment variable DSS_API_KEY referenced by digitalstrom_api_key is not set")
+}
+
+func TestConfigStringIsRedacted(t *testing.T) {
+	c := Config{Digitalstrom: ConfigDigitalstrom{Host: "test_ip", ApiKey: "4f2a9c"}}
+
+	assert.Contains(t, c.String(), "test_ip")
+	assert.NotContains(t, c.String(), "4f2a9c")
+}
+
+func TestValidate(t *testing.T) {
+	os.Setenv("MQTT_URL", "tcp://broker:70000")
+	os.Setenv("HEALTHCHECK_PORT", "0")
+	os.Setenv("HOME_ASSISTANT_REMOVE_REGEXP_FROM_NAME", "(abc")
+	defer os.Clearenv()
+
+	problems := []string{}
+	for _, problem := range Validate() {
+		problems = append(problems, problem.Key)
+	}
+	assert.ElementsMatch(t, []string{"healthcheck_port", "mqtt_url", "home_assistant_remove_regexp_from_name"}, problems)
+}
+
+func TestSuggestKey(t *testing.T) {
+	assert.Equal(t, "did you mean mqtt_username?", suggestKey("mqt_username"))
+	assert.Equal(t, "", suggestKey("something_else"))
+}
+
+func TestJSONSchemaIsUpToDate(t *testing.T) {
+	schema, err := JSONSchema()
+	assert.NoError(t, err)
+	committed, err := os.ReadFile("../../docs/config.schema.json")
+	assert.NoError(t, err)
+	assert.Equal(t, string(committed), string(schema), "run 'go run . -mode=config-schema > docs/config.schema.json'")
+}
+
+func TestJSONSchemaAcceptsTheExample(t *testing.T) {
+	data, err := JSONSchema()
+	assert.NoError(t, err)
+	var schema struct {
+		Properties map[string]interface{} `json:"properties"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &schema))
+	example, err := os.ReadFile("../../config.yaml.example")
+	assert.NoError(t, err)
+	for _, line := range strings.Split(strings.TrimSpace(string(example)), "\n") {
+		key, _, _ := strings.Cut(line, ":")
+		assert.Contains(t, schema.Properties, key)
+		assert.Contains(t, schema.Properties, strings.ToLower(key))
+	}
+}
+
+func TestConfigUpdate(t *testing.T) {
+	current := &Config{MeteringsInterval: 10, Mqtt: ConfigMqtt{TopicPrefix: "digitalstrom"}}
+	updated := &Config{MeteringsInterval: 30, Mqtt: ConfigMqtt{TopicPrefix: "dss"}, LogLevel: "DEBUG"}
+
+	next, applied, restart := current.Apply(updated)
+
+	assert.Equal(t, []string{"log_level", "meterings_interval_seconds"}, applied)
+	assert.Equal(t, []string{"mqtt_topic_prefix"}, restart)
+	assert.Equal(t, 30, next.MeteringsInterval)
+	assert.Equal(t, "DEBUG", next.LogLevel)
+	assert.Equal(t, "digitalstrom", next.Mqtt.TopicPrefix, "settings requiring a restart must not be applied")
+	assert.Equal(t, 10, current.MeteringsInterval, "the current config must not be modified")
+}
+
+func TestEverySettingIsCompared(t *testing.T) {
+	for key := range defaultConfig {
+		if _, ok := settings[key]; !ok && defaultConfig[key] != deprecated {
+			t.Errorf("setting %s is missing in the settings compared when reloading", key)
+		}
+	}
+}
+
+func TestReadOverrides(t *testing.T) {
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(`
+zones:
+  - zone: Living room
+    invert_blinds_position: true
+devices:
+  - name: "Blind * West"
+    invert_blinds_position: false
+    device_class: shutter
+  - name: "Joker *"
+    type: light
+  - dsid: 302ed89f43f00e4000000001
+    topic_name: kitchen_light
+    read_only: true
+`))
+	assert.NoError(t, err)
+
+	overrides, err := readOverrides()
+	assert.NoError(t, err)
+
+	defaults := DeviceSettings{Scale: 1}
+	east := overrides.Resolve(defaults, "302ed89f43f00e4000000002", "Blind 1 East", "3", "living room")
+	assert.Equal(t, DeviceSettings{InvertBlindsPosition: true, Scale: 1}, east)
+	west := overrides.Resolve(defaults, "302ed89f43f00e4000000003", "blind 2 west", "3", "Living room")
+	assert.Equal(t, DeviceSettings{DeviceClass: "shutter", Scale: 1}, west)
+	joker := overrides.Resolve(defaults, "302ed89f43f00e4000000004", "Joker lamp", "4", "Kitchen")
+	assert.Equal(t, DeviceSettings{Type: "light", Scale: 1}, joker)
+	kitchen := overrides.Resolve(defaults, "302ED89F43F00E4000000001", "Light", "4", "Kitchen")
+	assert.Equal(t, DeviceSettings{TopicName: "kitchen_light", ReadOnly: true, Scale: 1}, kitchen)
+}
+
+func TestReadOverridesWithUnknownField(t *testing.T) {
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(`
+devices:
+  - name: "Blind *"
+    invert: true
+`))
+	assert.NoError(t, err)
+
+	_, err = readOverrides()
+	assert.ErrorContains(t, err, "invert")
+}
+
+func TestReadOutputOverrides(t *testing.T) {
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(`
+outputs:
+  - type: lightBrightness
+    scale: 2.55
+  - type: lightTemperature
+    kelvin: true
+`))
+	assert.NoError(t, err)
+
+	overrides, err := readOverrides()
+	assert.NoError(t, err)
+	assert.Equal(t, 2.55, *overrides.Output("lightBrightness").Scale)
+	assert.True(t, overrides.Output("lightTemperature").Kelvin)
+	assert.Nil(t, overrides.Output("heatingPower").Scale)
+
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	err = viper.ReadConfig(strings.NewReader(`
+outputs:
+  - type: lightBrightness
+    kelvin: true
+`))
+	assert.NoError(t, err)
+	_, err = readOverrides()
+	assert.ErrorContains(t, err, "kelvin")
+}
+
+func TestReadOverridesWithUnknownType(t *testing.T) {
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(`
+devices:
+  - name: "Joker *"
+    type: lamp
+`))
+	assert.NoError(t, err)
+
+	_, err = readOverrides()
+	assert.ErrorContains(t, err, "lamp")
+}
+
+func TestReadOverridesWithSharedTopicName(t *testing.T) {
+	for name, yaml := range map[string]string{
+		"zone": `
+zones:
+  - zone: Kitchen
+    topic_name: kitchen
+`,
+		"pattern": `
+devices:
+  - name: "Kitchen *"
+    topic_name: kitchen
+`,
+		"duplicate": `
+devices:
+  - dsid: 302ed89f43f00e4000000001
+    topic_name: kitchen
+  - name: "Kitchen light"
+    topic_name: Kitchen
+`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			viper.Reset()
+			viper.SetConfigType("yaml")
+			assert.NoError(t, viper.ReadConfig(strings.NewReader(yaml)))
+
+			_, err := readOverrides()
+			assert.ErrorContains(t, err, "topic_name")
+		})
+	}
+}
+
+func TestWatchFollowsConfigMapUpdates(t *testing.T) {
+	// Layout of a Kubernetes config map mounted as a volume.
+	dir := t.TempDir()
+	writeConfigMapVersion := func(version string) {
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, version), 0o755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, version, "config.yaml"), []byte("log_level: "+version), 0o644))
+		assert.NoError(t, os.Symlink(version, filepath.Join(dir, "..data_tmp")))
+		assert.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	}
+	writeConfigMapVersion("..v1")
+	assert.NoError(t, os.Symlink(filepath.Join("..data", "config.yaml"), filepath.Join(dir, "config.yaml")))
+
+	changed := make(chan struct{}, 1)
+	stop, err := watchFile(filepath.Join(dir, "config.yaml"), func() { changed <- struct{}{} })
+	assert.NoError(t, err)
+	defer stop()
+
+	writeConfigMapVersion("..v2")
+	select {
+	case <-changed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("The update of the config map was not noticed")
+	}
+}
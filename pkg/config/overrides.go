@@ -0,0 +1,262 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/go-viper/mapstructure/v2"
+	"github.com/spf13/viper"
+)
+
+// DeviceSettings are the settings applying to a single device, once the
+// overrides of its zone and of the device itself are resolved.
+type DeviceSettings struct {
+	InvertBlindsPosition bool
+	// Name used in the topics instead of the name of the device.
+	TopicName string
+	// Home Assistant device class of the entity.
+	DeviceClass string
+	// Type of the device, replacing the one inferred from the application
+	// and the outputs of the device when set. One of DeviceTypes.
+	Type string
+	// Factor applied to the values published, the commands being divided by
+	// it. For example 2.55 to publish values between 0 and 255. Unset (0) to
+	// use the scale of the output type.
+	Scale float64
+	// No command is accepted for the device.
+	ReadOnly bool
+	// The device is ignored.
+	Exclude bool
+}
+
+// DeviceTypes are the types of the devices accepted by the overrides, the
+// ones of the classification of the devices module.
+var DeviceTypes = []string{"light", "blind", "awning", "window", "heating", "ventilation", "joker", "unknown"}
+
+// OutputTypes are the types of the outputs of the dSS accepted by the
+// outputs section.
+var OutputTypes = []string{
+	"lightBrightness",
+	"lightHue",
+	"lightSaturation",
+	outputTypeLightTemperature,
+	"lightCieX",
+	"lightCieY",
+	"shadePositionOutside",
+	"shadePositionIndoor",
+	"shadeOpeningAngleOutside",
+	"shadeOpeningAngleIndoor",
+	"shadeTransparency",
+	"airFlowIntensity",
+	"airFlowDirection",
+	"airFlapOpeningAngle",
+	"ventilationLouverPosition",
+	"heatingPower",
+	"coolingCapacity",
+	"audioVolume",
+	"powerState",
+	"ventilationSwingMode",
+	"ventilationAutoIntensity",
+	"waterTemperature",
+	"waterFlowRate",
+	"powerLevel",
+	"videoStation",
+	"videoInputSource",
+}
+
+// The only outputs which can be published in Kelvin.
+const outputTypeLightTemperature = "lightTemperature"
+
+// Override contains the settings overridden for some devices. Unset fields
+// keep the inherited value.
+type Override struct {
+	InvertBlindsPosition *bool    `mapstructure:"invert_blinds_position"`
+	TopicName            string   `mapstructure:"topic_name"`
+	DeviceClass          string   `mapstructure:"device_class"`
+	Type                 string   `mapstructure:"type"`
+	Scale                *float64 `mapstructure:"scale"`
+	ReadOnly             *bool    `mapstructure:"read_only"`
+	Exclude              *bool    `mapstructure:"exclude"`
+}
+
+// ZoneOverride overrides the settings of all the devices of a zone, given by
+// its name or id.
+type ZoneOverride struct {
+	Zone     string `mapstructure:"zone"`
+	Override `mapstructure:",squash"`
+}
+
+// DeviceOverride overrides the settings of the devices matching the dsid or
+// the name, which can be a glob pattern (e.g. "Blind *").
+type DeviceOverride struct {
+	Dsid     string `mapstructure:"dsid"`
+	Name     string `mapstructure:"name"`
+	Override `mapstructure:",squash"`
+}
+
+// OutputOverride sets how the values of the outputs of a type are published.
+type OutputOverride struct {
+	Type  string   `mapstructure:"type"`
+	Scale *float64 `mapstructure:"scale"`
+	// Publish the color temperatures in Kelvin, the dSS using mireds.
+	Kelvin bool `mapstructure:"kelvin"`
+}
+
+// Overrides of the global settings per zone and per device. The device
+// overrides take precedence over the zone ones, and the later entries of a
+// list over the earlier ones.
+type Overrides struct {
+	Zones   []ZoneOverride
+	Devices []DeviceOverride
+	Outputs []OutputOverride
+}
+
+// Output returns the settings of the outputs of a type, the later entries
+// taking precedence over the earlier ones.
+func (o Overrides) Output(outputType string) OutputOverride {
+	result := OutputOverride{Type: outputType}
+	for _, output := range o.Outputs {
+		if output.Type != outputType {
+			continue
+		}
+		if output.Scale != nil {
+			result.Scale = output.Scale
+		}
+		result.Kelvin = result.Kelvin || output.Kelvin
+	}
+	return result
+}
+
+// Resolve returns the settings of a device, starting from the given global
+// settings. Names are compared ignoring the case.
+func (o Overrides) Resolve(settings DeviceSettings, dsid string, name string, zoneId string, zoneName string) DeviceSettings {
+	for _, zone := range o.Zones {
+		if zone.Zone == zoneId || strings.EqualFold(zone.Zone, zoneName) {
+			zone.apply(&settings)
+		}
+	}
+	for _, device := range o.Devices {
+		if device.matches(dsid, name) {
+			device.apply(&settings)
+		}
+	}
+	return settings
+}
+
+func (d DeviceOverride) matches(dsid string, name string) bool {
+	if d.Dsid != "" && !strings.EqualFold(d.Dsid, dsid) {
+		return false
+	}
+	if d.Name != "" {
+		// The pattern is checked when reading the config.
+		matched, _ := path.Match(strings.ToLower(d.Name), strings.ToLower(name))
+		return matched
+	}
+	return d.Dsid != ""
+}
+
+func (o Override) apply(settings *DeviceSettings) {
+	if o.InvertBlindsPosition != nil {
+		settings.InvertBlindsPosition = *o.InvertBlindsPosition
+	}
+	if o.TopicName != "" {
+		settings.TopicName = o.TopicName
+	}
+	if o.DeviceClass != "" {
+		settings.DeviceClass = o.DeviceClass
+	}
+	if o.Type != "" {
+		settings.Type = o.Type
+	}
+	if o.Scale != nil {
+		settings.Scale = *o.Scale
+	}
+	if o.ReadOnly != nil {
+		settings.ReadOnly = *o.ReadOnly
+	}
+	if o.Exclude != nil {
+		settings.Exclude = *o.Exclude
+	}
+}
+
+func (o Override) validate() error {
+	if o.Scale != nil && *o.Scale <= 0 {
+		return fmt.Errorf("scale must be positive but got %g", *o.Scale)
+	}
+	if o.Type != "" && !slices.Contains(DeviceTypes, o.Type) {
+		return fmt.Errorf("type must be one of %v but got '%s'", DeviceTypes, o.Type)
+	}
+	if strings.ContainsAny(o.TopicName, "/+#") {
+		return fmt.Errorf("topic_name must not contain '/', '+' nor '#' but got '%s'", o.TopicName)
+	}
+	return nil
+}
+
+// Reads the zones and devices sections of the config file. Unknown fields
+// are reported as errors to catch typos.
+func readOverrides() (Overrides, error) {
+	overrides := Overrides{}
+	strict := func(c *mapstructure.DecoderConfig) {
+		c.ErrorUnused = true
+	}
+	if err := viper.UnmarshalKey(envKeyZones, &overrides.Zones, strict); err != nil {
+		return overrides, fmt.Errorf("invalid %s: %w", envKeyZones, err)
+	}
+	if err := viper.UnmarshalKey(envKeyDevices, &overrides.Devices, strict); err != nil {
+		return overrides, fmt.Errorf("invalid %s: %w", envKeyDevices, err)
+	}
+	if err := viper.UnmarshalKey(envKeyOutputs, &overrides.Outputs, strict); err != nil {
+		return overrides, fmt.Errorf("invalid %s: %w", envKeyOutputs, err)
+	}
+
+	for i, zone := range overrides.Zones {
+		if zone.Zone == "" {
+			return overrides, fmt.Errorf("invalid %s[%d]: zone must be set", envKeyZones, i)
+		}
+		// The devices of the zone would share the same topics.
+		if zone.TopicName != "" {
+			return overrides, fmt.Errorf("invalid %s[%d]: topic_name can only be set for a single device", envKeyZones, i)
+		}
+		if err := zone.validate(); err != nil {
+			return overrides, fmt.Errorf("invalid %s[%d]: %w", envKeyZones, i, err)
+		}
+	}
+	topicNames := map[string]int{}
+	for i, device := range overrides.Devices {
+		if device.Dsid == "" && device.Name == "" {
+			return overrides, fmt.Errorf("invalid %s[%d]: dsid or name must be set", envKeyDevices, i)
+		}
+		if _, err := path.Match(device.Name, ""); errors.Is(err, path.ErrBadPattern) {
+			return overrides, fmt.Errorf("invalid %s[%d]: invalid name pattern '%s'", envKeyDevices, i, device.Name)
+		}
+		if device.TopicName != "" {
+			// The devices matching a pattern would share the same topics.
+			if device.Dsid == "" && strings.ContainsAny(device.Name, "*?[") {
+				return overrides, fmt.Errorf("invalid %s[%d]: topic_name can only be set for a single device, not for the pattern '%s'", envKeyDevices, i, device.Name)
+			}
+			key := strings.ToLower(device.TopicName)
+			if j, ok := topicNames[key]; ok {
+				return overrides, fmt.Errorf("invalid %s[%d]: topic_name '%s' is already used by %s[%d]", envKeyDevices, i, device.TopicName, envKeyDevices, j)
+			}
+			topicNames[key] = i
+		}
+		if err := device.validate(); err != nil {
+			return overrides, fmt.Errorf("invalid %s[%d]: %w", envKeyDevices, i, err)
+		}
+	}
+	for i, output := range overrides.Outputs {
+		if !slices.Contains(OutputTypes, output.Type) {
+			return overrides, fmt.Errorf("invalid %s[%d]: unknown output type '%s'", envKeyOutputs, i, output.Type)
+		}
+		if output.Scale != nil && *output.Scale <= 0 {
+			return overrides, fmt.Errorf("invalid %s[%d]: scale must be positive but got %g", envKeyOutputs, i, *output.Scale)
+		}
+		if output.Kelvin && output.Type != outputTypeLightTemperature {
+			return overrides, fmt.Errorf("invalid %s[%d]: kelvin is only supported by the %s outputs", envKeyOutputs, i, outputTypeLightTemperature)
+		}
+	}
+	return overrides, nil
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Value of each setting in the Config, used to detect what changed when the
+// config is reloaded.
+var settings = map[string]func(c *Config) interface{}{
+	envKeyDigitalstromHost:                  func(c *Config) interface{} { return c.Digitalstrom.Host },
+	envKeyDigitalstromPort:                  func(c *Config) interface{} { return c.Digitalstrom.Port },
+	envKeyDigitalstromUsername:              func(c *Config) interface{} { return c.Digitalstrom.Username },
+	envKeyDigitalstromPassword:              func(c *Config) interface{} { return c.Digitalstrom.Password },
+	envKeyDigitalstromApiKey:                func(c *Config) interface{} { return c.Digitalstrom.ApiKey },
+	envKeyDigitalstromCaptureFile:           func(c *Config) interface{} { return c.Digitalstrom.CaptureFile },
+	envKeyMqttUrl:                           func(c *Config) interface{} { return c.Mqtt.MqttUrl },
+	envKeyMqttUsername:                      func(c *Config) interface{} { return c.Mqtt.Username },
+	envKeyMqttPassword:                      func(c *Config) interface{} { return c.Mqtt.Password },
+	envKeyMqttTopicPrefix:                   func(c *Config) interface{} { return c.Mqtt.TopicPrefix },
+	envKeyMqttNormalizeTopicName:            func(c *Config) interface{} { return c.Mqtt.NormalizeDeviceName },
+	envKeyMqttRetain:                        func(c *Config) interface{} { return c.Mqtt.Retain },
+	envKeyMqttDeduplicate:                   func(c *Config) interface{} { return c.Mqtt.Deduplicate },
+	envKeyInvertBlindsPosition:              func(c *Config) interface{} { return c.InvertBlindsPosition },
+	envKeyMeteringsEnabled:                  func(c *Config) interface{} { return c.MeteringsEnabled },
+	envKeyMeteringsInterval:                 func(c *Config) interface{} { return c.MeteringsInterval },
+	envKeyMeteringsStateFile:                func(c *Config) interface{} { return c.MeteringsStateFile },
+	envKeyDataDir:                           func(c *Config) interface{} { return c.DataDir },
+	envKeyMeteringsDeadband:                 func(c *Config) interface{} { return c.MeteringsDeadbands },
+	envKeyPublishMaxSilence:                 func(c *Config) interface{} { return c.PublishMaxSilence },
+	envKeyRefreshAtStart:                    func(c *Config) interface{} { return c.RefreshAtStart },
+	envKeyLogLevel:                          func(c *Config) interface{} { return c.LogLevel },
+	envKeyHomeAssistantDiscoveryEnabled:     func(c *Config) interface{} { return c.HomeAssistant.DiscoveryEnabled },
+	envKeyHomeAssistantDiscoveryPrefix:      func(c *Config) interface{} { return c.HomeAssistant.DiscoveryTopicPrefix },
+	envKeyHomeAssistantRemoveRegexpFromName: func(c *Config) interface{} { return c.HomeAssistant.RemoveRegexpFromName },
+	envKeyHomeAssistantDeviceDiscovery:      func(c *Config) interface{} { return c.HomeAssistant.DeviceDiscovery },
+	envKeyHealthCheckPort:                   func(c *Config) interface{} { return c.HealthCheck.Port },
+	envKeyMetricsExportValues:               func(c *Config) interface{} { return c.HealthCheck.ExportValues },
+	envKeyHealthCheckNotificationMaxAge:     func(c *Config) interface{} { return c.HealthCheck.NotificationMaxAge },
+	envKeyHealthCheckWebsocketMaxDowntime:   func(c *Config) interface{} { return c.HealthCheck.WebsocketMaxDowntime },
+	envKeyApiEnabled:                        func(c *Config) interface{} { return c.Api.Enabled },
+	envKeyApiToken:                          func(c *Config) interface{} { return c.Api.Token },
+	envKeyDashboardEnabled:                  func(c *Config) interface{} { return c.Api.DashboardEnabled },
+	envKeyCommandStateMode:                  func(c *Config) interface{} { return c.CommandStateMode },
+	envKeyCommandConfirmTimeout:             func(c *Config) interface{} { return c.CommandConfirmTimeout },
+	envKeyCommandWorkers:                    func(c *Config) interface{} { return c.CommandWorkers },
+	envKeyCommandRateLimit:                  func(c *Config) interface{} { return c.CommandRateLimit },
+	envKeyZones:                             func(c *Config) interface{} { return c.Overrides.Zones },
+	envKeyDevices:                           func(c *Config) interface{} { return c.Overrides.Devices },
+	envKeyOutputs:                           func(c *Config) interface{} { return c.Overrides.Outputs },
+}
+
+// Settings which can be changed while the bridge is running, with the
+// function copying them from the updated config. The other settings are
+// only used when starting the bridge.
+var liveSettings = map[string]func(c *Config, updated *Config){
+	envKeyLogLevel:             func(c *Config, updated *Config) { c.LogLevel = updated.LogLevel },
+	envKeyInvertBlindsPosition: func(c *Config, updated *Config) { c.InvertBlindsPosition = updated.InvertBlindsPosition },
+	envKeyMeteringsInterval:    func(c *Config, updated *Config) { c.MeteringsInterval = updated.MeteringsInterval },
+	envKeyMeteringsDeadband:    func(c *Config, updated *Config) { c.MeteringsDeadbands = updated.MeteringsDeadbands },
+	envKeyHomeAssistantDiscoveryEnabled: func(c *Config, updated *Config) {
+		c.HomeAssistant.DiscoveryEnabled = updated.HomeAssistant.DiscoveryEnabled
+	},
+	envKeyHomeAssistantRemoveRegexpFromName: func(c *Config, updated *Config) {
+		c.HomeAssistant.RemoveRegexpFromName = updated.HomeAssistant.RemoveRegexpFromName
+	},
+}
+
+// Apply returns a copy of the config with the settings of the updated config
+// which can be changed while running, the config itself being left unchanged
+// for the ones still reading it. Also returns the keys of the settings applied
+// and the keys of the changed settings requiring a restart, which are left as
+// is.
+func (c *Config) Apply(updated *Config) (next *Config, applied []string, restart []string) {
+	copied := *c
+	next = &copied
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := settings[key]
+		if reflect.DeepEqual(value(c), value(updated)) {
+			continue
+		}
+		if apply, ok := liveSettings[key]; ok {
+			apply(next, updated)
+			applied = append(applied, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+	return next, applied, restart
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// Description of the config keys, used to generate the JSON Schema.
+var descriptions = map[string]string{
+	envKeyDigitalstromHost:                  "Ip address of the digitalstrom system. Required.",
+	envKeyDigitalstromPort:                  "Secure port of the rest API.",
+	envKeyDigitalstromUsername:              "Deprecated, use digitalstrom_api_key instead.",
+	envKeyDigitalstromPassword:              "Deprecated, use digitalstrom_api_key instead.",
+	envKeyDigitalstromApiKey:                "DigitalSTROM API key. Required, unless digitalstrom_api_key_file is set.",
+	envKeyDigitalstromCaptureFile:           "Record all the traffic with the dSS to this file.",
+	envKeyMqttUrl:                           "MQTT url, e.g. tcp://192.168.1.2:1883. Required.",
+	envKeyMqttUsername:                      "MQTT username.",
+	envKeyMqttPassword:                      "MQTT password.",
+	envKeyMqttTopicFormat:                   "Deprecated, the topics use the device name.",
+	envKeyMqttTopicPrefix:                   "Topic prefix.",
+	envKeyMqttNormalizeTopicName:            "Remove special chars from device name.",
+	envKeyMqttRetain:                        "Retain MQTT messages.",
+	envKeyMqttDeduplicate:                   "Do not publish a device state identical to the last one published on its topic.",
+	envKeyInvertBlindsPosition:              "100% is fully close.",
+	envKeyMeteringsEnabled:                  "Whether to poll digitalSTROM metering values.",
+	envKeyMeteringsInterval:                 "Polling interval for digitalSTROM metering values.",
+	envKeyMeteringsStateFile:                "File where the cumulative energy counters are persisted (empty to disable), relative to the data directory.",
+	envKeyDataDir:                           "Directory of the files written by the bridge, e.g. the state of the energy counters.",
+	envKeyMeteringsDeadband:                 "Minimum change per unit before publishing a metering value again, e.g. W=5,Wh=1%.",
+	envKeyPublishMaxSilence:                 "Publish unchanged values again after this delay (0 to never publish them again).",
+	envKeyRefreshAtStart:                    "Should the states be refreshed at start.",
+	envKeyLogLevel:                          "Log level.",
+	envKeyHomeAssistantDiscoveryEnabled:     "Whether or not publish MQTT Discovery messages for Home Assistant.",
+	envKeyHomeAssistantDiscoveryPrefix:      "Topic prefix where to publish the MQTT Discovery messages for Home Assistant.",
+	envKeyHomeAssistantRemoveRegexpFromName: "Regular expression to remove from device names when announcing to Home Assistant.",
+	envKeyHomeAssistantDeviceDiscovery:      "Publish one device-based discovery message per device instead of one per entity.",
+	envKeyHealthCheckPort:                   "Port of the HTTP server exposing the health checks and the metrics.",
+	envKeyMetricsExportValues:               "Export the metering and output values as Prometheus gauges.",
+	envKeyHealthCheckNotificationMaxAge:     "Report the bridge as not alive when no notification was received for this delay (0 to disable).",
+	envKeyHealthCheckWebsocketMaxDowntime:   "Report the bridge as not alive when the notification websocket is disconnected for longer than this delay (0 to disable).",
+	envKeyApiEnabled:                        "Serve the local REST API on the health check server, api_token being required.",
+	envKeyApiToken:                          "Bearer token required to call the local REST API.",
+	envKeyDashboardEnabled:                  "Serve the read-only web dashboard on /ui of the health check server.",
+	envKeyCommandStateMode:                  "How the state is published after a command: optimistic, confirm (once reported by the dSS, rolled back otherwise) or none.",
+	envKeyCommandConfirmTimeout:             "Delay for the dSS to report the change requested by a command in confirm mode.",
+	envKeyCommandWorkers:                    "Number of devices for which commands are sent to the dSS in parallel.",
+	envKeyCommandRateLimit:                  "Maximum number of commands sent to the dSS per second (0 for no limit).",
+}
+
+// Types of the required keys, which have no default value to derive it from.
+var undefinedTypes = map[string]string{
+	envKeyDigitalstromHost:   "string",
+	envKeyDigitalstromApiKey: "string",
+	envKeyMqttUrl:            "string",
+}
+
+// JSONSchema returns the JSON Schema of config.yaml, to be used by editors to
+// complete and check the config file. No key is required by the schema as
+// all of them can be given as environment variables instead.
+func JSONSchema() ([]byte, error) {
+	properties := map[string]map[string]interface{}{}
+	for key, defaultValue := range defaultConfig {
+		property := map[string]interface{}{
+			"description": descriptions[key],
+		}
+		switch value := defaultValue.(type) {
+		case int:
+			property["type"] = "integer"
+			property["default"] = value
+		case bool:
+			property["type"] = "boolean"
+			property["default"] = value
+		case string:
+			switch value {
+			case deprecated:
+				property["deprecated"] = true
+			case undefined:
+				property["type"] = undefinedTypes[key]
+			default:
+				property["type"] = "string"
+				property["default"] = value
+			}
+		}
+		properties[key] = property
+	}
+	for _, key := range []string{envKeyDigitalstromPort, envKeyHealthCheckPort} {
+		properties[key]["minimum"] = 1
+		properties[key]["maximum"] = 65535
+	}
+	properties[envKeyMeteringsInterval]["minimum"] = 1
+	properties[envKeyPublishMaxSilence]["minimum"] = 0
+	properties[envKeyHealthCheckNotificationMaxAge]["minimum"] = 0
+	properties[envKeyHealthCheckWebsocketMaxDowntime]["minimum"] = 0
+	properties[envKeyLogLevel]["enum"] = logLevels
+	properties[envKeyCommandStateMode]["enum"] = commandStateModes
+	properties[envKeyCommandConfirmTimeout]["minimum"] = 1
+	properties[envKeyCommandWorkers]["minimum"] = 1
+	properties[envKeyCommandRateLimit]["minimum"] = 0
+	properties[envKeyHomeAssistantRemoveRegexpFromName]["format"] = "regex"
+
+	for _, key := range secretKeys {
+		properties[key+"_file"] = map[string]interface{}{
+			"description": "File containing the value of " + key + ", which must not be set.",
+			"type":        "string",
+		}
+	}
+
+	override := map[string]interface{}{
+		"invert_blinds_position": map[string]interface{}{"type": "boolean", "description": "Invert the position of the blinds."},
+		"topic_name":             map[string]interface{}{"type": "string", "description": "Name used in the topics instead of the name of the device, for a single device."},
+		"device_class":           map[string]interface{}{"type": "string", "description": "Home Assistant device class, e.g. shutter or awning for a cover."},
+		"type":                   map[string]interface{}{"type": "string", "enum": DeviceTypes, "description": "Type of the device, replacing the one inferred from the dSS."},
+		"scale":                  map[string]interface{}{"type": "number", "exclusiveMinimum": 0, "description": "Factor applied to the values published, the commands are divided by it."},
+		"read_only":              map[string]interface{}{"type": "boolean", "description": "Ignore the commands and announce the device as a sensor."},
+		"exclude":                map[string]interface{}{"type": "boolean", "description": "Ignore the device."},
+	}
+	section := func(description string, match map[string]interface{}, omitted ...string) map[string]interface{} {
+		itemProperties := map[string]interface{}{}
+		for key, value := range override {
+			if !slices.Contains(omitted, key) {
+				itemProperties[key] = value
+			}
+		}
+		for key, value := range match {
+			itemProperties[key] = value
+		}
+		return map[string]interface{}{
+			"description": description,
+			"type":        "array",
+			"items": map[string]interface{}{
+				"type":                 "object",
+				"properties":           itemProperties,
+				"additionalProperties": false,
+			},
+		}
+	}
+	properties[envKeyZones] = section("Settings overridden for the devices of a zone.", map[string]interface{}{
+		"zone": map[string]interface{}{"type": "string", "description": "Name or id of the zone."},
+	}, "topic_name")
+	properties[envKeyDevices] = section("Settings overridden for some devices, taking precedence over the zones.", map[string]interface{}{
+		"dsid": map[string]interface{}{"type": "string", "description": "dsid of the device."},
+		"name": map[string]interface{}{"type": "string", "description": "Name of the device, * and ? can be used as wildcards."},
+	})
+	properties[envKeyOutputs] = map[string]interface{}{
+		"description": "Settings of the outputs of a type.",
+		"type":        "array",
+		"items": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"type":   map[string]interface{}{"type": "string", "enum": OutputTypes, "description": "Type of the outputs, e.g. lightBrightness."},
+				"scale":  map[string]interface{}{"type": "number", "exclusiveMinimum": 0, "description": "Factor applied to the values published, unless the device has a scale."},
+				"kelvin": map[string]interface{}{"type": "boolean", "description": "Publish the color temperatures in Kelvin instead of mireds."},
+			},
+			"required":             []string{"type"},
+			"additionalProperties": false,
+		},
+	}
+
+	// The keys are case insensitive, the upper case ones being used like the
+	// environment variables, e.g. in config.yaml.example.
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	for _, key := range keys {
+		properties[strings.ToUpper(key)] = map[string]interface{}{"$ref": "#/properties/" + key}
+	}
+
+	schema := map[string]interface{}{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "digitalstrom-mqtt config",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	// The keys of the maps are sorted by json.Marshal, the output is stable.
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
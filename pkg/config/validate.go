@@ -0,0 +1,217 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Problem is an issue found in the config by Validate.
+type Problem struct {
+	Key        string
+	Message    string
+	Suggestion string
+}
+
+func (p Problem) String() string {
+	description := p.Key + ": " + p.Message
+	if p.Key == "" {
+		description = p.Message
+	}
+	if p.Suggestion != "" {
+		description += " (" + p.Suggestion + ")"
+	}
+	return description
+}
+
+// Schemes supported by the MQTT client, a URL without scheme uses tcp.
+var mqttSchemes = []string{"tcp", "ssl", "tls", "mqtt", "mqtts", "ws", "wss", "unix"}
+
+var logLevels = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR"}
+
+// Validate loads the config like ReadConfig, but instead of stopping at the
+// first error it reports every problem found, including the unknown keys of
+// the config file and the values of the wrong type.
+func Validate() []Problem {
+	problems := []Problem{}
+	add := func(key string, message string, suggestion string) {
+		problems = append(problems, Problem{Key: key, Message: message, Suggestion: suggestion})
+	}
+	if err := loadConfig(); err != nil {
+		add("", err.Error(), "")
+		return problems
+	}
+
+	for _, key := range viper.AllKeys() {
+		// The sections are checked when reading them.
+		if section, _, _ := strings.Cut(key, "."); section == envKeyZones || section == envKeyDevices || section == envKeyOutputs {
+			continue
+		}
+		if !isKnownKey(key) {
+			add(key, "unknown key", suggestKey(key))
+		}
+	}
+
+	keys := make([]string, 0, len(defaultConfig))
+	for key := range defaultConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		defaultValue := defaultConfig[key]
+		if defaultValue == deprecated {
+			if viper.IsSet(key) {
+				add(key, "deprecated key", "remove it, an API key is used instead")
+			}
+			continue
+		}
+		if defaultValue == undefined {
+			if !viper.IsSet(key) || viper.GetString(key) == "" {
+				add(key, "required key not set", "set it in config.yaml or with the "+strings.ToUpper(key)+" environment variable")
+			}
+			continue
+		}
+		value := fmt.Sprint(viper.Get(key))
+		switch defaultValue.(type) {
+		case int:
+			if _, err := strconv.Atoi(value); err != nil {
+				add(key, fmt.Sprintf("'%s' is not an integer", value), "")
+			}
+		case bool:
+			if _, err := strconv.ParseBool(value); err != nil {
+				add(key, fmt.Sprintf("'%s' is not a boolean", value), "use true or false")
+			}
+		}
+	}
+
+	checkPort := func(key string) {
+		if port, err := strconv.Atoi(viper.GetString(key)); err == nil && (port < 1 || port > 65535) {
+			add(key, fmt.Sprintf("port %d is out of range", port), "use a port between 1 and 65535")
+		}
+	}
+	checkPort(envKeyDigitalstromPort)
+	checkPort(envKeyHealthCheckPort)
+
+	checkMinimum := func(key string, minimum int) {
+		if value, err := strconv.Atoi(viper.GetString(key)); err == nil && value < minimum {
+			add(key, fmt.Sprintf("must be at least %d", minimum), "")
+		}
+	}
+	checkMinimum(envKeyMeteringsInterval, 1)
+	checkMinimum(envKeyPublishMaxSilence, 0)
+	checkMinimum(envKeyHealthCheckNotificationMaxAge, 0)
+	checkMinimum(envKeyHealthCheckWebsocketMaxDowntime, 0)
+	checkMinimum(envKeyCommandConfirmTimeout, 1)
+	checkMinimum(envKeyCommandWorkers, 1)
+	checkMinimum(envKeyCommandRateLimit, 0)
+
+	if mqttUrl := viper.GetString(envKeyMqttUrl); mqttUrl != "" {
+		if problem := checkMqttUrl(mqttUrl); problem != "" {
+			add(envKeyMqttUrl, problem, "e.g. tcp://192.168.1.2:1883")
+		}
+	}
+	if host := viper.GetString(envKeyDigitalstromHost); strings.Contains(host, "://") || strings.Contains(host, "/") {
+		add(envKeyDigitalstromHost, fmt.Sprintf("'%s' is not a host name", host), "remove the scheme and the path, e.g. 192.168.1.10")
+	}
+	if expression := viper.GetString(envKeyHomeAssistantRemoveRegexpFromName); expression != "" {
+		if _, err := regexp.Compile(expression); err != nil {
+			add(envKeyHomeAssistantRemoveRegexpFromName, "invalid regular expression: "+err.Error(), "")
+		}
+	}
+	if level := viper.GetString(envKeyLogLevel); !slices.Contains(logLevels, level) {
+		add(envKeyLogLevel, fmt.Sprintf("unknown log level '%s'", level), "use one of "+strings.Join(logLevels, ", "))
+	}
+	if mode := viper.GetString(envKeyCommandStateMode); !slices.Contains(commandStateModes, mode) {
+		add(envKeyCommandStateMode, fmt.Sprintf("unknown mode '%s'", mode), "use one of "+strings.Join(commandStateModes, ", "))
+	}
+	if _, err := parseDeadbands(viper.GetString(envKeyMeteringsDeadband)); err != nil {
+		add(envKeyMeteringsDeadband, err.Error(), "e.g. W=5,Wh=1%")
+	}
+	if _, err := readOverrides(); err != nil {
+		add("", err.Error(), "")
+	}
+	return problems
+}
+
+// Returns why the URL cannot be used to connect to the MQTT broker, or an
+// empty string if it can.
+func checkMqttUrl(mqttUrl string) string {
+	if !strings.Contains(mqttUrl, "://") {
+		mqttUrl = "tcp://" + mqttUrl
+	}
+	parsed, err := url.Parse(mqttUrl)
+	if err != nil {
+		return "invalid URL: " + err.Error()
+	}
+	if !slices.Contains(mqttSchemes, parsed.Scheme) {
+		return fmt.Sprintf("unsupported scheme '%s'", parsed.Scheme)
+	}
+	if parsed.Scheme != "unix" && parsed.Hostname() == "" {
+		return "missing host"
+	}
+	if port := parsed.Port(); port != "" {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Sprintf("invalid port '%s'", port)
+		}
+	}
+	return ""
+}
+
+func isKnownKey(key string) bool {
+	if _, ok := defaultConfig[key]; ok {
+		return true
+	}
+	for _, secretKey := range secretKeys {
+		if key == secretKey+"_file" {
+			return true
+		}
+	}
+	return false
+}
+
+// Suggests the known key closest to an unknown one, if any is close enough to
+// be a typo.
+func suggestKey(key string) string {
+	best := ""
+	bestDistance := 4
+	for known, defaultValue := range defaultConfig {
+		if defaultValue == deprecated {
+			continue
+		}
+		if distance := levenshtein(key, known); distance < bestDistance || (distance == bestDistance && known < best) {
+			best = known
+			bestDistance = distance
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return "did you mean " + best + "?"
+}
+
+// Returns the edit distance between two strings.
+func levenshtein(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
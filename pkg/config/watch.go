@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// Delay without any change of the config file before calling the callback,
+// as editors usually write a file in several steps.
+const watchDebounce = 500 * time.Millisecond
+
+// Watch calls the callback every time the config file is written, created or
+// replaced. The returned function stops watching.
+func Watch(onChange func()) (func() error, error) {
+	return watchFile(configFile, onChange)
+}
+
+func watchFile(name string, onChange func()) (func() error, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("unable to watch the config file: %w", err)
+	}
+	file, err := filepath.Abs(name)
+	if err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("unable to watch the config file: %w", err)
+	}
+	// Watch the directory rather than the file, to keep watching when the
+	// file is replaced (e.g. by an editor or a Kubernetes config map).
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("unable to watch the config file: %w", err)
+	}
+	// A Kubernetes config map mounts the file as a symlink to `..data/`,
+	// itself a symlink replaced by the kubelet on every update: the file is
+	// never written, only the target of the symlinks changes.
+	realFile, _ := filepath.EvalSymlinks(file)
+
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				written := filepath.Clean(event.Name) == file && event.Op&(fsnotify.Write|fsnotify.Create) != 0
+				currentFile, _ := filepath.EvalSymlinks(file)
+				if written || (currentFile != "" && currentFile != realFile) {
+					realFile = currentFile
+					debounce = time.After(watchDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warn().Err(err).Msg("Error watching the config file")
+			case <-debounce:
+				debounce = nil
+				log.Info().Str("file", file).Msg("Config file changed")
+				onChange()
+			}
+		}
+	}()
+	return watcher.Close, nil
+}
@@ -1,25 +1,40 @@
 package controller
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/api"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/controller/modules"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/health"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/homeassistant"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/metrics"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/mqtt"
 	"github.com/rs/zerolog/log"
 )
 
 type Controller struct {
+	config        *config.Config
 	dsClient      digitalstrom.Client
 	dsRegistry    digitalstrom.Registry
 	mqttClient    mqtt.Client
 	hassDiscovery *homeassistant.HomeAssistantDiscovery
 	healthCheck   health.Health
+	dashboard     *api.Dashboard
 
 	modules map[string]modules.Module
+
+	// Serializes the reloads and the publications of the discovery messages,
+	// which can be requested by the API while the config is being reloaded.
+	// Also guards the config, which is replaced by the reloads.
+	mutex sync.Mutex
 }
 
 func NewController(config *config.Config) *Controller {
@@ -27,8 +42,12 @@ func NewController(config *config.Config) *Controller {
 	dsOptions := digitalstrom.NewClientOptions().
 		SetHost(config.Digitalstrom.Host).
 		SetPort(config.Digitalstrom.Port).
-		SetApiKey(config.Digitalstrom.ApiKey)
+		SetApiKey(config.Digitalstrom.ApiKey).
+		SetCaptureFile(config.Digitalstrom.CaptureFile)
 	dsClient := digitalstrom.NewClient(dsOptions)
+	if config.Digitalstrom.ReplayFile != "" {
+		dsClient = digitalstrom.NewReplayClient(config.Digitalstrom.ReplayFile)
+	}
 
 	dsRegistry := digitalstrom.NewRegistry(dsClient)
 
@@ -37,16 +56,22 @@ func NewController(config *config.Config) *Controller {
 		SetUsername(config.Mqtt.Username).
 		SetPassword(config.Mqtt.Password).
 		SetTopicPrefix(config.Mqtt.TopicPrefix).
-		SetRetain(config.Mqtt.Retain)
+		SetRetain(config.Mqtt.Retain).
+		SetDeduplicate(config.Mqtt.Deduplicate, time.Duration(config.PublishMaxSilence)*time.Second)
 	mqttClient := mqtt.NewClient(mqttOptions)
 
 	hass := homeassistant.NewHomeAssistantDiscovery(
 		mqttClient,
 		&config.HomeAssistant)
 
-	healthCheck := health.NewHealth(config.HealthCheck, mqttClient)
+	healthCheck := health.NewHealth(config.HealthCheck, mqttClient, dsClient)
 
-	controller := Controller{
+	if config.HealthCheck.ExportValues {
+		metrics.EnableValuesExport()
+	}
+
+	controller := &Controller{
+		config:        config,
 		dsClient:      dsClient,
 		dsRegistry:    dsRegistry,
 		mqttClient:    mqttClient,
@@ -58,9 +83,23 @@ func NewController(config *config.Config) *Controller {
 	for name, builder := range modules.Modules {
 		module := builder(mqttClient, dsClient, dsRegistry, config)
 		controller.modules[name] = module
+		if checker, ok := module.(health.Checker); ok {
+			if err := healthCheck.AddChecks(checker.HealthChecks()); err != nil {
+				log.Error().Err(err).Str("module", name).Msg("Unable to register module healthchecks")
+			}
+		}
 	}
 
-	return &controller
+	if config.Api.Enabled {
+		restApi := api.NewApi(dsClient, dsRegistry, controller, config.Api.Token)
+		healthCheck.Mount("/api", restApi.Handler())
+	}
+	if config.Api.DashboardEnabled {
+		controller.dashboard = api.NewDashboard(dsClient, dsRegistry, mqttClient, controller)
+		healthCheck.Mount("/ui", controller.dashboard.Handler())
+	}
+
+	return controller
 }
 
 func (c *Controller) Start() error {
@@ -77,15 +116,90 @@ func (c *Controller) Start() error {
 	if err := c.healthCheck.Start(); err != nil {
 		return fmt.Errorf("error starting Healthcheck: %w", err)
 	}
+	if c.dashboard != nil {
+		if err := c.dashboard.Start(); err != nil {
+			return fmt.Errorf("error starting dashboard: %w", err)
+		}
+	}
 
 	for name, module := range c.modules {
 		log.Info().Str("module", name).Msg("Starting module.")
 		if err := module.Start(); err != nil {
+			metrics.ModuleStartFailures.WithLabelValues(name).Inc()
 			return fmt.Errorf("error starting module '%s': %w", name, err)
 		}
 	}
 
-	// Retrieve from all the modules the discovery configs to be exported.
+	if err := c.PublishDiscovery(); err != nil {
+		return err
+	}
+
+	c.healthCheck.SetStarted(true)
+	return nil
+}
+
+// Config returns the config in use, including the settings reloaded since
+// the start.
+func (c *Controller) Config() *config.Config {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.config
+}
+
+// Reload applies the settings of the updated config which can be changed
+// while running and returns the keys of the changed settings requiring a
+// restart, which are ignored.
+func (c *Controller) Reload(updated *config.Config) ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// The config is replaced rather than modified, the previous one being
+	// possibly still read.
+	next, applied, restart := c.config.Apply(updated)
+	if len(applied) == 0 {
+		return restart, nil
+	}
+	c.config = next
+	c.hassDiscovery.SetConfig(&next.HomeAssistant)
+	log.Info().Strs("settings", applied).Msg("Applying the updated settings.")
+
+	for name, module := range c.modules {
+		m, ok := module.(modules.Reloadable)
+		if !ok {
+			continue
+		}
+		if err := m.Reload(c.config); err != nil {
+			return restart, fmt.Errorf("error reloading module '%s': %w", name, err)
+		}
+	}
+	// The Home Assistant discovery uses the new config, the names and the
+	// entities might have changed.
+	for _, key := range applied {
+		if strings.HasPrefix(key, "home_assistant_") {
+			return restart, c.publishDiscovery()
+		}
+	}
+	return restart, nil
+}
+
+// PublishDiscovery retrieves the discovery configs from all the modules and
+// publishes the Home Assistant discovery messages.
+func (c *Controller) PublishDiscovery() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.publishDiscovery()
+}
+
+func (c *Controller) publishDiscovery() error {
+	if err := c.collectDiscoveryConfigs(); err != nil {
+		return err
+	}
+	// Publishes Home Assistant Discovery messages.
+	return c.hassDiscovery.PublishDiscoveryMessages()
+}
+
+// Retrieves from all the modules the discovery configs to be exported.
+func (c *Controller) collectDiscoveryConfigs() error {
+	c.hassDiscovery.ClearConfigs()
 	for name, module := range c.modules {
 		m, ok := module.(homeassistant.HomeAssistantDiscoveryInterface)
 		if !ok {
@@ -97,16 +211,94 @@ func (c *Controller) Start() error {
 		}
 		c.hassDiscovery.AddConfigs(configs)
 	}
-	// Publishes Home Assistant Discovery messages.
-	if err := c.hassDiscovery.PublishDiscoveryMessages(); err != nil {
+	return nil
+}
+
+// DiscoveryMessages returns the Home Assistant discovery messages as they were
+// last published.
+func (c *Controller) DiscoveryMessages() ([]homeassistant.DiscoveryMessage, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hassDiscovery.DiscoveryMessages()
+}
+
+// PingDigitalstrom returns the cached result of the ping of the dSS done by
+// the health check.
+func (c *Controller) PingDigitalstrom(ctx context.Context) error {
+	return c.healthCheck.PingDigitalstrom(ctx)
+}
+
+// ReloadRegistry reloads the structure of the apartment from the dSS and
+// publishes again the Home Assistant discovery messages, the devices might
+// have been added, renamed or removed. The modules follow the changes from
+// the events of the registry.
+func (c *Controller) ReloadRegistry() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.dsRegistry.Reload(); err != nil {
 		return err
 	}
+	return c.publishDiscovery()
+}
 
-	return nil
+// SetOutputValue sets the value of an output through the module handling the
+// commands of the devices and returns the result of the command.
+func (c *Controller) SetOutputValue(ctx context.Context, deviceId string, functionBlockId string, outputId string, value float64) (modules.CommandResult, error) {
+	for _, module := range c.modules {
+		if m, ok := module.(modules.OutputSetter); ok {
+			return m.SetOutputValue(ctx, deviceId, functionBlockId, outputId, value)
+		}
+	}
+	return modules.CommandResult{}, errors.New("no module handles the outputs of the devices")
+}
+
+// CheckDeviceAction returns an error when the actions of the device are
+// refused by the config, e.g. for a read-only device.
+func (c *Controller) CheckDeviceAction(device digitalstrom.Device) error {
+	return modules.CheckDeviceAction(c.dsRegistry, c.Config(), device)
+}
+
+// DeviceTopics returns the MQTT topics used by all the modules for the
+// devices.
+func (c *Controller) DeviceTopics() ([]modules.Topic, error) {
+	topics := []modules.Topic{}
+	for name, module := range c.modules {
+		m, ok := module.(modules.TopicProvider)
+		if !ok {
+			continue
+		}
+		moduleTopics, err := m.GetDeviceTopics()
+		if err != nil {
+			return nil, fmt.Errorf("error getting topics from module '%s': %w", name, err)
+		}
+		topics = append(topics, moduleTopics...)
+	}
+	return topics, nil
+}
+
+// CommandHistory returns the last commands received by all the modules, the
+// most recent first.
+func (c *Controller) CommandHistory() []modules.CommandRecord {
+	records := []modules.CommandRecord{}
+	for _, module := range c.modules {
+		if m, ok := module.(modules.CommandHistoryProvider); ok {
+			records = append(records, m.GetCommandHistory()...)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Time.After(records[j].Time)
+	})
+	return records
 }
 
 func (c *Controller) Stop() error {
 	log.Info().Msg("Stopping controller.")
+	c.healthCheck.SetStarted(false)
+	if c.dashboard != nil {
+		if err := c.dashboard.Stop(); err != nil {
+			return fmt.Errorf("error stopping dashboard: %w", err)
+		}
+	}
 
 	for name, module := range c.modules {
 		log.Info().Str("module", name).Msg("Stopping module.")
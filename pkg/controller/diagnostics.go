@@ -0,0 +1,232 @@
+package controller
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/controller/modules"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/rs/zerolog/log"
+)
+
+// Result of a connectivity test run for the diagnostics.
+type connectivityResult struct {
+	Name     string        `json:"name"`
+	Ok       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// MQTT topic used by more than one device, e.g. because their names are the
+// same once normalized.
+type topicCollision struct {
+	Topic   string   `json:"topic"`
+	Devices []string `json:"devices"`
+}
+
+type diagnosticsSummary struct {
+	Time      time.Time `json:"time"`
+	GoVersion string    `json:"goVersion"`
+	Platform  string    `json:"platform"`
+	// Parts of the diagnostics which could not be collected.
+	Errors []string `json:"errors"`
+}
+
+// Diagnose connects to the dSS and the MQTT broker without starting the
+// modules nor publishing anything, and writes a zip file describing the
+// installation and the way the bridge maps it, to be attached to support
+// requests. The given logs are included in the bundle.
+func Diagnose(config *config.Config, file string, logs *bytes.Buffer) error {
+	c := NewController(config)
+	summary := diagnosticsSummary{
+		Time:      time.Now(),
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Errors:    []string{},
+	}
+	bundle := map[string]interface{}{
+		"config.json": config.Redacted(),
+	}
+	raw := map[string][]byte{}
+	failed := func(part string, err error) {
+		log.Error().Err(err).Str("part", part).Msg("Unable to collect diagnostics")
+		summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %s", part, err))
+	}
+
+	connectivity, registryLoaded := c.testConnectivity()
+	bundle["connectivity.json"] = connectivity
+	defer c.dsClient.Disconnect()
+	defer c.mqttClient.RawClient().Disconnect(250)
+
+	if apartment, err := c.dsClient.GetApartmentRaw(); err == nil {
+		raw["apartment.json"] = apartment
+	} else {
+		failed("apartment.json", err)
+	}
+	if status, err := c.dsClient.GetApartmentStatusRaw(); err == nil {
+		raw["apartment-status.json"] = status
+	} else {
+		failed("apartment-status.json", err)
+	}
+
+	if registryLoaded {
+		if err := c.collectDiscoveryConfigs(); err == nil {
+			if messages, err := c.hassDiscovery.DiscoveryMessages(); err == nil {
+				bundle["discovery.json"] = messages
+			} else {
+				failed("discovery.json", err)
+			}
+		} else {
+			failed("discovery.json", err)
+		}
+		bundle["skipped-devices.json"] = c.skippedDevices()
+
+		if topics, err := c.DeviceTopics(); err == nil {
+			bundle["topics.json"] = topics
+			bundle["topic-collisions.json"] = topicCollisions(topics, c.dsRegistry)
+		} else {
+			failed("topics.json", err)
+		}
+	}
+	bundle["summary.json"] = summary
+
+	return writeBundle(file, bundle, raw, logs)
+}
+
+// Runs the connectivity tests, leaving the clients connected when possible.
+// Returns whether the registry could be loaded.
+func (c *Controller) testConnectivity() ([]connectivityResult, bool) {
+	results := []connectivityResult{}
+	run := func(name string, test func() error) bool {
+		start := time.Now()
+		err := test()
+		result := connectivityResult{Name: name, Ok: err == nil, Duration: time.Since(start)}
+		if err != nil {
+			result.Error = err.Error()
+			log.Warn().Err(err).Str("test", name).Msg("Connectivity test failed")
+		} else {
+			log.Info().Str("test", name).Msg("Connectivity test succeeded")
+		}
+		results = append(results, result)
+		return err == nil
+	}
+
+	run("mqtt", func() error {
+		// Connects without publishing the status of the bridge, to not
+		// disturb a running instance.
+		t := c.mqttClient.RawClient().Connect()
+		if !t.WaitTimeout(30 * time.Second) {
+			return errors.New("timeout connecting to the MQTT broker")
+		}
+		return t.Error()
+	})
+	dssReachable := run("digitalstrom", func() error {
+		err := c.dsClient.Ping()
+		if errors.Is(err, digitalstrom.ErrUnauthorized) {
+			return fmt.Errorf("API key rejected: %w", err)
+		}
+		return err
+	})
+	run("websocket", func() error {
+		if err := c.dsClient.Connect(); err != nil {
+			return err
+		}
+		if !c.dsClient.WebsocketConnected() {
+			return errors.New("notification websocket not connected")
+		}
+		return nil
+	})
+	registryLoaded := dssReachable && run("registry", c.dsRegistry.Start)
+	return results, registryLoaded
+}
+
+func (c *Controller) skippedDevices() []modules.SkippedDevice {
+	skipped := []modules.SkippedDevice{}
+	for _, module := range c.modules {
+		if m, ok := module.(modules.SkippedDevicesProvider); ok {
+			skipped = append(skipped, m.GetSkippedDevices()...)
+		}
+	}
+	return skipped
+}
+
+// Returns the topics used by more than one device.
+func topicCollisions(topics []modules.Topic, dsRegistry digitalstrom.Registry) []topicCollision {
+	devicesByTopic := map[string][]string{}
+	for _, topic := range topics {
+		found := false
+		for _, deviceId := range devicesByTopic[topic.Topic] {
+			found = found || deviceId == topic.DeviceId
+		}
+		if !found {
+			devicesByTopic[topic.Topic] = append(devicesByTopic[topic.Topic], topic.DeviceId)
+		}
+	}
+
+	collisions := []topicCollision{}
+	for topic, deviceIds := range devicesByTopic {
+		if len(deviceIds) < 2 {
+			continue
+		}
+		collision := topicCollision{Topic: topic}
+		for _, deviceId := range deviceIds {
+			description := deviceId
+			if device, err := dsRegistry.GetDevice(deviceId); err == nil {
+				description = fmt.Sprintf("%s (%s)", device.Attributes.Name, deviceId)
+			}
+			collision.Devices = append(collision.Devices, description)
+		}
+		collisions = append(collisions, collision)
+	}
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i].Topic < collisions[j].Topic
+	})
+	return collisions
+}
+
+func writeBundle(file string, bundle map[string]interface{}, raw map[string][]byte, logs *bytes.Buffer) error {
+	out, err := os.Create(file)
+	if err != nil {
+		return fmt.Errorf("unable to create diagnostics file: %w", err)
+	}
+	defer out.Close()
+	archive := zip.NewWriter(out)
+
+	for name, content := range bundle {
+		data, err := json.MarshalIndent(content, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error serializing '%s': %w", name, err)
+		}
+		raw[name] = data
+	}
+	if logs != nil {
+		raw["diagnostics.log"] = logs.Bytes()
+	}
+	for name, data := range raw {
+		if json.Valid(data) {
+			var indented bytes.Buffer
+			if err := json.Indent(&indented, data, "", "  "); err == nil {
+				data = indented.Bytes()
+			}
+		}
+		w, err := archive.Create(name)
+		if err != nil {
+			return fmt.Errorf("error adding '%s' to the diagnostics: %w", name, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("error adding '%s' to the diagnostics: %w", name, err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("error writing diagnostics file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+)
+
+const capture = `{"type": "request", "method": "GET", "path": "api/v1/apartment", "query": "include=installation%2CdsDevices%2Csubmodules%2CfunctionBlocks%2Czones%2Ccontrollers%2Cmeterings", "status": 200, "responseBody": {"data": {"id": "apartment", "included": {
+  "dsDevices": [
+    {"id": "d1", "attributes": {"name": "Lamp 1", "zone": "z1", "submodules": ["s1"]}},
+    {"id": "d2", "attributes": {"name": "Lamp/1", "zone": "z1", "submodules": ["s2"]}},
+    {"id": "d3", "attributes": {"name": "Sensor", "zone": "z1", "submodules": ["s3"]}}
+  ],
+  "submodules": [
+    {"id": "s1", "attributes": {"functionBlocks": ["f1"], "application": "lights"}},
+    {"id": "s2", "attributes": {"functionBlocks": ["f2"], "application": "lights"}},
+    {"id": "s3", "attributes": {"functionBlocks": ["f3"]}}
+  ],
+  "functionBlocks": [
+    {"id": "f1", "attributes": {"technicalName": "GE-KM200", "outputs": [{"id": "brightness"}]}},
+    {"id": "f2", "attributes": {"technicalName": "GE-KM200", "outputs": [{"id": "brightness"}]}},
+    {"id": "f3", "attributes": {"technicalName": "BL-SDS200"}}
+  ]}}}}
+{"type": "request", "method": "GET", "path": "api/v1/apartment/meterings", "status": 200, "responseBody": {"data": {"meterings": []}}}
+{"type": "request", "method": "GET", "path": "api/v1/apartment/status", "query": "include=dsDevices%2Czones", "status": 200, "responseBody": {"data": {"included": {"dsDevices": []}}}}
+`
+
+func TestDiagnose(t *testing.T) {
+	dir := t.TempDir()
+	captureFile := filepath.Join(dir, "capture.jsonl")
+	if err := os.WriteFile(captureFile, []byte(strings.ReplaceAll(capture, "\n  ", " ")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bundleFile := filepath.Join(dir, "diagnostics.zip")
+	c := &config.Config{
+		Digitalstrom: config.ConfigDigitalstrom{ApiKey: "secret", ReplayFile: captureFile},
+		Mqtt: config.ConfigMqtt{
+			MqttUrl:             "tcp://127.0.0.1:1",
+			TopicPrefix:         "digitalstrom",
+			NormalizeDeviceName: true,
+		},
+		HomeAssistant: config.ConfigHomeAssistant{DiscoveryTopicPrefix: "homeassistant"},
+	}
+	if err := Diagnose(c, bundleFile, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.OpenReader(bundleFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	files := map[string]string{}
+	for _, f := range archive.File {
+		r, _ := f.Open()
+		content, _ := io.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(content)
+	}
+
+	if strings.Contains(files["config.json"], "secret") {
+		t.Errorf("API key not redacted: %s", files["config.json"])
+	}
+	var connectivity []connectivityResult
+	json.Unmarshal([]byte(files["connectivity.json"]), &connectivity)
+	if len(connectivity) != 4 || connectivity[0].Name != "mqtt" || connectivity[0].Ok || !connectivity[3].Ok {
+		t.Errorf("Unexpected connectivity results: %+v", connectivity)
+	}
+	if !strings.Contains(files["topic-collisions.json"], "digitalstrom/devices/Lamp_1/brightness/state") {
+		t.Errorf("Collision not reported: %s", files["topic-collisions.json"])
+	}
+	if !strings.Contains(files["skipped-devices.json"], "unsupported device type 'unknown' (technical name 'BL-SDS200')") {
+		t.Errorf("Skipped device not reported: %s", files["skipped-devices.json"])
+	}
+	if !strings.Contains(files["discovery.json"], "homeassistant/light/d1/light/config") {
+		t.Errorf("Discovery messages missing: %s", files["discovery.json"])
+	}
+}
@@ -0,0 +1,94 @@
+package modules
+
+import (
+	"math"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+)
+
+// channel is an output of a function block of a device. It is named in the
+// topics by the id of the output, prefixed by the id of the function block
+// (e.g. "303505d7f8000000000000400013befc00/brightness") when several function
+// blocks of the device have an output with the same id, like the two channels
+// of a dual relay. The names do not depend on the order of the function
+// blocks.
+type channel struct {
+	name          string
+	functionBlock digitalstrom.FunctionBlock
+	output        digitalstrom.Output
+}
+
+// Returns the channels of the function blocks of a device.
+func channelsOf(functionBlocks []digitalstrom.FunctionBlock) []channel {
+	count := map[string]int{}
+	prefixed := false
+	for _, functionBlock := range functionBlocks {
+		for _, output := range functionBlock.Attributes.Outputs {
+			count[output.OutputId]++
+			prefixed = prefixed || count[output.OutputId] > 1
+		}
+	}
+	channels := []channel{}
+	for _, functionBlock := range functionBlocks {
+		for _, output := range functionBlock.Attributes.Outputs {
+			name := output.OutputId
+			if prefixed {
+				name = functionBlock.FunctionBlockId + "/" + output.OutputId
+			}
+			channels = append(channels, channel{name: name, functionBlock: functionBlock, output: output})
+		}
+	}
+	return channels
+}
+
+func findChannel(channels []channel, name string) (channel, bool) {
+	for _, ch := range channels {
+		if ch.name == name {
+			return ch, true
+		}
+	}
+	return channel{}, false
+}
+
+// Returns the channel of the output of the function block.
+func channelOfOutput(channels []channel, functionBlockId string, outputId string) (channel, bool) {
+	for _, ch := range channels {
+		if ch.functionBlock.FunctionBlockId == functionBlockId && ch.output.OutputId == outputId {
+			return ch, true
+		}
+	}
+	return channel{}, false
+}
+
+// Returns the first channel of an output with the given id, whatever its
+// function block.
+func firstChannelOfOutput(channels []channel, outputId string) (channel, bool) {
+	for _, ch := range channels {
+		if ch.output.OutputId == outputId {
+			return ch, true
+		}
+	}
+	return channel{}, false
+}
+
+func (c *DeviceModule) channelsOfDevice(deviceId string) ([]channel, error) {
+	functionBlocks, err := c.dsRegistry.GetFunctionBlocksOfDevice(deviceId)
+	if err != nil {
+		return nil, err
+	}
+	return channelsOf(functionBlocks), nil
+}
+
+// Returns the value of the channel known by the registry, NaN if unknown.
+func (c *DeviceModule) channelValue(deviceId string, ch channel) float64 {
+	values, err := c.dsRegistry.GetOutputValuesOfFunctionBlock(deviceId, ch.functionBlock.FunctionBlockId)
+	if err != nil {
+		return math.NaN()
+	}
+	for _, value := range values {
+		if value.OutputId == ch.output.OutputId {
+			return value.TargetValue
+		}
+	}
+	return math.NaN()
+}
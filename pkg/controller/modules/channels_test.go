@@ -0,0 +1,57 @@
+package modules
+
+import (
+	"testing"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/stretchr/testify/assert"
+)
+
+func functionBlockWithOutputs(functionBlockId string, outputIds ...string) digitalstrom.FunctionBlock {
+	functionBlock := digitalstrom.FunctionBlock{FunctionBlockId: functionBlockId}
+	for _, outputId := range outputIds {
+		functionBlock.Attributes.Outputs = append(functionBlock.Attributes.Outputs, digitalstrom.Output{OutputId: outputId})
+	}
+	return functionBlock
+}
+
+func TestChannelsOf(t *testing.T) {
+	names := func(channels []channel) []string {
+		result := []string{}
+		for _, ch := range channels {
+			result = append(result, ch.name)
+		}
+		return result
+	}
+
+	// Blind with a single function block.
+	channels := channelsOf([]digitalstrom.FunctionBlock{
+		functionBlockWithOutputs("fb1", "shadePositionOutside", "shadeOpeningAngleOutside"),
+	})
+	assert.Equal(t, []string{"shadePositionOutside", "shadeOpeningAngleOutside"}, names(channels))
+
+	// Dual relay.
+	channels = channelsOf([]digitalstrom.FunctionBlock{
+		functionBlockWithOutputs("fb1", "brightness"),
+		functionBlockWithOutputs("fb2", "brightness"),
+	})
+	assert.Equal(t, []string{"fb1/brightness", "fb2/brightness"}, names(channels))
+	ch, ok := channelOfOutput(channels, "fb2", "brightness")
+	assert.True(t, ok)
+	assert.Equal(t, "fb2/brightness", ch.name)
+	ch, ok = findChannel(channels, "fb1/brightness")
+	assert.True(t, ok)
+	assert.Equal(t, "fb1", ch.functionBlock.FunctionBlockId)
+	_, ok = findChannel(channels, "brightness")
+	assert.False(t, ok)
+	ch, ok = firstChannelOfOutput(channels, "brightness")
+	assert.True(t, ok)
+	assert.Equal(t, "fb1/brightness", ch.name)
+
+	// The names do not depend on the order of the function blocks.
+	channels = channelsOf([]digitalstrom.FunctionBlock{
+		functionBlockWithOutputs("fb2", "brightness"),
+		functionBlockWithOutputs("fb1", "brightness"),
+	})
+	assert.Equal(t, []string{"fb2/brightness", "fb1/brightness"}, names(channels))
+}
@@ -0,0 +1,113 @@
+package modules
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/homeassistant"
+	"github.com/rs/zerolog/log"
+)
+
+// classification is the Home Assistant entity announced for a function block.
+type classification struct {
+	deviceType digitalstrom.DeviceType
+	// Empty when the function block is not announced.
+	domain      homeassistant.Domain
+	deviceClass string
+	// Whether the type comes from the config.
+	overridden bool
+}
+
+// Returns the Home Assistant domain and device class of a function block of
+// the given type. The type and the device class can be overridden in the
+// config.
+func classify(deviceType digitalstrom.DeviceType, settings config.DeviceSettings) classification {
+	result := classification{deviceType: deviceType}
+	if settings.Type != "" {
+		result.deviceType = digitalstrom.DeviceType(settings.Type)
+		result.overridden = true
+	}
+	switch result.deviceType {
+	case digitalstrom.DeviceTypeLight:
+		result.domain = homeassistant.Light
+	case digitalstrom.DeviceTypeBlind:
+		// Announced without a device class as before the classification,
+		// to not change the existing entities.
+		result.domain = homeassistant.Cover
+	case digitalstrom.DeviceTypeAwning:
+		result.domain = homeassistant.Cover
+		result.deviceClass = "awning"
+	case digitalstrom.DeviceTypeWindow:
+		result.domain = homeassistant.Cover
+		result.deviceClass = "window"
+	case digitalstrom.DeviceTypeVentilation:
+		result.domain = homeassistant.Fan
+	case digitalstrom.DeviceTypeHeating:
+		// Announced by the entity of its heating power.
+		result.domain = homeassistant.Number
+	}
+	if settings.DeviceClass != "" {
+		result.deviceClass = settings.DeviceClass
+	}
+	return result
+}
+
+func (c *DeviceModule) classifyFunctionBlock(functionBlock digitalstrom.FunctionBlock, settings config.DeviceSettings) classification {
+	return classify(c.dsRegistry.GetDeviceType(functionBlock), settings)
+}
+
+// Logs the classification of the function blocks of every device, to check
+// the entities announced to Home Assistant and which devices need a type in
+// the config.
+func (c *DeviceModule) logClassification(devices []digitalstrom.Device) {
+	counts := map[string]int{}
+	for _, device := range devices {
+		settings := c.deviceSettings(&device)
+		if settings.Exclude {
+			continue
+		}
+		functionBlocks, err := c.dsRegistry.GetFunctionBlocksOfDevice(device.DeviceId)
+		if err != nil {
+			continue
+		}
+		for _, functionBlock := range functionBlocks {
+			application := ""
+			// The submodule giving the type of the function block.
+			if submodule, err := c.dsRegistry.GetSubmoduleOfFunctionBlock(functionBlock); err == nil {
+				application = string(submodule.Attributes.Application)
+			}
+			classified := c.classifyFunctionBlock(functionBlock, settings)
+			outputTypes := []string{}
+			for _, output := range functionBlock.Attributes.Outputs {
+				outputTypes = append(outputTypes, string(output.Attributes.Type))
+			}
+			domain := string(classified.domain)
+			if domain == "" {
+				domain = "none"
+			}
+			counts[domain]++
+			log.Debug().
+				Str("device", device.Attributes.Name).
+				Str("technicalName", functionBlock.Attributes.TechnicalName).
+				Str("application", application).
+				Str("outputTypes", strings.Join(outputTypes, ";")).
+				Str("type", string(classified.deviceType)).
+				Bool("overridden", classified.overridden).
+				Str("domain", domain).
+				Str("deviceClass", classified.deviceClass).
+				Msg("Device classified.")
+		}
+	}
+	domains := make([]string, 0, len(counts))
+	for domain := range counts {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	event := log.Info()
+	for _, domain := range domains {
+		event = event.Int(domain, counts[domain])
+	}
+	event.Msg("Devices classified, set the type of the devices in the config to change their classification.")
+}
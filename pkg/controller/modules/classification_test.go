@@ -0,0 +1,51 @@
+package modules
+
+import (
+	"testing"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/homeassistant"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	blind := classify(digitalstrom.DeviceTypeBlind, config.DeviceSettings{})
+	assert.Equal(t, homeassistant.Cover, blind.domain)
+	assert.Equal(t, "", blind.deviceClass)
+
+	shutter := classify(digitalstrom.DeviceTypeBlind, config.DeviceSettings{DeviceClass: "shutter"})
+	assert.Equal(t, "shutter", shutter.deviceClass)
+
+	awning := classify(digitalstrom.DeviceTypeAwning, config.DeviceSettings{DeviceClass: "shade"})
+	assert.Equal(t, homeassistant.Cover, awning.domain)
+	assert.Equal(t, "shade", awning.deviceClass)
+
+	joker := classify(digitalstrom.DeviceTypeJoker, config.DeviceSettings{Type: string(digitalstrom.DeviceTypeLight)})
+	assert.Equal(t, homeassistant.Light, joker.domain)
+	assert.True(t, joker.overridden)
+
+	ventilation := classify(digitalstrom.DeviceTypeVentilation, config.DeviceSettings{})
+	assert.Equal(t, homeassistant.Fan, ventilation.domain)
+
+	heating := classify(digitalstrom.DeviceTypeHeating, config.DeviceSettings{})
+	assert.Equal(t, homeassistant.Number, heating.domain)
+
+	unknown := classify(digitalstrom.DeviceTypeUnknown, config.DeviceSettings{})
+	assert.Equal(t, homeassistant.Domain(""), unknown.domain)
+}
+
+// The config lists the types without depending on the dSS client.
+func TestConfigTypesMatch(t *testing.T) {
+	deviceTypes := []string{}
+	for _, deviceType := range digitalstrom.DeviceTypes {
+		deviceTypes = append(deviceTypes, string(deviceType))
+	}
+	assert.Equal(t, deviceTypes, config.DeviceTypes)
+
+	outputTypes := []string{}
+	for _, outputType := range digitalstrom.OutputTypes {
+		outputTypes = append(outputTypes, string(outputType))
+	}
+	assert.Equal(t, outputTypes, config.OutputTypes)
+}
@@ -0,0 +1,207 @@
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+)
+
+// Codes reported in the command results.
+const (
+	resultOk              string = "ok"
+	resultInvalidPayload  string = "invalid_payload"
+	resultOutOfRange      string = "out_of_range"
+	resultUnknownDevice   string = "unknown_device"
+	resultReadOnly        string = "read_only"
+	resultNoFunctionBlock string = "no_function_block"
+	resultUnauthorized    string = "unauthorized"
+	resultUnreachable     string = "unreachable"
+	resultDssError        string = "dss_error"
+	resultTimeout         string = "timeout"
+	resultSuperseded      string = "superseded"
+)
+
+// How the state of an output is published after a command.
+const (
+	// The requested value is published as soon as the dSS accepted the
+	// command.
+	stateModeOptimistic string = "optimistic"
+	// The requested value is published once the dSS reports the change, the
+	// actual value being published again when it does not in time.
+	stateModeConfirm string = "confirm"
+	// Only the changes reported by the dSS are published.
+	stateModeNone string = "none"
+)
+
+// CommandResult is published on the result topic of a device for every
+// command received.
+type CommandResult struct {
+	// Empty for the commands setting several outputs of the device.
+	OutputId      string             `json:"outputId"`
+	Value         *float64           `json:"value,omitempty"`
+	Values        map[string]float64 `json:"values,omitempty"`
+	Success       bool               `json:"success"`
+	Code          string             `json:"code"`
+	Message       string             `json:"message,omitempty"`
+	CorrelationId string             `json:"correlationId,omitempty"`
+	Time          time.Time          `json:"time"`
+}
+
+// Payload of a command, either a number or a JSON object with the value and
+// an optional correlation id echoed in the result, e.g.
+// {"value": 50, "correlationId": "abc"}. The commands of a device give the
+// values per output instead, e.g. {"values": {"brightness": 50}}.
+type commandPayload struct {
+	Value         *float64           `json:"value"`
+	Values        map[string]float64 `json:"values"`
+	CorrelationId string             `json:"correlationId"`
+}
+
+// Returns the values to set per output.
+func (p commandPayload) outputs(outputId string) map[string]float64 {
+	if p.Value == nil {
+		return p.Values
+	}
+	return map[string]float64{outputId: *p.Value}
+}
+
+func parseCommand(message string) (commandPayload, error) {
+	message = strings.TrimSpace(message)
+	command := commandPayload{}
+	if strings.HasPrefix(message, "{") {
+		if err := json.Unmarshal([]byte(message), &command); err != nil {
+			return command, &commandError{code: resultInvalidPayload, err: fmt.Errorf("error parsing message as JSON: %w", err)}
+		}
+		if command.Value == nil {
+			return command, &commandError{code: resultInvalidPayload, err: errors.New("no value in the message")}
+		}
+		command.Values = nil
+		return command, nil
+	}
+	value, err := strconv.ParseFloat(message, 64)
+	if err != nil {
+		return command, &commandError{code: resultInvalidPayload, err: fmt.Errorf("error parsing message as float value: %w", err)}
+	}
+	command.Value = &value
+	return command, nil
+}
+
+// Parses the command of a device, setting several outputs at once.
+func parseDeviceCommand(message string) (commandPayload, error) {
+	command := commandPayload{}
+	if err := json.Unmarshal([]byte(message), &command); err != nil {
+		return command, &commandError{code: resultInvalidPayload, err: fmt.Errorf("error parsing message as JSON: %w", err)}
+	}
+	command.Value = nil
+	if len(command.Values) == 0 {
+		return command, &commandError{code: resultInvalidPayload, err: errors.New("no values in the message")}
+	}
+	return command, nil
+}
+
+// Error of a command, with the code reported in the result.
+type commandError struct {
+	code string
+	err  error
+}
+
+func (e *commandError) Error() string {
+	return e.err.Error()
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// Returns the result of a command given its error.
+func newCommandResult(outputId string, command commandPayload, err error) CommandResult {
+	result := CommandResult{
+		OutputId:      outputId,
+		Value:         command.Value,
+		Values:        command.Values,
+		Success:       err == nil,
+		Code:          resultOk,
+		CorrelationId: command.CorrelationId,
+		Time:          time.Now(),
+	}
+	if err == nil {
+		return result
+	}
+	result.Message = err.Error()
+	var cmdErr *commandError
+	switch {
+	case errors.As(err, &cmdErr):
+		result.Code = cmdErr.code
+	case errors.Is(err, digitalstrom.ErrUnauthorized):
+		result.Code = resultUnauthorized
+	case errors.Is(err, digitalstrom.ErrUnreachable):
+		result.Code = resultUnreachable
+	default:
+		result.Code = resultDssError
+	}
+	return result
+}
+
+// Command waiting for the dSS to report the change of the output.
+type pendingCommand struct {
+	value float64
+	// Receives the code of the result.
+	result chan string
+}
+
+// Commands waiting for a confirmation, at most one per output.
+type pendingCommands struct {
+	waiting map[string]*pendingCommand
+	mutex   sync.Mutex
+}
+
+func pendingKey(deviceId string, outputId string) string {
+	return deviceId + "/" + outputId
+}
+
+// Registers a command, superseding the one waiting for the same output.
+func (p *pendingCommands) add(deviceId string, outputId string, value float64) *pendingCommand {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.waiting == nil {
+		p.waiting = map[string]*pendingCommand{}
+	}
+	key := pendingKey(deviceId, outputId)
+	if previous, ok := p.waiting[key]; ok {
+		previous.result <- resultSuperseded
+	}
+	command := &pendingCommand{value: value, result: make(chan string, 1)}
+	p.waiting[key] = command
+	return command
+}
+
+// Forgets the command, e.g. after a timeout.
+func (p *pendingCommands) remove(deviceId string, outputId string, command *pendingCommand) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	key := pendingKey(deviceId, outputId)
+	if p.waiting[key] == command {
+		delete(p.waiting, key)
+	}
+}
+
+// Confirms the command waiting for the output if the dSS reports the
+// requested value.
+func (p *pendingCommands) changed(deviceId string, outputId string, value float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	key := pendingKey(deviceId, outputId)
+	command, ok := p.waiting[key]
+	// The dSS rounds the values.
+	if ok && math.Abs(command.value-value) < 0.5 {
+		command.result <- resultOk
+		delete(p.waiting, key)
+	}
+}
@@ -0,0 +1,66 @@
+package modules
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCommand(t *testing.T) {
+	command, err := parseCommand(" 42.5 ")
+	assert.NoError(t, err)
+	assert.Equal(t, 42.5, *command.Value)
+
+	command, err = parseCommand(`{"value": 10, "correlationId": "abc"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 10.0, *command.Value)
+	assert.Equal(t, "abc", command.CorrelationId)
+
+	_, err = parseCommand(`{"correlationId": "abc"}`)
+	assert.Equal(t, resultInvalidPayload, newCommandResult("0", commandPayload{}, err).Code)
+	_, err = parseCommand("on")
+	assert.Equal(t, resultInvalidPayload, newCommandResult("0", commandPayload{}, err).Code)
+}
+
+func TestParseDeviceCommand(t *testing.T) {
+	command, err := parseDeviceCommand(`{"values": {"shadePositionOutside": 50, "shadeOpeningAngleOutside": 20}, "correlationId": "abc"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"shadePositionOutside": 50, "shadeOpeningAngleOutside": 20}, command.outputs(""))
+	assert.Equal(t, "abc", command.CorrelationId)
+
+	_, err = parseDeviceCommand(`{"value": 50}`)
+	assert.Equal(t, resultInvalidPayload, newCommandResult("", commandPayload{}, err).Code)
+	_, err = parseDeviceCommand("50")
+	assert.Equal(t, resultInvalidPayload, newCommandResult("", commandPayload{}, err).Code)
+}
+
+func TestCommandResultCodes(t *testing.T) {
+	value := 50.0
+	command := commandPayload{Value: &value, CorrelationId: "abc"}
+
+	result := newCommandResult("brightness", command, nil)
+	assert.True(t, result.Success)
+	assert.Equal(t, resultOk, result.Code)
+	assert.Equal(t, "abc", result.CorrelationId)
+
+	result = newCommandResult("brightness", command, fmt.Errorf("error doing the request: %w", digitalstrom.ErrUnreachable))
+	assert.False(t, result.Success)
+	assert.Equal(t, resultUnreachable, result.Code)
+	assert.Equal(t, resultDssError, newCommandResult("brightness", command, fmt.Errorf("httpStatus=500")).Code)
+}
+
+func TestPendingCommands(t *testing.T) {
+	pending := pendingCommands{}
+
+	first := pending.add("d1", "brightness", 50)
+	second := pending.add("d1", "brightness", 80)
+	assert.Equal(t, resultSuperseded, <-first.result)
+
+	// Another value does not confirm the command.
+	pending.changed("d1", "brightness", 50)
+	assert.Len(t, second.result, 0)
+	pending.changed("d1", "brightness", 80.2)
+	assert.Equal(t, resultOk, <-second.result)
+}
@@ -1,16 +1,25 @@
 package modules
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	mqtt_base "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/homeassistant"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/metrics"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/mqtt"
 	"github.com/rs/zerolog/log"
+	"math"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -28,156 +37,634 @@ type DeviceModule struct {
 
 	normalizeDeviceName  bool
 	refreshAtStart       bool
-	invertBlindsPosition bool
+	invertBlindsPosition atomic.Bool
+	overrides            config.Overrides
+
+	// How the state is published after a command.
+	stateMode      string
+	confirmTimeout time.Duration
+	pending        pendingCommands
+
+	// Queues the commands received from MQTT.
+	dispatcher *commandDispatcher
+	// Command topics subscribed per device id, changing with the structure
+	// of the apartment.
+	commandTopicsMutex sync.Mutex
+	commandTopics      map[string][]string
+
+	history commandHistory
+	skipped skippedDevices
 }
 
 func (c *DeviceModule) Start() error {
+	c.dispatcher.start()
 	devices, err := c.dsRegistry.GetDevices()
+	if err != nil {
+		return err
+	}
 
 	for _, device := range devices {
-		err := c.dsRegistry.DeviceChangeSubscribe(device.DeviceId, func(deviceId string, outputId string, oldValue float64, newValue float64) {
-			err := c.updateDevice(deviceId)
-			if err != nil {
-				log.Error().Err(err).Str("deviceid", deviceId).Msg("Error updating device ")
-			}
-		})
-		if err != nil {
-			return err
+		if c.deviceSettings(&device).Exclude {
+			log.Info().Str("device", device.Attributes.Name).Msg("Device excluded by the config.")
 		}
 	}
+	c.logClassification(devices)
+	err = c.dsRegistry.Subscribe("devices", c.handleEvent)
+	if err != nil {
+		return err
+	}
 
-	if err == nil {
-		// Refresh devices values.
-		if c.refreshAtStart {
-			go func() {
-				for _, device := range devices {
-					if err := c.updateDevice(device.DeviceId); err != nil {
-						log.Error().Err(err).Msgf("Error updating device '%s'", device.Attributes.Name)
-					}
+	// Refresh devices values.
+	if c.refreshAtStart {
+		go func() {
+			for _, device := range devices {
+				if err := c.updateDevice(device.DeviceId); err != nil {
+					log.Error().Err(err).Msgf("Error updating device '%s'", device.Attributes.Name)
 				}
-			}()
-		}
+			}
+		}()
 	}
 
 	// Subscribe to MQTT events.
 	for _, device := range devices {
-		outputs, err := c.dsRegistry.GetOutputsOfDevice(device.DeviceId)
-		if err == nil {
-			for _, output := range outputs {
-				deviceId := device.DeviceId          // deep copy
-				deviceName := device.Attributes.Name // deep copy
-				outputName := output.OutputId        // deep copy
-				topic := c.deviceCommandTopic(deviceName, outputName)
-				log.Trace().
-					Str("topic", topic).
-					Str("deviceName", deviceName).
-					Str("outputName", outputName).
-					Msg("Subscribing for topic.")
-				err := c.mqttClient.Subscribe(topic, func(client mqtt_base.Client, message mqtt_base.Message) {
-					payload := string(message.Payload())
-					log.Trace().
-						Str("topic", topic).
-						Str("deviceName", deviceName).
-						Str("outputName", outputName).
-						Str("payload", payload).
-						Msg("Message Received.")
-					if err := c.onMqttMessage(deviceId, outputName, payload); err != nil {
-						log.Error().
-							Str("topic", topic).
-							Err(err).
-							Msg("Error handling MQTT Message.")
-					}
-				})
-				if err != nil {
-					return err
-				}
+		if err := c.subscribeDevice(&device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handles the events of the registry: publishes the changed outputs and
+// follows the devices added, renamed or removed when the structure of the
+// apartment is reloaded.
+func (c *DeviceModule) handleEvent(event digitalstrom.Event) {
+	switch changed := event.(type) {
+	case digitalstrom.OutputChanged:
+		if channels, err := c.channelsOfDevice(changed.DeviceId); err == nil {
+			if ch, ok := channelOfOutput(channels, changed.FunctionBlockId, changed.OutputId); ok {
+				c.pending.changed(changed.DeviceId, ch.name, changed.NewValue)
 			}
 		}
+		// Excluded devices are skipped.
+		if err := c.updateDevice(changed.DeviceId); err != nil {
+			log.Error().Err(err).Str("deviceid", changed.DeviceId).Msg("Error updating device ")
+		}
+	case digitalstrom.DeviceAdded:
+		c.resubscribeDevice(changed.Device.DeviceId)
+	case digitalstrom.DeviceRenamed:
+		// The commands are received on the topics of the new name.
+		c.resubscribeDevice(changed.DeviceId)
+	case digitalstrom.DeviceRemoved:
+		if err := c.unsubscribeDevice(changed.Device.DeviceId); err != nil {
+			log.Error().Err(err).Str("deviceid", changed.Device.DeviceId).Msg("Error unsubscribing device")
+		}
+	}
+}
+
+// Subscribes again to the command topics of the device as it is now in the
+// registry and publishes its state on its topics.
+func (c *DeviceModule) resubscribeDevice(deviceId string) {
+	if err := c.unsubscribeDevice(deviceId); err != nil {
+		log.Error().Err(err).Str("deviceid", deviceId).Msg("Error unsubscribing device")
+	}
+	device, err := c.dsRegistry.GetDevice(deviceId)
+	if err != nil {
+		log.Error().Err(err).Str("deviceid", deviceId).Msg("Error getting device")
+		return
+	}
+	if err := c.subscribeDevice(&device); err != nil {
+		log.Error().Err(err).Str("deviceid", deviceId).Msg("Error subscribing device")
+	}
+	if err := c.updateDevice(deviceId); err != nil {
+		log.Error().Err(err).Str("deviceid", deviceId).Msg("Error updating device ")
+	}
+}
+
+// Subscribes to the command topics of the device and of its outputs, unless
+// the device is excluded or read-only.
+func (c *DeviceModule) subscribeDevice(device *digitalstrom.Device) error {
+	settings := c.deviceSettings(device)
+	if settings.Exclude || settings.ReadOnly {
+		return nil
+	}
+	channels, err := c.channelsOfDevice(device.DeviceId)
+	if err != nil {
+		return nil
+	}
+	// Commands setting several outputs at once.
+	if err := c.subscribeCommand(device, ""); err != nil {
+		return err
+	}
+	for _, ch := range channels {
+		if err := c.subscribeCommand(device, ch.name); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Unsubscribes from all the command topics subscribed for the device.
+func (c *DeviceModule) unsubscribeDevice(deviceId string) error {
+	c.commandTopicsMutex.Lock()
+	topics := c.commandTopics[deviceId]
+	delete(c.commandTopics, deviceId)
+	c.commandTopicsMutex.Unlock()
+
+	var errs []error
+	for _, topic := range topics {
+		log.Trace().Str("topic", topic).Str("deviceid", deviceId).Msg("Unsubscribing from topic.")
+		errs = append(errs, c.mqttClient.Unsubscribe(topic))
+	}
+	return errors.Join(errs...)
+}
+
+// Subscribes to the command topic of the output, or of the device when the
+// output id is empty, queuing the commands received.
+func (c *DeviceModule) subscribeCommand(device *digitalstrom.Device, outputName string) error {
+	deviceId := device.DeviceId          // deep copy
+	deviceName := device.Attributes.Name // deep copy
+	topic := c.deviceCommandTopic(c.topicName(device), outputName)
+	log.Trace().
+		Str("topic", topic).
+		Str("deviceName", deviceName).
+		Str("outputName", outputName).
+		Msg("Subscribing for topic.")
+	c.commandTopicsMutex.Lock()
+	c.commandTopics[deviceId] = append(c.commandTopics[deviceId], topic)
+	c.commandTopicsMutex.Unlock()
+	return c.mqttClient.Subscribe(topic, func(client mqtt_base.Client, message mqtt_base.Message) {
+		payload := string(message.Payload())
+		log.Trace().
+			Str("topic", topic).
+			Str("deviceName", deviceName).
+			Str("outputName", outputName).
+			Str("payload", payload).
+			Msg("Message Received.")
+		// The handler must not block as the messages are delivered in order.
+		c.dispatcher.enqueue(queuedCommand{
+			deviceId: deviceId,
+			outputId: outputName,
+			payload:  payload,
+			received: time.Now(),
+		})
+	})
+}
+
 func (c *DeviceModule) Stop() error {
-	if devices, err := c.dsRegistry.GetDevices(); err != nil {
-		for _, device := range devices {
-			_ = c.dsRegistry.DeviceChangeUnsubscribe(device.DeviceId)
+	_ = c.dsRegistry.Unsubscribe("devices")
+	c.dispatcher.stop()
+
+	return nil
+}
+
+// Reload applies the inversion of the blinds position, publishing again the
+// states of the devices when it changed.
+func (c *DeviceModule) Reload(config *config.Config) error {
+	if c.invertBlindsPosition.Swap(config.InvertBlindsPosition) == config.InvertBlindsPosition {
+		return nil
+	}
+	devices, err := c.dsRegistry.GetDevices()
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if err := c.updateDevice(device.DeviceId); err != nil {
+			log.Error().Err(err).Msgf("Error updating device '%s'", device.Attributes.Name)
 		}
 	}
-
 	return nil
 }
 
-func (c *DeviceModule) onMqttMessage(deviceId string, outputId string, message string) error {
+// Executes a command received from MQTT or the API, called by the
+// dispatcher. In confirm mode, the command is done once the dSS reported the
+// change, which is waited for without blocking the worker.
+func (c *DeviceModule) executeCommand(queued queuedCommand) {
+	command, err := queued.parse()
+	if err == nil {
+		var confirm func() error
+		confirm, err = c.setOutputValues(queued.deviceId, queued.outputId, command)
+		if err == nil && confirm != nil {
+			go func() {
+				c.finishCommand(queued, command, confirm())
+			}()
+			return
+		}
+	}
+	c.finishCommand(queued, command, err)
+}
+
+// Publishes the result of a command, records it in the history and replies
+// to the one waiting for it.
+func (c *DeviceModule) finishCommand(queued queuedCommand, command commandPayload, err error) {
+	if err != nil {
+		log.Error().
+			Str("deviceid", queued.deviceId).
+			Str("outputId", queued.outputId).
+			Err(err).
+			Msg("Error handling command.")
+	}
+	result := newCommandResult(queued.outputId, command, err)
+	c.publishResult(queued.deviceId, result)
+	// Includes the time spent in the queue.
+	duration := time.Since(queued.received)
+	c.recordCommand(queued, duration, err)
+	label := "success"
+	if err != nil {
+		label = "error"
+	}
+	metrics.CommandDuration.WithLabelValues(label).Observe(duration.Seconds())
+	queued.reply(result)
+}
+
+// Reports a command replaced by a newer one for the same output before being
+// executed.
+func (c *DeviceModule) onCommandSuperseded(queued queuedCommand) {
+	log.Debug().
+		Str("deviceid", queued.deviceId).
+		Str("outputId", queued.outputId).
+		Str("payload", queued.payload).
+		Msg("Command superseded by a newer one.")
+	// Called from the MQTT handler, which must not block.
+	go func() {
+		command, _ := queued.parse()
+		err := &commandError{code: resultSuperseded, err: errors.New("superseded by a newer command")}
+		result := newCommandResult(queued.outputId, command, err)
+		c.publishResult(queued.deviceId, result)
+		c.recordCommand(queued, 0, err)
+		queued.reply(result)
+	}()
+}
+
+// OutputSetter is implemented by the modules setting the outputs of the
+// devices on behalf of the API.
+type OutputSetter interface {
+	SetOutputValue(ctx context.Context, deviceId string, functionBlockId string, outputId string, value float64) (CommandResult, error)
+}
+
+// SetOutputValue queues a command for the output as if received from MQTT,
+// so that the same checks and rate limit apply, and waits for its result. The
+// function block is only needed for the devices having several outputs with
+// the same id.
+func (c *DeviceModule) SetOutputValue(ctx context.Context, deviceId string, functionBlockId string, outputId string, value float64) (CommandResult, error) {
+	command := commandPayload{Value: &value}
+	channels, err := c.channelsOfDevice(deviceId)
+	if err != nil {
+		return newCommandResult(outputId, command, &commandError{code: resultUnknownDevice, err: err}), nil
+	}
+	ch, ok := firstChannelOfOutput(channels, outputId)
+	if functionBlockId != "" {
+		ch, ok = channelOfOutput(channels, functionBlockId, outputId)
+	}
+	if !ok {
+		err := fmt.Errorf("no output '%s' found for device %s", outputId, deviceId)
+		return newCommandResult(outputId, command, &commandError{code: resultInvalidPayload, err: err}), nil
+	}
+
+	// Buffered so that the dispatcher never waits for the caller.
+	result := make(chan CommandResult, 1)
+	c.dispatcher.enqueue(queuedCommand{
+		deviceId: deviceId,
+		outputId: ch.name,
+		payload:  strconv.FormatFloat(value, 'f', -1, 64),
+		received: time.Now(),
+		result:   result,
+	})
+	select {
+	case r := <-result:
+		return r, nil
+	case <-ctx.Done():
+		return CommandResult{}, ctx.Err()
+	}
+}
+
+func (c *DeviceModule) recordCommand(queued queuedCommand, duration time.Duration, err error) {
+	record := CommandRecord{
+		Time:     queued.received,
+		DeviceId: queued.deviceId,
+		OutputId: queued.outputId,
+		Payload:  queued.payload,
+		Duration: duration,
+	}
+	if device, err := c.dsRegistry.GetDevice(queued.deviceId); err == nil {
+		record.Device = device.Attributes.Name
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	c.history.add(record)
+}
+
+func (c *DeviceModule) GetCommandHistory() []CommandRecord {
+	return c.history.list()
+}
+
+func (c *DeviceModule) GetDeviceTopics() ([]Topic, error) {
+	devices, err := c.dsRegistry.GetDevices()
+	if err != nil {
+		return nil, err
+	}
+	topics := []Topic{}
+	for _, device := range devices {
+		settings := c.deviceSettings(&device)
+		if settings.Exclude {
+			continue
+		}
+		channels, err := c.channelsOfDevice(device.DeviceId)
+		if err != nil {
+			return nil, err
+		}
+		topicName := c.topicName(&device)
+		if !settings.ReadOnly {
+			topics = append(topics,
+				Topic{
+					DeviceId: device.DeviceId,
+					Kind:     mqtt.Result,
+					Topic:    c.mqttClient.GetFullTopic(c.deviceResultTopic(topicName)),
+				},
+				Topic{
+					DeviceId: device.DeviceId,
+					Kind:     mqtt.Command,
+					Topic:    c.mqttClient.GetFullTopic(c.deviceCommandTopic(topicName, "")),
+				})
+		}
+		for _, ch := range channels {
+			topics = append(topics,
+				Topic{
+					DeviceId:        device.DeviceId,
+					OutputId:        ch.name,
+					FunctionBlockId: ch.functionBlock.FunctionBlockId,
+					Kind:            mqtt.State,
+					Topic:           c.mqttClient.GetFullTopic(c.deviceStateTopic(topicName, ch.name)),
+				})
+			if !settings.ReadOnly {
+				topics = append(topics,
+					Topic{
+						DeviceId:        device.DeviceId,
+						OutputId:        ch.name,
+						FunctionBlockId: ch.functionBlock.FunctionBlockId,
+						Kind:            mqtt.Command,
+						Topic:           c.mqttClient.GetFullTopic(c.deviceCommandTopic(topicName, ch.name)),
+					})
+			}
+		}
+	}
+	return topics, nil
+}
+
+// Sets the values of the outputs in a single request, so that they change
+// together. The outputs are named by their channel, the output id being empty
+// for the commands of the whole device. In confirm mode, returns the function
+// waiting for the dSS to report the changes.
+func (c *DeviceModule) setOutputValues(deviceId string, outputId string, command commandPayload) (func() error, error) {
 	device, err := c.dsRegistry.GetDevice(deviceId)
 	if err != nil {
-		return err
+		return nil, &commandError{code: resultUnknownDevice, err: err}
 	}
 
-	value, err := strconv.ParseFloat(strings.TrimSpace(message), 64)
+	settings := c.deviceSettings(&device)
+	selected, targets, err := c.outputTargets(&device, settings, outputId, command)
 	if err != nil {
-		return fmt.Errorf("error parsing message as float value: %w", err)
+		return nil, err
+	}
+	for i, target := range targets {
+		log.Info().
+			Str("device", device.Attributes.Name).
+			Str("outputId", selected[i].name).
+			Float64("value", target.Value).
+			Msg("Setting value.")
+	}
+
+	pending := map[string]*pendingCommand{}
+	if c.stateMode == stateModeConfirm {
+		for i, target := range targets {
+			name := selected[i].name
+			// Registered before sending the command to not miss the change.
+			pending[name] = c.pending.add(deviceId, name, target.Value)
+			// The dSS does not report any change when the output already has
+			// the value, compared with the same rounding as the changes.
+			c.pending.changed(deviceId, name, c.channelValue(deviceId, selected[i]))
+		}
 	}
-	value = c.invertValueIfNeeded(outputId, value)
-	log.Info().
-		Str("device", device.Attributes.Name).
-		Str("outputId", outputId).
-		Float64("value", value).
-		Msg("Setting value.")
 
-	functionBlock, err := c.dsRegistry.GetFunctionBlockForDevice(deviceId)
+	err = c.dsClient.DeviceSetOutputValues(deviceId, targets)
 	if err != nil {
-		return fmt.Errorf("no function block found for device %s: %w", deviceId, err)
+		for id, command := range pending {
+			c.pending.remove(deviceId, id, command)
+		}
+		return nil, err
+	}
+
+	switch c.stateMode {
+	case stateModeConfirm:
+		return func() error {
+			return c.waitForConfirmation(&device, outputId, pending)
+		}, nil
+	case stateModeOptimistic:
+		// for fast deliveries we confirm the state
+		for i, target := range targets {
+			if err := c.publishDeviceValue(&device, settings, selected[i], target.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Returns the channels set by a command and their targets, checking that the
+// device accepts commands and that the values are in the range of the
+// outputs.
+func (c *DeviceModule) outputTargets(device *digitalstrom.Device, settings config.DeviceSettings, outputId string, command commandPayload) ([]channel, []digitalstrom.OutputTarget, error) {
+	if err := checkCommandsAccepted(device, settings); err != nil {
+		return nil, nil, err
 	}
 
-	err = c.dsClient.DeviceSetOutputValue(deviceId, functionBlock.FunctionBlockId, outputId, value)
+	channels, err := c.channelsOfDevice(device.DeviceId)
+	if err == nil && len(channels) == 0 {
+		err = errors.New("no output")
+	}
 	if err != nil {
-		return err
+		return nil, nil, &commandError{code: resultNoFunctionBlock, err: fmt.Errorf("no function block found for device %s: %w", device.DeviceId, err)}
 	}
 
-	// for fast deliveries we confirm the state
-	if err := c.publishDeviceValue(&device, outputId, value); err != nil {
-		return err
+	outputs := command.outputs(outputId)
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	selected := make([]channel, 0, len(names))
+	targets := make([]digitalstrom.OutputTarget, 0, len(names))
+	for _, name := range names {
+		ch, ok := findChannel(channels, name)
+		if !ok {
+			return nil, nil, &commandError{code: resultInvalidPayload, err: fmt.Errorf("no output '%s' for device '%s'", name, device.Attributes.Name)}
+		}
+		sc := c.scalingOf(settings, ch.output)
+		value, err := sc.check(name, outputs[name], sc.fromCommand(outputs[name]))
+		if err != nil {
+			return nil, nil, err
+		}
+		target, err := ch.functionBlock.OutputTarget(ch.output.OutputId, value)
+		if err != nil {
+			return nil, nil, &commandError{code: resultInvalidPayload, err: err}
+		}
+		selected = append(selected, ch)
+		targets = append(targets, target)
 	}
+	return selected, targets, nil
+}
 
+// Returns an error when the device does not accept commands, being read-only
+// or excluded by the config.
+func checkCommandsAccepted(device *digitalstrom.Device, settings config.DeviceSettings) error {
+	if settings.ReadOnly || settings.Exclude {
+		return &commandError{code: resultReadOnly, err: fmt.Errorf("device '%s' is read-only", device.Attributes.Name)}
+	}
 	return nil
 }
 
+// Returns a module only used to check the commands sent without running the
+// bridge. Only the overrides of the devices and the inversion of the blinds
+// position of the config are used.
+func newCheckingModule(dsRegistry digitalstrom.Registry, config *config.Config) *DeviceModule {
+	module := &DeviceModule{dsRegistry: dsRegistry, overrides: config.Overrides}
+	module.invertBlindsPosition.Store(config.InvertBlindsPosition)
+	return module
+}
+
+// CheckDeviceAction returns an error when the actions of the device, e.g.
+// app.moveUp, are refused by the config like its commands.
+func CheckDeviceAction(dsRegistry digitalstrom.Registry, config *config.Config, device digitalstrom.Device) error {
+	module := newCheckingModule(dsRegistry, config)
+	return checkCommandsAccepted(&device, module.deviceSettings(&device))
+}
+
+// CheckOutputValue checks a value like a command received from MQTT for an
+// output named as in the topics, the first output of the device when empty,
+// and returns the target to send to the dSS. Used by the CLI, which sends a
+// single command without running the bridge.
+func CheckOutputValue(dsRegistry digitalstrom.Registry, config *config.Config, deviceId string, outputId string, value float64) (digitalstrom.OutputTarget, error) {
+	module := newCheckingModule(dsRegistry, config)
+
+	device, err := dsRegistry.GetDevice(deviceId)
+	if err != nil {
+		return digitalstrom.OutputTarget{}, err
+	}
+	if outputId == "" {
+		channels, err := module.channelsOfDevice(deviceId)
+		if err != nil {
+			return digitalstrom.OutputTarget{}, err
+		}
+		if len(channels) == 0 {
+			return digitalstrom.OutputTarget{}, fmt.Errorf("device '%s' has no output", device.Attributes.Name)
+		}
+		outputId = channels[0].name
+	}
+	_, targets, err := module.outputTargets(&device, module.deviceSettings(&device), outputId, commandPayload{Value: &value})
+	if err != nil {
+		return digitalstrom.OutputTarget{}, err
+	}
+	return targets[0], nil
+}
+
+// Waits for the dSS to report the changes requested by the command. When it
+// does not in time, the known values of the outputs are published again to
+// roll back the state.
+func (c *DeviceModule) waitForConfirmation(device *digitalstrom.Device, outputId string, pending map[string]*pendingCommand) error {
+	var err error
+	timeout := time.After(c.confirmTimeout)
+	for id, waiting := range pending {
+		if err != nil {
+			c.pending.remove(device.DeviceId, id, waiting)
+			continue
+		}
+		select {
+		case code := <-waiting.result:
+			if code != resultOk {
+				err = &commandError{code: code, err: errors.New("superseded by a newer command")}
+			}
+		case <-timeout:
+			c.pending.remove(device.DeviceId, id, waiting)
+			err = &commandError{code: resultTimeout, err: fmt.Errorf("change not confirmed by the dSS after %s", c.confirmTimeout)}
+		}
+	}
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) && cmdErr.code == resultTimeout {
+		log.Warn().
+			Str("device", device.Attributes.Name).
+			Str("outputId", outputId).
+			Msg("Command not confirmed, rolling back the state.")
+		if err := c.updateDevice(device.DeviceId); err != nil {
+			log.Error().Err(err).Str("device", device.Attributes.Name).Msg("Error rolling back the state.")
+		}
+	}
+	return err
+}
+
+// Publishes the result of a command on the result topic of the device.
+func (c *DeviceModule) publishResult(deviceId string, result CommandResult) {
+	device, err := c.dsRegistry.GetDevice(deviceId)
+	if err != nil {
+		log.Warn().Err(err).Str("deviceId", deviceId).Msg("No result published for the command of an unknown device.")
+		return
+	}
+	payload, err := json.Marshal(result)
+	if err != nil {
+		log.Error().Err(err).Msg("Error serializing the command result.")
+		return
+	}
+	if err := c.mqttClient.Publish(c.deviceResultTopic(c.topicName(&device)), payload); err != nil {
+		log.Error().Err(err).Str("device", device.Attributes.Name).Msg("Error publishing the command result.")
+	}
+}
+
 func (c *DeviceModule) updateDevice(deviceId string) error {
 	device, err := c.dsRegistry.GetDevice(deviceId)
 	if err != nil {
 		return err
 	}
-	outputs, err := c.dsRegistry.GetOutputsOfDevice(deviceId)
+	settings := c.deviceSettings(&device)
+	if settings.Exclude {
+		return nil
+	}
+	channels, err := c.channelsOfDevice(deviceId)
 	if err != nil {
 		return err
 	}
-	if len(outputs) == 0 {
+	if len(channels) == 0 {
 		log.Debug().Str("device", device.Attributes.Name).Msg("Skipping update. No output channels.")
 		return nil
 	}
 
-	channels := []string{}
-	for _, output := range outputs {
-		channels = append(channels, output.Attributes.TechnicalName)
+	technicalNames := []string{}
+	for _, ch := range channels {
+		technicalNames = append(technicalNames, ch.output.Attributes.TechnicalName)
 	}
 	log.Debug().
 		Str("device", device.Attributes.Name).
-		Str("outputChannels", strings.Join(channels, ";")).
+		Str("outputChannels", strings.Join(technicalNames, ";")).
 		Msg("Updating device")
 
-	outputValues, err := c.dsRegistry.GetOutputValuesOfDevice(deviceId)
-	if err != nil {
-		return err
-	}
+	// Values by function block and output.
 	outputValuesLookup := map[string]digitalstrom.OutputValue{}
-	for _, outputValue := range outputValues {
-		outputValuesLookup[outputValue.OutputId] = outputValue
+	for _, ch := range channels {
+		functionBlockId := ch.functionBlock.FunctionBlockId
+		if _, ok := outputValuesLookup[functionBlockId]; ok {
+			continue
+		}
+		outputValues, err := c.dsRegistry.GetOutputValuesOfFunctionBlock(deviceId, functionBlockId)
+		if err != nil {
+			return err
+		}
+		outputValuesLookup[functionBlockId] = digitalstrom.OutputValue{}
+		for _, outputValue := range outputValues {
+			outputValuesLookup[functionBlockId+"/"+outputValue.OutputId] = outputValue
+		}
 	}
 
-	for _, output := range outputs {
-		outputValue := outputValuesLookup[output.OutputId]
-		value := c.invertValueIfNeeded(output.OutputId, outputValue.TargetValue)
-		if err := c.publishDeviceValue(&device, output.OutputId, value); err != nil {
+	for _, ch := range channels {
+		outputValue := outputValuesLookup[ch.functionBlock.FunctionBlockId+"/"+ch.output.OutputId]
+		if err := c.publishDeviceValue(&device, settings, ch, outputValue.TargetValue); err != nil {
 			return fmt.Errorf("error publishing device '%s' value: %w", device.Attributes.Name, err)
 		}
 	}
@@ -185,37 +672,78 @@ func (c *DeviceModule) updateDevice(deviceId string) error {
 	return nil
 }
 
-func (c *DeviceModule) publishDeviceValue(device *digitalstrom.Device, outputId string, value float64) error {
-	return c.mqttClient.Publish(c.deviceStateTopic(device.Attributes.Name, outputId), fmt.Sprintf("%.2f", value))
+// Publishes the value of an output, converting it from the value of the dSS
+// according to the settings of the device.
+func (c *DeviceModule) publishDeviceValue(device *digitalstrom.Device, settings config.DeviceSettings, ch channel, value float64) error {
+	value = c.scalingOf(settings, ch.output).toPublished(value)
+	if metrics.ValuesExported() {
+		zoneName := device.Attributes.Zone
+		if zone, err := c.dsRegistry.GetZone(device.Attributes.Zone); err == nil {
+			zoneName = zone.Attributes.Name
+		}
+		controllerName := device.Attributes.Controller
+		if controller, err := c.dsRegistry.GetControllerById(device.Attributes.Controller); err == nil {
+			controllerName = controller.Attributes.Name
+		}
+		metrics.OutputValue.
+			WithLabelValues(device.Attributes.Name, device.Attributes.Dsid, zoneName, controllerName, ch.name).
+			Set(value)
+	}
+	return c.mqttClient.Publish(c.deviceStateTopic(c.topicName(device), ch.name), fmt.Sprintf("%.2f", value))
 }
 
-func (c *DeviceModule) invertValueIfNeeded(channel string, value float64) float64 {
-	if c.invertBlindsPosition {
-		if strings.HasPrefix(strings.ToLower(channel), "shadeposition") {
-			return 100 - value
-		}
+// Returns the settings of the device, the global ones being overridden by the
+// ones of its zone and its own.
+func (c *DeviceModule) deviceSettings(device *digitalstrom.Device) config.DeviceSettings {
+	defaults := config.DeviceSettings{
+		InvertBlindsPosition: c.invertBlindsPosition.Load(),
 	}
+	return resolveDeviceSettings(c.dsRegistry, c.overrides, defaults, device)
+}
 
-	// nothing to invert
-	return value
+func resolveDeviceSettings(dsRegistry digitalstrom.Registry, overrides config.Overrides, defaults config.DeviceSettings, device *digitalstrom.Device) config.DeviceSettings {
+	zoneName := ""
+	if zone, err := dsRegistry.GetZone(device.Attributes.Zone); err == nil {
+		zoneName = zone.Attributes.Name
+	}
+	return overrides.Resolve(defaults, device.Attributes.Dsid, device.Attributes.Name, device.Attributes.Zone, zoneName)
 }
 
-func (c *DeviceModule) deviceStateTopic(deviceName string, channel string) string {
-	if c.normalizeDeviceName {
-		deviceName = normalizeForTopicName(deviceName)
+// Returns the name of the device used in the topics.
+func (c *DeviceModule) topicName(device *digitalstrom.Device) string {
+	return deviceTopicName(device, c.deviceSettings(device))
+}
+
+func deviceTopicName(device *digitalstrom.Device, settings config.DeviceSettings) string {
+	if settings.TopicName != "" {
+		return settings.TopicName
 	}
-	return path.Join(devices, deviceName, channel, mqtt.State)
+	return device.Attributes.Name
+}
+
+func (c *DeviceModule) deviceStateTopic(deviceName string, channel string) string {
+	return deviceTopic(c.normalizeDeviceName, deviceName, channel, mqtt.State)
+}
+
+func (c *DeviceModule) deviceResultTopic(deviceName string) string {
+	return deviceTopic(c.normalizeDeviceName, deviceName, mqtt.Result)
 }
 
 func (c *DeviceModule) deviceCommandTopic(deviceName string, channel string) string {
-	if c.normalizeDeviceName {
+	return deviceTopic(c.normalizeDeviceName, deviceName, channel, mqtt.Command)
+}
+
+// Returns the topic of a device, relative to the prefix of the topics.
+func deviceTopic(normalizeDeviceName bool, deviceName string, elements ...string) string {
+	if normalizeDeviceName {
 		deviceName = normalizeForTopicName(deviceName)
 	}
-	return path.Join(devices, deviceName, channel, mqtt.Command)
+	return path.Join(append([]string{devices, deviceName}, elements...)...)
 }
 
 func (c *DeviceModule) GetHomeAssistantEntities() ([]homeassistant.DiscoveryConfig, error) {
 	configs := []homeassistant.DiscoveryConfig{}
+	c.skipped.reset()
 
 	devices, err := c.dsRegistry.GetDevices()
 	if err != nil {
@@ -223,100 +751,255 @@ func (c *DeviceModule) GetHomeAssistantEntities() ([]homeassistant.DiscoveryConf
 	}
 
 	for _, device := range devices {
-		functionBlock, err := c.dsRegistry.GetFunctionBlockForDevice(device.DeviceId)
+		settings := c.deviceSettings(&device)
+		if settings.Exclude {
+			c.skipped.add(device.DeviceId, device.Attributes.Name, "excluded by the config")
+			continue
+		}
+		topicName := c.topicName(&device)
+		functionBlocks, err := c.dsRegistry.GetFunctionBlocksOfDevice(device.DeviceId)
 		if err != nil {
 			return nil, err
 		}
-		properties := functionBlock.Properties()
-		deviceType := functionBlock.DeviceType()
-		var cfg homeassistant.DiscoveryConfig
-		if deviceType == digitalstrom.DeviceTypeLight {
+		channels := channelsOf(functionBlocks)
+		for _, functionBlock := range functionBlocks {
+			// The entities of the devices with several function blocks are
+			// suffixed by the id of the function block.
+			suffix := ""
+			if len(functionBlocks) > 1 {
+				suffix = "_" + functionBlock.FunctionBlockId
+			}
+			cfg, used, reason := c.functionBlockEntity(&device, settings, topicName, functionBlock, channels, suffix)
+			if cfg != nil {
+				configs = append(configs, *cfg)
+			}
+			// The other outputs have their own entity.
+			outputConfigs := c.outputEntities(&device, settings, topicName, functionBlock, channels, used)
+			configs = append(configs, outputConfigs...)
+			if cfg == nil && len(outputConfigs) == 0 {
+				c.skipped.add(device.DeviceId, device.Attributes.Name, reason)
+			}
+		}
+	}
+	return configs, nil
+}
 
-			outputs, err := c.dsRegistry.GetOutputsOfDevice(device.DeviceId)
-			if err != nil || len(outputs) == 0 {
-				log.Info().Str("deviceId", device.DeviceId).Msg("Skipping device without output channels.")
+// Returns the main entity of a function block of the device with the names of
+// the channels it uses, or the reason why there is none.
+func (c *DeviceModule) functionBlockEntity(device *digitalstrom.Device, settings config.DeviceSettings, topicName string, functionBlock digitalstrom.FunctionBlock, channels []channel, suffix string) (*homeassistant.DiscoveryConfig, []string, string) {
+	properties := functionBlock.Properties()
+	classified := c.classifyFunctionBlock(functionBlock, settings)
+	if classified.domain == homeassistant.Light {
+		// The brightness, or the first output when none has the type.
+		var lightChannel *channel
+		var temperatureChannel *channel
+		for _, ch := range channels {
+			if ch.functionBlock.FunctionBlockId != functionBlock.FunctionBlockId {
 				continue
 			}
-			lightOutput := outputs[0]
-
-			entityConfig := &homeassistant.LightConfig{
-				BaseConfig: homeassistant.BaseConfig{
-					Device: homeassistant.Device{
-						Identifiers: []string{
-							device.DeviceId,
-						},
-						Model: functionBlock.Attributes.TechnicalName,
-						Name:  device.Attributes.Name,
+			switch {
+			case ch.output.Attributes.Type == digitalstrom.OutputTypeLightTemperature:
+				temperatureChannel = &ch
+			case lightChannel == nil || ch.output.Attributes.Type == digitalstrom.OutputTypeLightBrightness:
+				lightChannel = &ch
+			}
+		}
+		if lightChannel == nil {
+			log.Info().Str("deviceId", device.DeviceId).Msg("Skipping device without output channels.")
+			return nil, nil, "light without output channels"
+		}
+		used := []string{lightChannel.name}
+		if settings.ReadOnly {
+			cfg := c.readOnlyConfig(device, functionBlock, settings, topicName, *lightChannel, "light"+suffix)
+			return &cfg, used, ""
+		}
+
+		// Values published when fully on or off.
+		minValue, maxValue, _ := c.scalingOf(settings, lightChannel.output).publishedRange()
+		fullValue := fmt.Sprintf("%.2f", maxValue)
+		offValue := fmt.Sprintf("%.2f", minValue)
+
+		entityConfig := &homeassistant.LightConfig{
+			BaseConfig: homeassistant.BaseConfig{
+				Device: homeassistant.Device{
+					Identifiers: []string{
+						device.DeviceId,
 					},
-					Name:     "light",
-					UniqueId: device.DeviceId + "_light",
+					Model: functionBlock.Attributes.TechnicalName,
+					Name:  device.Attributes.Name,
 				},
-				CommandTopic: c.mqttClient.GetFullTopic(
-					c.deviceCommandTopic(device.Attributes.Name, lightOutput.OutputId)),
-				StateTopic: c.mqttClient.GetFullTopic(
-					c.deviceStateTopic(device.Attributes.Name, lightOutput.OutputId)),
-				PayloadOn:  "100.00",
-				PayloadOff: "0.00",
-			}
-			if properties.Dimmable {
-				entityConfig.OnCommandType = "brightness"
-				entityConfig.BrightnessScale = 100
-				entityConfig.BrightnessStateTopic = c.mqttClient.GetFullTopic(
-					c.deviceStateTopic(device.Attributes.Name, lightOutput.OutputId))
-				entityConfig.BrightnessCommandTopic = c.mqttClient.GetFullTopic(
-					c.deviceCommandTopic(device.Attributes.Name, lightOutput.OutputId))
-				entityConfig.StateValueTemplate = "{% if value|int > 0 %}100.00{% else %}0.00{% endif %}"
-			}
-			cfg = homeassistant.DiscoveryConfig{
-				Domain:   homeassistant.Light,
-				DeviceId: device.DeviceId,
-				ObjectId: "light",
-				Config:   entityConfig,
+				Name:     "light" + suffix,
+				UniqueId: device.DeviceId + "_light" + suffix,
+			},
+			CommandTopic: c.mqttClient.GetFullTopic(
+				c.deviceCommandTopic(topicName, lightChannel.name)),
+			StateTopic: c.mqttClient.GetFullTopic(
+				c.deviceStateTopic(topicName, lightChannel.name)),
+			PayloadOn:  fullValue,
+			PayloadOff: offValue,
+		}
+		if properties.Dimmable {
+			entityConfig.OnCommandType = "brightness"
+			entityConfig.BrightnessScale = int(math.Round(maxValue))
+			entityConfig.BrightnessStateTopic = c.mqttClient.GetFullTopic(
+				c.deviceStateTopic(topicName, lightChannel.name))
+			entityConfig.BrightnessCommandTopic = c.mqttClient.GetFullTopic(
+				c.deviceCommandTopic(topicName, lightChannel.name))
+			entityConfig.StateValueTemplate = "{% if value|float > " + offValue + " %}" + fullValue + "{% else %}" + offValue + "{% endif %}"
+		}
+		if temperatureChannel != nil {
+			used = append(used, temperatureChannel.name)
+			sc := c.scalingOf(settings, temperatureChannel.output)
+			minTemperature, maxTemperature, _ := sc.publishedRange()
+			entityConfig.ColorTempStateTopic = c.mqttClient.GetFullTopic(
+				c.deviceStateTopic(topicName, temperatureChannel.name))
+			entityConfig.ColorTempCommandTopic = c.mqttClient.GetFullTopic(
+				c.deviceCommandTopic(topicName, temperatureChannel.name))
+			entityConfig.ColorTempKelvin = sc.kelvin
+			// The defaults of Home Assistant are used without range.
+			if sc.kelvin && sc.ranged {
+				entityConfig.MinKelvin = int(math.Round(minTemperature))
+				entityConfig.MaxKelvin = int(math.Round(maxTemperature))
+			} else if sc.ranged {
+				entityConfig.MinMireds = int(math.Round(minTemperature))
+				entityConfig.MaxMireds = int(math.Round(maxTemperature))
 			}
-			configs = append(configs, cfg)
-		} else if deviceType == digitalstrom.DeviceTypeBlind {
-			entityConfig := &homeassistant.CoverConfig{
-				BaseConfig: homeassistant.BaseConfig{
-					Device: homeassistant.Device{
-						Identifiers: []string{
-							device.DeviceId,
-						},
-						Model: functionBlock.Attributes.TechnicalName,
-						Name:  device.Attributes.Name,
+		}
+		return &homeassistant.DiscoveryConfig{
+			Domain:   homeassistant.Light,
+			DeviceId: device.DeviceId,
+			ObjectId: "light" + suffix,
+			Config:   entityConfig,
+		}, used, ""
+	} else if classified.domain == homeassistant.Cover {
+		position, ok := channelOfOutput(channels, functionBlock.FunctionBlockId, properties.PositionChannel)
+		if !ok {
+			return nil, nil, fmt.Sprintf("%s without position output", classified.deviceType)
+		}
+		used := []string{position.name}
+		if settings.ReadOnly {
+			cfg := c.readOnlyConfig(device, functionBlock, settings, topicName, position, "cover"+suffix)
+			return &cfg, used, ""
+		}
+		// Values published when fully open or closed.
+		minValue, maxValue, _ := c.scalingOf(settings, position.output).publishedRange()
+		fullValue := fmt.Sprintf("%.2f", maxValue)
+		closedValue := fmt.Sprintf("%.2f", minValue)
+		entityConfig := &homeassistant.CoverConfig{
+			BaseConfig: homeassistant.BaseConfig{
+				Device: homeassistant.Device{
+					Identifiers: []string{
+						device.DeviceId,
 					},
-					Name:     "cover",
-					UniqueId: device.DeviceId + "_cover",
+					Model: functionBlock.Attributes.TechnicalName,
+					Name:  device.Attributes.Name,
 				},
-				CommandTopic: c.mqttClient.GetFullTopic(
-					c.deviceCommandTopic(device.Attributes.Name, properties.PositionChannel)),
-				PayloadOpen:  "100.00",
-				PayloadClose: "0.00",
-				PayloadStop:  "STOP",
-				StateTopic: c.mqttClient.GetFullTopic(
-					c.deviceStateTopic(device.Attributes.Name, properties.PositionChannel)),
-				StateOpen:        "100.00",
-				StateClosed:      "0.00",
-				PositionTopic:    c.mqttClient.GetFullTopic(c.deviceStateTopic(device.Attributes.Name, properties.PositionChannel)),
-				SetPositionTopic: c.mqttClient.GetFullTopic(c.deviceCommandTopic(device.Attributes.Name, properties.PositionChannel)),
-				PositionTemplate: "{{ value | int }}",
+				Name:     "cover" + suffix,
+				UniqueId: device.DeviceId + "_cover" + suffix,
+			},
+			CommandTopic: c.mqttClient.GetFullTopic(
+				c.deviceCommandTopic(topicName, position.name)),
+			DeviceClass:  classified.deviceClass,
+			PayloadOpen:  fullValue,
+			PayloadClose: closedValue,
+			PayloadStop:  "STOP",
+			StateTopic: c.mqttClient.GetFullTopic(
+				c.deviceStateTopic(topicName, position.name)),
+			StateOpen:        fullValue,
+			StateClosed:      closedValue,
+			PositionTopic:    c.mqttClient.GetFullTopic(c.deviceStateTopic(topicName, position.name)),
+			SetPositionTopic: c.mqttClient.GetFullTopic(c.deviceCommandTopic(topicName, position.name)),
+			PositionTemplate: "{{ value | int }}",
+		}
+		// The defaults of Home Assistant are 0 and 100.
+		if maxValue != 100 {
+			entityConfig.PositionOpen = int(math.Round(maxValue))
+		}
+		entityConfig.PositionClosed = int(math.Round(minValue))
+		if tilt, ok := channelOfOutput(channels, functionBlock.FunctionBlockId, properties.TiltChannel); ok {
+			used = append(used, tilt.name)
+			minTilt, maxTilt, _ := c.scalingOf(settings, tilt.output).publishedRange()
+			entityConfig.TiltStatusTemplate = "{{ value | int }}"
+			if maxTilt != 100 {
+				entityConfig.TiltMax = int(math.Round(maxTilt))
 			}
-			if properties.TiltChannel != "" {
-				entityConfig.TiltStatusTemplate = "{{ value | int }}"
-				entityConfig.TiltStatusTopic = c.mqttClient.GetFullTopic(
-					c.deviceStateTopic(device.Attributes.Name, properties.TiltChannel))
-				entityConfig.TiltCommandTopic = c.mqttClient.GetFullTopic(
-					c.deviceCommandTopic(device.Attributes.Name, properties.TiltChannel))
+			entityConfig.TiltMin = int(math.Round(minTilt))
+			entityConfig.TiltStatusTopic = c.mqttClient.GetFullTopic(
+				c.deviceStateTopic(topicName, tilt.name))
+			entityConfig.TiltCommandTopic = c.mqttClient.GetFullTopic(
+				c.deviceCommandTopic(topicName, tilt.name))
+		}
+		return &homeassistant.DiscoveryConfig{
+			Domain:   homeassistant.Cover,
+			DeviceId: device.DeviceId,
+			ObjectId: "cover" + suffix,
+			Config:   entityConfig,
+		}, used, ""
+	} else if classified.domain == homeassistant.Fan {
+		var intensity, power *channel
+		for _, ch := range channels {
+			if ch.functionBlock.FunctionBlockId != functionBlock.FunctionBlockId {
+				continue
 			}
-			cfg = homeassistant.DiscoveryConfig{
-				Domain:   homeassistant.Cover,
-				DeviceId: device.DeviceId,
-				ObjectId: "cover",
-				Config:   entityConfig,
+			switch ch.output.Attributes.Type {
+			case digitalstrom.OutputTypeAirFlowIntensity:
+				intensity = &ch
+			case digitalstrom.OutputTypePowerState:
+				power = &ch
 			}
-			configs = append(configs, cfg)
 		}
+		if intensity == nil {
+			return nil, nil, fmt.Sprintf("%s without air flow intensity output", classified.deviceType)
+		}
+		if settings.ReadOnly {
+			cfg := c.readOnlyConfig(device, functionBlock, settings, topicName, *intensity, "fan"+suffix)
+			return &cfg, []string{intensity.name}, ""
+		}
+		cfg := c.fanConfig(device, functionBlock, settings, topicName, *intensity, power, "fan"+suffix)
+		used := []string{intensity.name}
+		if power != nil {
+			used = append(used, power.name)
+		}
+		return &cfg, used, ""
 	}
-	return configs, nil
+	return nil, nil, fmt.Sprintf("unsupported device type '%s' (technical name '%s')", classified.deviceType, functionBlock.Attributes.TechnicalName)
+}
+
+// Returns the config of a sensor reporting the value of an output, for the
+// devices not accepting any command.
+func (c *DeviceModule) readOnlyConfig(device *digitalstrom.Device, functionBlock digitalstrom.FunctionBlock, settings config.DeviceSettings, topicName string, ch channel, objectId string) homeassistant.DiscoveryConfig {
+	entityConfig := &homeassistant.SensorConfig{
+		BaseConfig: homeassistant.BaseConfig{
+			Device: homeassistant.Device{
+				Identifiers: []string{
+					device.DeviceId,
+				},
+				Model: functionBlock.Attributes.TechnicalName,
+				Name:  device.Attributes.Name,
+			},
+			Name:     objectId,
+			UniqueId: device.DeviceId + "_" + objectId,
+		},
+		// The device class of the override is the one of the cover or light
+		// announced otherwise, which does not apply to a sensor.
+		StateTopic: c.mqttClient.GetFullTopic(c.deviceStateTopic(topicName, ch.name)),
+		StateClass: "measurement",
+	}
+	if sc := c.scalingOf(settings, ch.output); sc.kelvin {
+		entityConfig.UnitOfMeasurement = "K"
+	} else if sc.scale == 1 {
+		entityConfig.UnitOfMeasurement = "%"
+	}
+	return homeassistant.DiscoveryConfig{
+		Domain:   homeassistant.Sensor,
+		DeviceId: device.DeviceId,
+		ObjectId: objectId,
+		Config:   entityConfig,
+	}
+}
+
+func (c *DeviceModule) GetSkippedDevices() []SkippedDevice {
+	return c.skipped.list()
 }
 
 func normalizeForTopicName(item string) string {
@@ -333,14 +1016,21 @@ func normalizeForTopicName(item string) string {
 }
 
 func NewDeviceModule(mqttClient mqtt.Client, dsClient digitalstrom.Client, dsRegistry digitalstrom.Registry, config *config.Config) Module {
-	return &DeviceModule{
-		mqttClient:           mqttClient,
-		dsClient:             dsClient,
-		dsRegistry:           dsRegistry,
-		normalizeDeviceName:  config.Mqtt.NormalizeDeviceName,
-		refreshAtStart:       config.RefreshAtStart,
-		invertBlindsPosition: config.InvertBlindsPosition,
+	module := &DeviceModule{
+		mqttClient:          mqttClient,
+		dsClient:            dsClient,
+		dsRegistry:          dsRegistry,
+		normalizeDeviceName: config.Mqtt.NormalizeDeviceName,
+		refreshAtStart:      config.RefreshAtStart,
+		overrides:           config.Overrides,
+		stateMode:           config.CommandStateMode,
+		confirmTimeout:      time.Duration(config.CommandConfirmTimeout) * time.Second,
+		commandTopics:       map[string][]string{},
+		skipped:             skippedDevices{module: "devices"},
 	}
+	module.invertBlindsPosition.Store(config.InvertBlindsPosition)
+	module.dispatcher = newCommandDispatcher(config.CommandWorkers, float64(config.CommandRateLimit), module.executeCommand, module.onCommandSuperseded)
+	return module
 }
 
 func init() {
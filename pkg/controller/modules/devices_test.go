@@ -0,0 +1,371 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	mqtt_base "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/homeassistant"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/mqtt"
+	"github.com/stretchr/testify/assert"
+)
+
+// Registry of the devices given, the other methods are not implemented.
+type fakeRegistry struct {
+	digitalstrom.Registry
+	devices        []digitalstrom.Device
+	functionBlocks map[string][]digitalstrom.FunctionBlock
+	deviceTypes    map[string]digitalstrom.DeviceType
+	states         map[string][]digitalstrom.DeviceState
+	submodules     map[string][]digitalstrom.SubmoduleStatus
+	// Values by function block.
+	outputValues map[string][]digitalstrom.OutputValue
+	// Returned by GetDevices when set.
+	err error
+}
+
+func (r *fakeRegistry) GetDevices() ([]digitalstrom.Device, error) {
+	return r.devices, r.err
+}
+
+func (r *fakeRegistry) GetDevice(deviceId string) (digitalstrom.Device, error) {
+	for _, device := range r.devices {
+		if device.DeviceId == deviceId {
+			return device, nil
+		}
+	}
+	return digitalstrom.Device{}, errors.New("No device found with id " + deviceId)
+}
+
+func (r *fakeRegistry) GetFunctionBlocksOfDevice(deviceId string) ([]digitalstrom.FunctionBlock, error) {
+	return r.functionBlocks[deviceId], nil
+}
+
+func (r *fakeRegistry) GetOutputValuesOfFunctionBlock(deviceId string, functionBlockId string) ([]digitalstrom.OutputValue, error) {
+	return r.outputValues[functionBlockId], nil
+}
+
+func (r *fakeRegistry) GetStatesOfDevice(deviceId string) ([]digitalstrom.DeviceState, error) {
+	return r.states[deviceId], nil
+}
+
+func (r *fakeRegistry) GetSubmoduleStatusOfDevice(deviceId string) ([]digitalstrom.SubmoduleStatus, error) {
+	return r.submodules[deviceId], nil
+}
+
+func (r *fakeRegistry) GetZone(zoneId string) (digitalstrom.Zone, error) {
+	return digitalstrom.Zone{}, errors.New("No zone found with id " + zoneId)
+}
+
+func (r *fakeRegistry) GetSubmoduleOfFunctionBlock(functionBlock digitalstrom.FunctionBlock) (digitalstrom.Submodule, error) {
+	return digitalstrom.Submodule{}, errors.New("No submodule found for function block " + functionBlock.FunctionBlockId)
+}
+
+func (r *fakeRegistry) GetDeviceType(functionBlock digitalstrom.FunctionBlock) digitalstrom.DeviceType {
+	return r.deviceTypes[functionBlock.FunctionBlockId]
+}
+
+// Client recording the output values set.
+type fakeDsClient struct {
+	digitalstrom.Client
+	targets map[string][]digitalstrom.OutputTarget
+}
+
+func (c *fakeDsClient) DeviceSetOutputValues(deviceId string, targets []digitalstrom.OutputTarget) error {
+	c.targets[deviceId] = targets
+	return nil
+}
+
+// MQTT client recording the last message published per topic, the full
+// topics being prefixed by "digitalstrom".
+type fakeMqttClient struct {
+	mqtt.Client
+	published  map[string]string
+	subscribed map[string]bool
+}
+
+func (c *fakeMqttClient) Subscribe(topic string, messageHandler mqtt_base.MessageHandler) error {
+	c.subscribed[topic] = true
+	return nil
+}
+
+func (c *fakeMqttClient) Unsubscribe(topic string) error {
+	delete(c.subscribed, topic)
+	return nil
+}
+
+func (c *fakeMqttClient) Publish(topic string, message interface{}) error {
+	c.published[topic] = fmt.Sprintf("%s", message)
+	return nil
+}
+
+func (c *fakeMqttClient) GetFullTopic(topic string) string {
+	return "digitalstrom/" + topic
+}
+
+// Returns a module with a dimmer, the given overrides applying to it.
+func newTestDeviceModule(overrides config.Overrides) (*DeviceModule, *fakeDsClient, *fakeMqttClient) {
+	registry := &fakeRegistry{
+		devices: []digitalstrom.Device{
+			{DeviceId: "dev1", Attributes: digitalstrom.DeviceAttributes{Name: "Kitchen light", Dsid: "302ed89f43f00e4000000001", Zone: "1"}},
+		},
+		functionBlocks: map[string][]digitalstrom.FunctionBlock{
+			"dev1": {{
+				FunctionBlockId: "fb1",
+				Attributes: digitalstrom.FunctionBlockAttributes{
+					TechnicalName: "GE-KM200",
+					Outputs: []digitalstrom.Output{{
+						OutputId:   "brightness",
+						Attributes: digitalstrom.OutputAttributes{Type: digitalstrom.OutputTypeLightBrightness, Min: 0, Max: 100},
+					}},
+				},
+			}},
+		},
+		deviceTypes: map[string]digitalstrom.DeviceType{"fb1": digitalstrom.DeviceTypeLight},
+	}
+	dsClient := &fakeDsClient{targets: map[string][]digitalstrom.OutputTarget{}}
+	mqttClient := &fakeMqttClient{published: map[string]string{}, subscribed: map[string]bool{}}
+	module := NewDeviceModule(mqttClient, dsClient, registry, &config.Config{
+		Overrides:        overrides,
+		CommandStateMode: stateModeOptimistic,
+		CommandWorkers:   1,
+	}).(*DeviceModule)
+	return module, dsClient, mqttClient
+}
+
+func deviceOverride(override config.Override) config.Overrides {
+	return config.Overrides{Devices: []config.DeviceOverride{{Name: "Kitchen light", Override: override}}}
+}
+
+func brightnessCommand(value float64) commandPayload {
+	return commandPayload{Value: &value}
+}
+
+func TestDeviceModuleFollowsTheStructureChanges(t *testing.T) {
+	module, _, mqttClient := newTestDeviceModule(config.Overrides{})
+	registry := module.dsRegistry.(*fakeRegistry)
+
+	module.handleEvent(digitalstrom.DeviceAdded{Device: registry.devices[0]})
+	assert.Equal(t, map[string]bool{
+		"devices/Kitchen light/command":            true,
+		"devices/Kitchen light/brightness/command": true,
+	}, mqttClient.subscribed)
+
+	registry.devices[0].Attributes.Name = "Dining light"
+	module.handleEvent(digitalstrom.DeviceRenamed{DeviceId: "dev1", OldName: "Kitchen light", NewName: "Dining light"})
+	assert.Equal(t, map[string]bool{
+		"devices/Dining light/command":            true,
+		"devices/Dining light/brightness/command": true,
+	}, mqttClient.subscribed)
+	assert.Contains(t, mqttClient.published, "devices/Dining light/brightness/state")
+
+	module.handleEvent(digitalstrom.DeviceRemoved{Device: registry.devices[0]})
+	assert.Empty(t, mqttClient.subscribed)
+}
+
+func TestDeviceModule(t *testing.T) {
+	module, dsClient, mqttClient := newTestDeviceModule(config.Overrides{})
+
+	entities, err := module.GetHomeAssistantEntities()
+	assert.NoError(t, err)
+	assert.Len(t, entities, 1)
+	assert.Equal(t, homeassistant.Light, entities[0].Domain)
+
+	_, err = module.setOutputValues("dev1", "brightness", brightnessCommand(40))
+	assert.NoError(t, err)
+	assert.Equal(t, 40.0, dsClient.targets["dev1"][0].Value)
+	assert.Equal(t, "40.00", mqttClient.published["devices/Kitchen light/brightness/state"])
+}
+
+func TestDeviceModuleStartFailsWithoutDevices(t *testing.T) {
+	module, _, _ := newTestDeviceModule(config.Overrides{})
+	err := errors.New("structure not loaded")
+	module.dsRegistry.(*fakeRegistry).err = err
+
+	assert.ErrorIs(t, module.Start(), err)
+	module.dispatcher.stop()
+}
+
+func TestDeviceModuleReadOnly(t *testing.T) {
+	readOnly := true
+	module, dsClient, _ := newTestDeviceModule(deviceOverride(config.Override{ReadOnly: &readOnly, DeviceClass: "shutter"}))
+
+	entities, err := module.GetHomeAssistantEntities()
+	assert.NoError(t, err)
+	assert.Len(t, entities, 1)
+	assert.Equal(t, homeassistant.Sensor, entities[0].Domain)
+	// The device class of the light does not apply to the sensor.
+	assert.Empty(t, entities[0].Config.(*homeassistant.SensorConfig).DeviceClass)
+
+	topics, err := module.GetDeviceTopics()
+	assert.NoError(t, err)
+	for _, topic := range topics {
+		assert.NotEqual(t, mqtt.Command, topic.Kind)
+	}
+
+	_, err = module.setOutputValues("dev1", "brightness", brightnessCommand(40))
+	assert.Equal(t, resultReadOnly, newCommandResult("brightness", brightnessCommand(40), err).Code)
+	assert.Empty(t, dsClient.targets)
+}
+
+func TestDeviceModuleExclude(t *testing.T) {
+	exclude := true
+	module, dsClient, mqttClient := newTestDeviceModule(deviceOverride(config.Override{Exclude: &exclude}))
+
+	entities, err := module.GetHomeAssistantEntities()
+	assert.NoError(t, err)
+	assert.Empty(t, entities)
+	assert.Len(t, module.GetSkippedDevices(), 1)
+
+	topics, err := module.GetDeviceTopics()
+	assert.NoError(t, err)
+	assert.Empty(t, topics)
+
+	assert.NoError(t, module.updateDevice("dev1"))
+	assert.Empty(t, mqttClient.published)
+
+	_, err = module.setOutputValues("dev1", "brightness", brightnessCommand(40))
+	assert.Equal(t, resultReadOnly, newCommandResult("brightness", brightnessCommand(40), err).Code)
+	assert.Empty(t, dsClient.targets)
+}
+
+func TestDeviceModuleScale(t *testing.T) {
+	scale := 2.55
+	module, dsClient, mqttClient := newTestDeviceModule(deviceOverride(config.Override{Scale: &scale}))
+
+	_, err := module.setOutputValues("dev1", "brightness", brightnessCommand(255))
+	assert.NoError(t, err)
+	assert.InDelta(t, 100.0, dsClient.targets["dev1"][0].Value, 0.001)
+	assert.Equal(t, "255.00", mqttClient.published["devices/Kitchen light/brightness/state"])
+
+	// The range is scaled too.
+	_, err = module.setOutputValues("dev1", "brightness", brightnessCommand(300))
+	assert.Equal(t, resultOutOfRange, newCommandResult("brightness", brightnessCommand(300), err).Code)
+}
+
+func TestDeviceModuleTopicName(t *testing.T) {
+	module, _, mqttClient := newTestDeviceModule(deviceOverride(config.Override{TopicName: "kitchen"}))
+
+	topics, err := module.GetDeviceTopics()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, topics)
+	for _, topic := range topics {
+		assert.Contains(t, topic.Topic, "digitalstrom/devices/kitchen/")
+	}
+
+	entities, err := module.GetHomeAssistantEntities()
+	assert.NoError(t, err)
+	assert.Len(t, entities, 1)
+	light := entities[0].Config.(*homeassistant.LightConfig)
+	assert.Equal(t, "digitalstrom/devices/kitchen/brightness/state", light.StateTopic)
+	assert.Equal(t, "digitalstrom/devices/kitchen/brightness/command", light.CommandTopic)
+
+	_, err = module.setOutputValues("dev1", "brightness", brightnessCommand(40))
+	assert.NoError(t, err)
+	assert.Equal(t, "40.00", mqttClient.published["devices/kitchen/brightness/state"])
+}
+
+func TestDeviceModuleRecordsTheConfirmation(t *testing.T) {
+	module, _, mqttClient := newTestDeviceModule(config.Overrides{})
+	module.stateMode = stateModeConfirm
+	module.confirmTimeout = 50 * time.Millisecond
+
+	result := make(chan CommandResult, 1)
+	module.executeCommand(queuedCommand{
+		deviceId: "dev1",
+		outputId: "brightness",
+		payload:  `{"value": 40, "correlationId": "abc"}`,
+		received: time.Now(),
+		result:   result,
+	})
+	// Recorded once the dSS reported the change or the timeout expired.
+	assert.Empty(t, module.GetCommandHistory())
+
+	commandResult := <-result
+	assert.Equal(t, resultTimeout, commandResult.Code)
+	assert.Equal(t, "abc", commandResult.CorrelationId)
+	history := module.GetCommandHistory()
+	assert.Len(t, history, 1)
+	assert.NotEmpty(t, history[0].Error)
+	assert.Contains(t, mqttClient.published["devices/Kitchen light/result"], `"correlationId":"abc"`)
+}
+
+func TestDeviceModuleSeveralFunctionBlocks(t *testing.T) {
+	module, _, _ := newTestDeviceModule(config.Overrides{})
+	registry := module.dsRegistry.(*fakeRegistry)
+	second := registry.functionBlocks["dev1"][0]
+	second.FunctionBlockId = "fb2"
+	registry.deviceTypes["fb2"] = digitalstrom.DeviceTypeLight
+
+	objectIds := func() map[string]string {
+		entities, err := module.GetHomeAssistantEntities()
+		assert.NoError(t, err)
+		result := map[string]string{}
+		for _, entity := range entities {
+			result[entity.ObjectId] = entity.Config.(*homeassistant.LightConfig).StateTopic
+		}
+		return result
+	}
+	expected := map[string]string{
+		"light_fb1": "digitalstrom/devices/Kitchen light/fb1/brightness/state",
+		"light_fb2": "digitalstrom/devices/Kitchen light/fb2/brightness/state",
+	}
+	registry.functionBlocks["dev1"] = append(registry.functionBlocks["dev1"], second)
+	assert.Equal(t, expected, objectIds())
+
+	// Same entities and topics when the function blocks are listed in
+	// another order.
+	functionBlocks := registry.functionBlocks["dev1"]
+	registry.functionBlocks["dev1"] = []digitalstrom.FunctionBlock{functionBlocks[1], functionBlocks[0]}
+	assert.Equal(t, expected, objectIds())
+}
+
+// The commands of the API go through the same checks as the ones of MQTT.
+func TestDeviceModuleSetOutputValue(t *testing.T) {
+	module, dsClient, _ := newTestDeviceModule(config.Overrides{})
+	module.dispatcher.start()
+	defer module.dispatcher.stop()
+
+	result, err := module.SetOutputValue(context.Background(), "dev1", "", "brightness", 150)
+	assert.NoError(t, err)
+	assert.Equal(t, resultOutOfRange, result.Code)
+	assert.Empty(t, dsClient.targets)
+
+	result, err = module.SetOutputValue(context.Background(), "dev1", "", "brightness", 40)
+	assert.NoError(t, err)
+	assert.Equal(t, resultOk, result.Code)
+	assert.Equal(t, 40.0, dsClient.targets["dev1"][0].Value)
+}
+
+// The dSS reports no change when the output already has the value, which is
+// rounded by the dSS.
+func TestDeviceModuleConfirmsTheValueAlreadySet(t *testing.T) {
+	scale := 2.55
+	module, dsClient, _ := newTestDeviceModule(deviceOverride(config.Override{Scale: &scale}))
+	module.stateMode = stateModeConfirm
+	module.confirmTimeout = time.Second
+	module.dsRegistry.(*fakeRegistry).outputValues = map[string][]digitalstrom.OutputValue{
+		"fb1": {{OutputId: "brightness", TargetValue: 50}},
+	}
+
+	result := make(chan CommandResult, 1)
+	module.executeCommand(queuedCommand{
+		deviceId: "dev1",
+		outputId: "brightness",
+		payload:  "128",
+		received: time.Now(),
+		result:   result,
+	})
+	select {
+	case commandResult := <-result:
+		assert.Equal(t, resultOk, commandResult.Code)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("command not confirmed")
+	}
+	assert.InDelta(t, 50.196, dsClient.targets["dev1"][0].Value, 0.001)
+}
@@ -0,0 +1,194 @@
+package modules
+
+import (
+	"sync"
+	"time"
+)
+
+// Command received from MQTT or the API, waiting to be executed.
+type queuedCommand struct {
+	deviceId string
+	outputId string
+	payload  string
+	received time.Time
+	// Receives the result of the command when not nil, e.g. for the API.
+	result chan<- CommandResult
+}
+
+// Sends the result to the one waiting for it, if any.
+func (q queuedCommand) reply(result CommandResult) {
+	if q.result != nil {
+		q.result <- result
+	}
+}
+
+// Parses the payload of the command, the commands of a whole device having
+// no output id.
+func (q queuedCommand) parse() (commandPayload, error) {
+	if q.outputId == "" {
+		return parseDeviceCommand(q.payload)
+	}
+	return parseCommand(q.payload)
+}
+
+// Commands of a device waiting to be executed, at most one per output.
+type deviceQueue struct {
+	// Outputs in the order of their first pending command.
+	outputs  []string
+	commands map[string]queuedCommand
+	// Whether the device is waiting for a worker or being processed.
+	scheduled bool
+}
+
+// commandDispatcher executes the commands towards the dSS. The commands of a
+// device are executed one after the other, while several devices are
+// processed in parallel by a bounded pool of workers. A command waiting for
+// an output replaces the previous one (the latest value wins), and the
+// requests to the dSS are rate limited globally.
+type commandDispatcher struct {
+	execute func(command queuedCommand)
+	// Called for the commands replaced by a newer one before being executed.
+	superseded func(command queuedCommand)
+	workers    int
+	// Minimum delay between two requests, no limit when 0.
+	interval time.Duration
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	queues   map[string]*deviceQueue
+	ready    []string
+	nextSlot time.Time
+	stopped  bool
+	wg       sync.WaitGroup
+}
+
+// Creates a dispatcher with the given number of workers and the maximum
+// number of requests per second, unlimited when 0.
+func newCommandDispatcher(workers int, rateLimit float64, execute func(queuedCommand), superseded func(queuedCommand)) *commandDispatcher {
+	d := &commandDispatcher{
+		execute:    execute,
+		superseded: superseded,
+		workers:    max(workers, 1),
+		queues:     map[string]*deviceQueue{},
+	}
+	if rateLimit > 0 {
+		d.interval = time.Duration(float64(time.Second) / rateLimit)
+	}
+	d.cond = sync.NewCond(&d.mutex)
+	return d
+}
+
+func (d *commandDispatcher) start() {
+	d.mutex.Lock()
+	d.stopped = false
+	d.mutex.Unlock()
+	for i := 0; i < d.workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+}
+
+// Stops the workers once the commands being executed are done. The pending
+// commands are dropped.
+func (d *commandDispatcher) stop() {
+	d.mutex.Lock()
+	d.stopped = true
+	d.queues = map[string]*deviceQueue{}
+	d.ready = nil
+	d.cond.Broadcast()
+	d.mutex.Unlock()
+	d.wg.Wait()
+}
+
+// Queues a command, replacing the one waiting for the same output. Never
+// blocks.
+func (d *commandDispatcher) enqueue(command queuedCommand) {
+	d.mutex.Lock()
+	queue, ok := d.queues[command.deviceId]
+	if !ok {
+		queue = &deviceQueue{commands: map[string]queuedCommand{}}
+		d.queues[command.deviceId] = queue
+	}
+	previous, replaced := queue.commands[command.outputId]
+	if !replaced {
+		queue.outputs = append(queue.outputs, command.outputId)
+	}
+	queue.commands[command.outputId] = command
+	if !queue.scheduled {
+		queue.scheduled = true
+		d.ready = append(d.ready, command.deviceId)
+		d.cond.Signal()
+	}
+	d.mutex.Unlock()
+
+	if replaced && d.superseded != nil {
+		d.superseded(previous)
+	}
+}
+
+func (d *commandDispatcher) work() {
+	defer d.wg.Done()
+	for {
+		command, ok := d.next()
+		if !ok {
+			return
+		}
+		d.waitForSlot()
+		d.execute(command)
+		d.done(command.deviceId)
+	}
+}
+
+// Returns the next command to execute, taken from the first device waiting
+// for a worker. Returns false when stopped.
+func (d *commandDispatcher) next() (queuedCommand, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for len(d.ready) == 0 && !d.stopped {
+		d.cond.Wait()
+	}
+	if d.stopped {
+		return queuedCommand{}, false
+	}
+	deviceId := d.ready[0]
+	d.ready = d.ready[1:]
+	queue := d.queues[deviceId]
+	outputId := queue.outputs[0]
+	queue.outputs = queue.outputs[1:]
+	command := queue.commands[outputId]
+	delete(queue.commands, outputId)
+	return command, true
+}
+
+// Schedules the device again if commands were received while executing the
+// previous one, the device staying assigned to a single worker at a time.
+func (d *commandDispatcher) done(deviceId string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	queue, ok := d.queues[deviceId]
+	if !ok {
+		return
+	}
+	if len(queue.outputs) == 0 {
+		delete(d.queues, deviceId)
+		return
+	}
+	d.ready = append(d.ready, deviceId)
+	d.cond.Signal()
+}
+
+// Waits until a request can be sent to the dSS according to the rate limit.
+func (d *commandDispatcher) waitForSlot() {
+	if d.interval == 0 {
+		return
+	}
+	d.mutex.Lock()
+	now := time.Now()
+	slot := d.nextSlot
+	if slot.Before(now) {
+		slot = now
+	}
+	d.nextSlot = slot.Add(d.interval)
+	d.mutex.Unlock()
+	time.Sleep(slot.Sub(now))
+}
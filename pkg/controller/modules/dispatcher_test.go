@@ -0,0 +1,48 @@
+package modules
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcherCoalescesCommands(t *testing.T) {
+	var mutex sync.Mutex
+	executed := []string{}
+	superseded := []string{}
+	// Blocks the first command until the others are queued.
+	started := make(chan struct{})
+	block := make(chan struct{})
+	dispatcher := newCommandDispatcher(2, 0, func(command queuedCommand) {
+		if command.payload == "first" {
+			close(started)
+			<-block
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		executed = append(executed, command.deviceId+"/"+command.outputId+"="+command.payload)
+	}, func(command queuedCommand) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		superseded = append(superseded, command.payload)
+	})
+
+	dispatcher.start()
+	dispatcher.enqueue(queuedCommand{deviceId: "a", outputId: "brightness", payload: "first"})
+	<-started
+	dispatcher.enqueue(queuedCommand{deviceId: "a", outputId: "brightness", payload: "10"})
+	dispatcher.enqueue(queuedCommand{deviceId: "a", outputId: "shadePositionOutside", payload: "5"})
+	dispatcher.enqueue(queuedCommand{deviceId: "a", outputId: "brightness", payload: "20"})
+	close(block)
+	assert.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(executed) == 3
+	}, time.Second, time.Millisecond)
+	dispatcher.stop()
+
+	assert.Equal(t, []string{"a/brightness=first", "a/brightness=20", "a/shadePositionOutside=5"}, executed)
+	assert.Equal(t, []string{"10"}, superseded)
+}
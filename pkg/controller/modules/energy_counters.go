@@ -0,0 +1,164 @@
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	energyCountersSaveInterval = 1 * time.Minute
+	dayFormat                  = "2006-01-02"
+	monthFormat                = "2006-01"
+)
+
+// Cumulative energy counter for a single metering. The counter keeps growing
+// even when the raw counter of the dSS goes back to zero (e.g. after a dSM
+// restart) and tracks the consumption of the current day and month.
+type energyCounter struct {
+	// Last raw value received from the dSS.
+	LastRaw float64 `json:"lastRaw"`
+	// Cumulative value, in the same unit as the raw value.
+	Total float64 `json:"total"`
+	// Value of Total at the beginning of the current day.
+	DayStart float64 `json:"dayStart"`
+	Day      string  `json:"day"`
+	// Value of Total at the beginning of the current month.
+	MonthStart float64 `json:"monthStart"`
+	Month      string  `json:"month"`
+}
+
+// Returns the consumption since the beginning of the current day.
+func (c *energyCounter) Daily() float64 {
+	return c.Total - c.DayStart
+}
+
+// Returns the consumption since the beginning of the current month.
+func (c *energyCounter) Monthly() float64 {
+	return c.Total - c.MonthStart
+}
+
+// Set of energy counters, optionally persisted in a local JSON file so they
+// survive restarts of the bridge.
+type energyCounters struct {
+	file     string
+	counters map[string]*energyCounter
+	dirty    bool
+	lastSave time.Time
+}
+
+// Creates the energy counters and loads the previous state from the given
+// file. An empty file name disables the persistence.
+func newEnergyCounters(file string) *energyCounters {
+	c := &energyCounters{
+		file:     file,
+		counters: map[string]*energyCounter{},
+	}
+	if file == "" {
+		return c
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Info().Str("file", file).Msg("No energy counters state found, starting from scratch.")
+		return c
+	}
+	if err != nil {
+		log.Error().Err(err).Str("file", file).Msg("Unable to read energy counters state.")
+		return c
+	}
+	if err := json.Unmarshal(data, &c.counters); err != nil {
+		log.Error().Err(err).Str("file", file).Msg("Unable to parse energy counters state.")
+		c.counters = map[string]*energyCounter{}
+	}
+	return c
+}
+
+// Updates the counter of the given metering with a new raw value read from
+// the dSS and returns a copy of the updated counter.
+func (c *energyCounters) update(meteringId string, raw float64, now time.Time) energyCounter {
+	day := now.Format(dayFormat)
+	month := now.Format(monthFormat)
+
+	counter, ok := c.counters[meteringId]
+	if !ok {
+		counter = &energyCounter{
+			LastRaw:    raw,
+			Total:      raw,
+			DayStart:   raw,
+			Day:        day,
+			MonthStart: raw,
+			Month:      month,
+		}
+		c.counters[meteringId] = counter
+		c.dirty = true
+		return *counter
+	}
+
+	delta := raw - counter.LastRaw
+	if delta < 0 {
+		// The raw counter went backwards, the dSS restarted counting from
+		// zero.
+		log.Info().
+			Str("meteringId", meteringId).
+			Float64("lastRaw", counter.LastRaw).
+			Float64("raw", raw).
+			Msg("Energy counter reset detected.")
+		delta = raw
+	}
+	if counter.Day != day {
+		counter.Day = day
+		counter.DayStart = counter.Total
+	}
+	if counter.Month != month {
+		counter.Month = month
+		counter.MonthStart = counter.Total
+	}
+	counter.Total += delta
+	counter.LastRaw = raw
+	c.dirty = true
+	return *counter
+}
+
+// Writes the counters to the state file if they changed and the last write
+// is older than the save interval, or unconditionally when forced.
+func (c *energyCounters) save(now time.Time, force bool) error {
+	if c.file == "" || !c.dirty {
+		return nil
+	}
+	if !force && now.Sub(c.lastSave) < energyCountersSaveInterval {
+		return nil
+	}
+	data, err := json.MarshalIndent(c.counters, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializing energy counters: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.file), 0755); err != nil {
+		return fmt.Errorf("error creating energy counters directory: %w", err)
+	}
+	// Write to a temporary file first so a crash never leaves a truncated
+	// state behind.
+	tmp, err := os.CreateTemp(filepath.Dir(c.file), filepath.Base(c.file)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating energy counters file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing energy counters file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing energy counters file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.file); err != nil {
+		return fmt.Errorf("error writing energy counters file: %w", err)
+	}
+	c.dirty = false
+	c.lastSave = now
+	return nil
+}
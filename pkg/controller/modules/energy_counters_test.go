@@ -0,0 +1,62 @@
+package modules
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnergyCountersSurviveResets(t *testing.T) {
+	counters := newEnergyCounters("")
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+
+	counter := counters.update("m1", 1000, now)
+	assert.Equal(t, 1000.0, counter.Total)
+	assert.Equal(t, 0.0, counter.Daily())
+
+	counter = counters.update("m1", 1500, now.Add(time.Minute))
+	assert.Equal(t, 1500.0, counter.Total)
+	assert.Equal(t, 500.0, counter.Daily())
+
+	// The dSS restarted and counts from zero again.
+	counter = counters.update("m1", 200, now.Add(2*time.Minute))
+	assert.Equal(t, 1700.0, counter.Total)
+	assert.Equal(t, 700.0, counter.Daily())
+	assert.Equal(t, 700.0, counter.Monthly())
+}
+
+func TestEnergyCountersDailyAndMonthlyDeltas(t *testing.T) {
+	counters := newEnergyCounters("")
+	now := time.Date(2024, 3, 31, 23, 59, 0, 0, time.Local)
+
+	counters.update("m1", 100, now)
+	counters.update("m1", 300, now.Add(30*time.Second))
+
+	// Next day, which is also a new month.
+	counter := counters.update("m1", 350, now.Add(2*time.Minute))
+	assert.Equal(t, 350.0, counter.Total)
+	assert.Equal(t, 50.0, counter.Daily())
+	assert.Equal(t, 50.0, counter.Monthly())
+
+	// Next day in the same month.
+	counter = counters.update("m1", 400, now.Add(24*time.Hour+2*time.Minute))
+	assert.Equal(t, 50.0, counter.Daily())
+	assert.Equal(t, 100.0, counter.Monthly())
+}
+
+func TestEnergyCountersArePersisted(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+
+	counters := newEnergyCounters(file)
+	counters.update("m1", 1000, now)
+	counters.update("m1", 0, now.Add(time.Minute))
+	assert.NoError(t, counters.save(now, true))
+
+	restored := newEnergyCounters(file)
+	counter := restored.update("m1", 10, now.Add(2*time.Minute))
+	assert.Equal(t, 1010.0, counter.Total)
+	assert.Equal(t, 10.0, counter.Daily())
+}
@@ -0,0 +1,71 @@
+package modules
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of commands kept in the history.
+const commandHistorySize = 50
+
+// CommandRecord describes a command received from MQTT and its result.
+type CommandRecord struct {
+	Time     time.Time     `json:"time"`
+	DeviceId string        `json:"deviceId"`
+	Device   string        `json:"device"`
+	OutputId string        `json:"outputId"`
+	Payload  string        `json:"payload"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Topic describes an MQTT topic used for an output of a device.
+type Topic struct {
+	DeviceId string `json:"deviceId"`
+	// Empty for the topics of the device, e.g. the result topic. Prefixed by
+	// the id of the function block for the devices having several outputs
+	// with the same id.
+	OutputId        string `json:"outputId"`
+	FunctionBlockId string `json:"functionBlockId,omitempty"`
+	// Either "state", "command" or "result".
+	Kind  string `json:"kind"`
+	Topic string `json:"topic"`
+}
+
+// CommandHistoryProvider is implemented by the modules keeping track of the
+// commands they received.
+type CommandHistoryProvider interface {
+	// Returns the last commands, the most recent first.
+	GetCommandHistory() []CommandRecord
+}
+
+// TopicProvider is implemented by the modules publishing or subscribing to
+// topics for the devices.
+type TopicProvider interface {
+	GetDeviceTopics() ([]Topic, error)
+}
+
+// Fixed size history of the last commands.
+type commandHistory struct {
+	records []CommandRecord
+	mutex   sync.Mutex
+}
+
+func (h *commandHistory) add(record CommandRecord) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.records = append(h.records, record)
+	if len(h.records) > commandHistorySize {
+		h.records = h.records[len(h.records)-commandHistorySize:]
+	}
+}
+
+func (h *commandHistory) list() []CommandRecord {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	records := make([]CommandRecord, 0, len(h.records))
+	for i := len(h.records) - 1; i >= 0; i-- {
+		records = append(records, h.records[i])
+	}
+	return records
+}
@@ -0,0 +1,60 @@
+package modules
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+)
+
+type publishedValue struct {
+	value float64
+	time  time.Time
+}
+
+// Filter deciding whether a metering value must be published, based on the
+// last published value of the same topic. A value is published when it went
+// through the deadband of its unit or when nothing was published for longer
+// than the maximum silence interval.
+type meteringFilter struct {
+	mutex      sync.Mutex
+	deadbands  map[string]config.Deadband
+	maxSilence time.Duration
+	last       map[string]publishedValue
+}
+
+func newMeteringFilter(deadbands map[string]config.Deadband, maxSilence time.Duration) *meteringFilter {
+	return &meteringFilter{
+		deadbands:  deadbands,
+		maxSilence: maxSilence,
+		last:       map[string]publishedValue{},
+	}
+}
+
+// Returns whether the value must be published on the given topic.
+func (f *meteringFilter) shouldPublish(topic string, unit string, value float64, now time.Time) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	last, ok := f.last[topic]
+	if !ok {
+		return true
+	}
+	if f.maxSilence > 0 && now.Sub(last.time) >= f.maxSilence {
+		return true
+	}
+	return f.deadbands[unit].Exceeded(last.value, value)
+}
+
+// Records that the value was published on the given topic.
+func (f *meteringFilter) published(topic string, value float64, now time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.last[topic] = publishedValue{value: value, time: now}
+}
+
+// Replaces the deadbands, e.g. when the config is reloaded.
+func (f *meteringFilter) setDeadbands(deadbands map[string]config.Deadband) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.deadbands = deadbands
+}
@@ -1,13 +1,19 @@
 package modules
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"path"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/health"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/homeassistant"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/metrics"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/mqtt"
 	"github.com/rs/zerolog/log"
 )
@@ -16,20 +22,172 @@ const (
 	meterings        string = "meterings"
 	powerConsumption string = "consumptionW"
 	energyMeter      string = "energyWh"
+	apartment        string = "apartment"
+
+	// Suffixes of the measurements derived from the cumulative energy
+	// counters.
+	energyTotal   string = "Total"
+	energyDaily   string = "Daily"
+	energyMonthly string = "Monthly"
 )
 
+// Describes how a metering unit reported by the dSS is published to MQTT and
+// announced to Home Assistant.
+type meteringUnit struct {
+	// Name of the measurement in the MQTT topic.
+	measurement string
+	// Object id used for the Home Assistant discovery.
+	objectId string
+	// Prefix of the Home Assistant entity name.
+	name              string
+	deviceClass       string
+	stateClass        string
+	unitOfMeasurement string
+	valueTemplate     string
+	icon              string
+	// Whether the metering is an ever increasing energy counter, for which a
+	// cumulative counter and daily and monthly deltas are published.
+	energy bool
+}
+
+// Units known to be reported by the dSS meterings.
+var meteringUnits = map[string]meteringUnit{
+	"W": {
+		measurement:       powerConsumption,
+		objectId:          "power",
+		name:              "Power",
+		deviceClass:       "power",
+		stateClass:        "measurement",
+		unitOfMeasurement: "W",
+		icon:              "mdi:flash",
+	},
+	"kW": {
+		measurement:       "consumptionKW",
+		objectId:          "power_kw",
+		name:              "Power",
+		deviceClass:       "power",
+		stateClass:        "measurement",
+		unitOfMeasurement: "kW",
+		icon:              "mdi:flash",
+	},
+	"Wh": {
+		measurement:       energyMeter,
+		objectId:          "energy",
+		name:              "Energy",
+		deviceClass:       "energy",
+		stateClass:        "total_increasing",
+		unitOfMeasurement: "kWh",
+		valueTemplate:     "{{ (value | float / (3600*1000)) | round(3) }}",
+		icon:              "mdi:lightning-bolt",
+		energy:            true,
+	},
+	"Ws": {
+		measurement:       "energyWs",
+		objectId:          "energy_ws",
+		name:              "Energy",
+		deviceClass:       "energy",
+		stateClass:        "total_increasing",
+		unitOfMeasurement: "kWh",
+		valueTemplate:     "{{ (value | float / (3600*1000)) | round(3) }}",
+		icon:              "mdi:lightning-bolt",
+		energy:            true,
+	},
+	"kWh": {
+		measurement:       "energyKWh",
+		objectId:          "energy_kwh",
+		name:              "Energy",
+		deviceClass:       "energy",
+		stateClass:        "total_increasing",
+		unitOfMeasurement: "kWh",
+		icon:              "mdi:lightning-bolt",
+		energy:            true,
+	},
+	"VA": {
+		measurement:       "apparentPowerVA",
+		objectId:          "apparent_power",
+		name:              "Apparent power",
+		deviceClass:       "apparent_power",
+		stateClass:        "measurement",
+		unitOfMeasurement: "VA",
+		icon:              "mdi:flash-outline",
+	},
+	"var": {
+		measurement:       "reactivePowerVar",
+		objectId:          "reactive_power",
+		name:              "Reactive power",
+		deviceClass:       "reactive_power",
+		stateClass:        "measurement",
+		unitOfMeasurement: "var",
+		icon:              "mdi:flash-outline",
+	},
+	"V": {
+		measurement:       "voltageV",
+		objectId:          "voltage",
+		name:              "Voltage",
+		deviceClass:       "voltage",
+		stateClass:        "measurement",
+		unitOfMeasurement: "V",
+		icon:              "mdi:sine-wave",
+	},
+	"A": {
+		measurement:       "currentA",
+		objectId:          "current",
+		name:              "Current",
+		deviceClass:       "current",
+		stateClass:        "measurement",
+		unitOfMeasurement: "A",
+		icon:              "mdi:current-ac",
+	},
+	"Hz": {
+		measurement:       "frequencyHz",
+		objectId:          "frequency",
+		name:              "Frequency",
+		deviceClass:       "frequency",
+		stateClass:        "measurement",
+		unitOfMeasurement: "Hz",
+		icon:              "mdi:sine-wave",
+	},
+}
+
+// Returns the description of the given unit. Units not known in advance are
+// still published, under a measurement named after the unit itself.
+func getMeteringUnit(unit string) meteringUnit {
+	if u, ok := meteringUnits[unit]; ok {
+		return u
+	}
+	name := normalizeForTopicName(unit)
+	if name == "" {
+		name = "unknown"
+	}
+	return meteringUnit{
+		measurement:       "value" + name,
+		objectId:          "value_" + name,
+		name:              "Value",
+		stateClass:        "measurement",
+		unitOfMeasurement: unit,
+	}
+}
+
 // Meterings Module encapsulates all the logic regarding the meterings of the controllers. The logic
 // is the following: every 10 seconds the meterings values are being checked and
-// pushed to the corresponding topic in the MQTT server.
+// pushed to the corresponding topic in the MQTT server. Energy meterings are
+// additionally accumulated into counters surviving the resets of the dSS,
+// from which the daily and monthly consumption is derived.
 type MeteringsModule struct {
 	mqttClient mqtt.Client
 	dsClient   digitalstrom.Client
 	dsRegistry digitalstrom.Registry
 
 	enabled         bool
-	intervalSeconds int
+	intervalSeconds atomic.Int64
+	stateFile       string
 	ticker          *time.Ticker
 	tickerDone      chan struct{}
+	energyCounters  *energyCounters
+	filter          *meteringFilter
+	startTime       time.Time
+	lastSuccess     atomic.Int64
+	skipped         skippedDevices
 }
 
 func (c *MeteringsModule) Start() error {
@@ -38,9 +196,10 @@ func (c *MeteringsModule) Start() error {
 		return nil
 	}
 	log.Debug().
-		Int("intervalSeconds", c.intervalSeconds).
+		Int64("intervalSeconds", c.intervalSeconds.Load()).
 		Msg("Meterings module enabled.")
-	c.ticker = time.NewTicker(time.Duration(c.intervalSeconds) * time.Second)
+	c.energyCounters = newEnergyCounters(c.stateFile)
+	c.ticker = time.NewTicker(c.interval())
 	c.tickerDone = make(chan struct{})
 
 	go func() {
@@ -63,6 +222,22 @@ func (c *MeteringsModule) Stop() error {
 	c.ticker.Stop()
 	c.tickerDone <- struct{}{}
 	c.ticker = nil
+	if err := c.energyCounters.save(time.Now(), true); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *MeteringsModule) interval() time.Duration {
+	return time.Duration(c.intervalSeconds.Load()) * time.Second
+}
+
+// Reload applies the polling interval and the deadbands.
+func (c *MeteringsModule) Reload(config *config.Config) error {
+	c.filter.setDeadbands(config.MeteringsDeadbands)
+	if c.intervalSeconds.Swap(int64(config.MeteringsInterval)) != int64(config.MeteringsInterval) && c.ticker != nil {
+		c.ticker.Reset(c.interval())
+	}
 	return nil
 }
 
@@ -80,51 +255,118 @@ func (c *MeteringsModule) updateMeteringValues() {
 		return
 	}
 
+	c.lastSuccess.Store(time.Now().UnixNano())
+	c.dsRegistry.UpdateMeteringValues(meteringStatus.Values)
+
 	meteringStatusLookup := make(map[string]digitalstrom.MeteringValue)
 	for _, value := range meteringStatus.Values {
 		meteringStatusLookup[value.Id] = value
 	}
 
+	now := time.Now()
 	for _, metering := range meterings {
+		itemName, err := c.meteringItemName(metering)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("controllerId", metering.Attributes.Origin.MeteringOriginId).
+				Str("meteringId", metering.MeteringId).
+				Msg("No controller found for metering ")
+			continue
+		}
 
-		var itemName string
+		meteringValue, ok := meteringStatusLookup[metering.MeteringId]
+		if !ok {
+			log.Debug().Str("meteringId", metering.MeteringId).Msg("No value for metering")
+			continue
+		}
+		unit := getMeteringUnit(metering.Attributes.Unit)
+		if _, known := meteringUnits[metering.Attributes.Unit]; !known {
+			log.Debug().Str("unit", metering.Attributes.Unit).Msg("Unknown unit, publishing raw value")
+		}
 
-		if metering.Attributes.Origin.Type == digitalstrom.MeteringTypeController {
-			controller, err := c.dsRegistry.GetControllerById(metering.Attributes.Origin.MeteringOriginId)
-			if err != nil {
+		if metrics.ValuesExported() {
+			metrics.MeteringValue.
+				WithLabelValues(itemName, metering.Attributes.Unit).
+				Set(meteringValue.Attributes.Value)
+		}
+
+		values := map[string]float64{
+			unit.measurement: meteringValue.Attributes.Value,
+		}
+		if unit.energy {
+			counter := c.energyCounters.update(metering.MeteringId, meteringValue.Attributes.Value, now)
+			values[unit.measurement+energyTotal] = counter.Total
+			values[unit.measurement+energyDaily] = counter.Daily()
+			values[unit.measurement+energyMonthly] = counter.Monthly()
+		}
+
+		for measurement, value := range values {
+			topic := meteringTopic(itemName, measurement)
+			if !c.filter.shouldPublish(topic, metering.Attributes.Unit, value, now) {
+				continue
+			}
+			valueStr := formatMeteringValue(value)
+			if err := c.mqttClient.Publish(topic, valueStr); err != nil {
 				log.Error().
 					Err(err).
-					Str("controllerId", metering.Attributes.Origin.MeteringOriginId).
-					Str("meteringId", metering.MeteringId).
-					Msg("No controller found for metering ")
+					Str("itemName", itemName).
+					Str("unit", metering.Attributes.Unit).
+					Msg("Error updating metering")
 				continue
 			}
-			itemName = controller.Attributes.Name
-		} else {
-			// apartment
-			itemName = "apartment"
+			c.filter.published(topic, value, now)
 		}
+	}
 
-		meteringValue := meteringStatusLookup[metering.MeteringId]
+	if err := c.energyCounters.save(now, false); err != nil {
+		log.Error().Err(err).Msg("Error saving energy counters")
+	}
+}
 
-		var measurement = ""
-		if metering.Attributes.Unit == "W" {
-			measurement = powerConsumption
-		} else if metering.Attributes.Unit == "Wh" {
-			measurement = energyMeter
-		} else {
-			log.Warn().Str("unit", metering.Attributes.Unit).Msg("Unknown unit")
+// Returns the name under which the values of the metering are published,
+// which is the name of its controller or "apartment".
+func (c *MeteringsModule) meteringItemName(metering digitalstrom.Metering) (string, error) {
+	if metering.Attributes.Origin.Type == digitalstrom.MeteringTypeController {
+		controller, err := c.dsRegistry.GetControllerById(metering.Attributes.Origin.MeteringOriginId)
+		if err != nil {
+			return "", err
 		}
+		return controller.Attributes.Name, nil
+	}
+	return apartment, nil
+}
 
-		valueStr := fmt.Sprintf("%.0f", meteringValue.Attributes.Value)
-		if err := c.mqttClient.Publish(meteringTopic(itemName, measurement), valueStr); err != nil {
-			log.Error().
-				Err(err).
-				Str("itemName", itemName).
-				Str("unit", metering.Attributes.Unit).
-				Msg("Error updating metering")
-			continue
-		}
+// Formats a metering value without decimals for whole numbers, and with the
+// precision required otherwise (e.g. for kWh or A).
+func formatMeteringValue(value float64) string {
+	if value == math.Trunc(value) || math.Abs(value) >= 1000 {
+		return fmt.Sprintf("%.0f", value)
+	}
+	return strconv.FormatFloat(value, 'f', 3, 64)
+}
+
+func (c *MeteringsModule) HealthChecks() []health.Check {
+	if !c.enabled {
+		return nil
+	}
+	return []health.Check{
+		{
+			Name:   "meterings",
+			Probes: health.Readiness,
+			Check: func(ctx context.Context) error {
+				// Tolerate a few failed polls before reporting an error.
+				maxAge := 3 * c.interval()
+				last := c.startTime
+				if lastSuccess := c.lastSuccess.Load(); lastSuccess != 0 {
+					last = time.Unix(0, lastSuccess)
+				}
+				if age := time.Since(last); age > maxAge {
+					return fmt.Errorf("meterings not polled successfully for %s", age.Round(time.Second))
+				}
+				return nil
+			},
+		},
 	}
 }
 
@@ -134,83 +376,102 @@ func meteringTopic(itemName string, measurement string) string {
 
 func (c *MeteringsModule) GetHomeAssistantEntities() ([]homeassistant.DiscoveryConfig, error) {
 	configs := []homeassistant.DiscoveryConfig{}
+	c.skipped.reset()
 	if !c.enabled {
 		return configs, nil
 	}
 
-	controllers, err := c.dsRegistry.GetControllers()
+	meterings, err := c.dsRegistry.GetMeterings()
 	if err != nil {
 		return nil, err
 	}
 
-	// manually add apartment
-	controllers = append(controllers, digitalstrom.Controller{
-		ControllerId: "apartment",
-		Attributes: digitalstrom.ControllerAttributes{
-			Name:     "apartment",
-			TechName: "apartment",
-		},
-	})
-
-	for _, controller := range controllers {
-		powerConfig := homeassistant.DiscoveryConfig{
-			Domain:   homeassistant.Sensor,
-			DeviceId: controller.ControllerId,
-			ObjectId: "power",
-			Config: &homeassistant.SensorConfig{
-				BaseConfig: homeassistant.BaseConfig{
-					Device: homeassistant.Device{
-						Identifiers: []string{controller.ControllerId},
-						Model:       controller.Attributes.TechName,
-						Name:        controller.Attributes.Name,
-					},
-					Name:     "Power " + controller.Attributes.Name,
-					UniqueId: controller.ControllerId + "_power",
-				},
-				StateTopic: c.mqttClient.GetFullTopic(
-					meteringTopic(controller.Attributes.Name, powerConsumption)),
-				UnitOfMeasurement: "W",
-				DeviceClass:       "power",
-				Icon:              "mdi:flash",
-			},
+	for _, metering := range meterings {
+		device := homeassistant.Device{
+			Identifiers: []string{apartment},
+			Model:       apartment,
+			Name:        apartment,
 		}
-		configs = append(configs, powerConfig)
-		energyConfig := homeassistant.DiscoveryConfig{
-			Domain:   homeassistant.Sensor,
-			DeviceId: controller.ControllerId,
-			ObjectId: "energy",
-			Config: &homeassistant.SensorConfig{
-				BaseConfig: homeassistant.BaseConfig{
-					Device: homeassistant.Device{
-						Identifiers: []string{controller.ControllerId},
-						Model:       controller.Attributes.TechName,
-						Name:        controller.Attributes.Name,
-					},
-					Name:     "Energy " + controller.Attributes.Name,
-					UniqueId: controller.ControllerId + "_energy",
-				},
-				StateTopic: c.mqttClient.GetFullTopic(
-					meteringTopic(controller.Attributes.Name, energyMeter)),
-				UnitOfMeasurement: "kWh",
-				DeviceClass:       "energy",
-				StateClass:        "total_increasing",
-				ValueTemplate:     "{{ (value | float / (3600*1000)) | round(3) }}",
-				Icon:              "mdi:lightning-bolt",
-			},
+		deviceId := apartment
+		if metering.Attributes.Origin.Type == digitalstrom.MeteringTypeController {
+			controller, err := c.dsRegistry.GetControllerById(metering.Attributes.Origin.MeteringOriginId)
+			if err != nil {
+				log.Warn().
+					Str("meteringId", metering.MeteringId).
+					Msg("Skipping metering without controller.")
+				c.skipped.add(metering.MeteringId, metering.Attributes.TechnicalName,
+					fmt.Sprintf("unknown controller '%s'", metering.Attributes.Origin.MeteringOriginId))
+				continue
+			}
+			deviceId = controller.ControllerId
+			device = homeassistant.Device{
+				Identifiers: []string{controller.ControllerId},
+				Model:       controller.Attributes.TechName,
+				Name:        controller.Attributes.Name,
+			}
+		}
+
+		unit := getMeteringUnit(metering.Attributes.Unit)
+		configs = append(configs, c.meteringSensorConfig(deviceId, device, unit, "", "", unit.stateClass))
+		if unit.energy {
+			configs = append(configs,
+				c.meteringSensorConfig(deviceId, device, unit, energyTotal, "total", "total_increasing"),
+				c.meteringSensorConfig(deviceId, device, unit, energyDaily, "daily", "total_increasing"),
+				c.meteringSensorConfig(deviceId, device, unit, energyMonthly, "monthly", "total_increasing"))
 		}
-		configs = append(configs, energyConfig)
 	}
 	return configs, nil
 }
 
+func (c *MeteringsModule) GetSkippedDevices() []SkippedDevice {
+	return c.skipped.list()
+}
+
+// Builds the Home Assistant sensor for a measurement of a metering. The
+// suffix selects one of the values derived from the energy counters.
+func (c *MeteringsModule) meteringSensorConfig(deviceId string, device homeassistant.Device, unit meteringUnit, suffix string, label string, stateClass string) homeassistant.DiscoveryConfig {
+	objectId := unit.objectId
+	name := unit.name + " " + device.Name
+	if label != "" {
+		objectId = objectId + "_" + label
+		name = unit.name + " " + label + " " + device.Name
+	}
+	return homeassistant.DiscoveryConfig{
+		Domain:   homeassistant.Sensor,
+		DeviceId: deviceId,
+		ObjectId: objectId,
+		Config: &homeassistant.SensorConfig{
+			BaseConfig: homeassistant.BaseConfig{
+				Device:   device,
+				Name:     name,
+				UniqueId: deviceId + "_" + objectId,
+			},
+			StateTopic: c.mqttClient.GetFullTopic(
+				meteringTopic(device.Name, unit.measurement+suffix)),
+			UnitOfMeasurement: unit.unitOfMeasurement,
+			DeviceClass:       unit.deviceClass,
+			StateClass:        stateClass,
+			ValueTemplate:     unit.valueTemplate,
+			Icon:              unit.icon,
+		},
+	}
+}
+
 func NewMeteringsModule(mqttClient mqtt.Client, dsClient digitalstrom.Client, dsRegistry digitalstrom.Registry, config *config.Config) Module {
-	return &MeteringsModule{
-		mqttClient:      mqttClient,
-		dsClient:        dsClient,
-		dsRegistry:      dsRegistry,
-		enabled:         config.MeteringsEnabled,
-		intervalSeconds: config.MeteringsInterval,
+	module := &MeteringsModule{
+		mqttClient: mqttClient,
+		dsClient:   dsClient,
+		dsRegistry: dsRegistry,
+		enabled:    config.MeteringsEnabled,
+		stateFile:  config.MeteringsStateFile,
+		startTime:  time.Now(),
+		skipped:    skippedDevices{module: "meterings"},
+		filter: newMeteringFilter(
+			config.MeteringsDeadbands,
+			time.Duration(config.PublishMaxSilence)*time.Second),
 	}
+	module.intervalSeconds.Store(int64(config.MeteringsInterval))
+	return module
 }
 
 func init() {
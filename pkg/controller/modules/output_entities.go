@@ -0,0 +1,202 @@
+package modules
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/homeassistant"
+)
+
+// selectOption is an option of a select entity with its value in the dSS.
+type selectOption struct {
+	name  string
+	value float64
+}
+
+// Options of the outputs announced as select entities, the other switched
+// outputs being either off or on.
+var selectOptions = map[digitalstrom.OutputType][]selectOption{
+	digitalstrom.OutputTypeAirFlowDirection:         {{"both", 0}, {"in", 1}, {"out", 2}},
+	digitalstrom.OutputTypeVentilationSwingMode:     {{"off", 0}, {"horizontal", 1}, {"vertical", 2}, {"both", 3}},
+	digitalstrom.OutputTypeVentilationAutoIntensity: {{"off", 0}, {"on", 1}},
+	digitalstrom.OutputTypePowerState:               {{"off", 0}, {"on", 1}, {"forced off", 2}, {"standby", 3}},
+}
+
+// Unit and device class of the outputs announced as number entities not
+// reporting percentages.
+var numberUnits = map[digitalstrom.OutputType][2]string{
+	digitalstrom.OutputTypeWaterTemperature: {"°C", "temperature"},
+}
+
+// Returns the options in the range of the output, e.g. the power states of a
+// device supporting only on and off. All the options are kept when the range
+// is unknown.
+func optionsInRange(sc scaling, options []selectOption) []selectOption {
+	if !sc.ranged {
+		return options
+	}
+	result := []selectOption{}
+	for _, option := range options {
+		if option.value >= sc.min && option.value <= sc.max {
+			result = append(result, option)
+		}
+	}
+	return result
+}
+
+// Returns the templates converting the values published into the options of a
+// select entity and the options into the commands.
+func selectTemplates(sc scaling, options []selectOption) (string, string) {
+	values := []string{}
+	commands := []string{}
+	for _, option := range options {
+		// The values are published with two decimals.
+		published := sc.toPublished(option.value)
+		values = append(values, fmt.Sprintf("'%.2f': '%s'", published, option.name))
+		commands = append(commands, fmt.Sprintf("'%s': %g", option.name, published))
+	}
+	return "{{ {" + strings.Join(values, ", ") + "}.get(value) }}",
+		"{{ {" + strings.Join(commands, ", ") + "}[value] }}"
+}
+
+// Returns the entities of the outputs of a function block which are not used
+// by its main entity, e.g. the heating power of a heating actuator or the
+// swing mode of a ventilation unit.
+func (c *DeviceModule) outputEntities(device *digitalstrom.Device, settings config.DeviceSettings, topicName string, functionBlock digitalstrom.FunctionBlock, channels []channel, used []string) []homeassistant.DiscoveryConfig {
+	configs := []homeassistant.DiscoveryConfig{}
+	for _, ch := range channels {
+		if ch.functionBlock.FunctionBlockId != functionBlock.FunctionBlockId {
+			continue
+		}
+		if mode := ch.output.Attributes.Mode; mode == digitalstrom.OutputModeDisabled || mode == digitalstrom.OutputModeInternal {
+			continue
+		}
+		isUsed := false
+		for _, name := range used {
+			isUsed = isUsed || name == ch.name
+		}
+		if isUsed {
+			continue
+		}
+
+		objectId := strings.ReplaceAll(ch.name, "/", "_")
+		if settings.ReadOnly {
+			configs = append(configs, c.readOnlyConfig(device, functionBlock, settings, topicName, ch, objectId))
+			continue
+		}
+		sc := c.scalingOf(settings, ch.output)
+		base := homeassistant.BaseConfig{
+			Device: homeassistant.Device{
+				Identifiers: []string{
+					device.DeviceId,
+				},
+				Model: functionBlock.Attributes.TechnicalName,
+				Name:  device.Attributes.Name,
+			},
+			Name:     ch.name,
+			UniqueId: device.DeviceId + "_" + objectId,
+		}
+		commandTopic := c.mqttClient.GetFullTopic(c.deviceCommandTopic(topicName, ch.name))
+		stateTopic := c.mqttClient.GetFullTopic(c.deviceStateTopic(topicName, ch.name))
+
+		options, isSelect := selectOptions[ch.output.Attributes.Type]
+		if isSelect {
+			options = optionsInRange(sc, options)
+		} else if ch.output.Attributes.Mode == digitalstrom.OutputModeSwitched {
+			options, isSelect = []selectOption{{"off", sc.min}, {"on", sc.max}}, true
+		}
+		if isSelect {
+			entityConfig := &homeassistant.SelectConfig{
+				BaseConfig:   base,
+				CommandTopic: commandTopic,
+				StateTopic:   stateTopic,
+			}
+			for _, option := range options {
+				entityConfig.Options = append(entityConfig.Options, option.name)
+			}
+			entityConfig.ValueTemplate, entityConfig.CommandTemplate = selectTemplates(sc, options)
+			configs = append(configs, homeassistant.DiscoveryConfig{
+				Domain:   homeassistant.Select,
+				DeviceId: device.DeviceId,
+				ObjectId: objectId,
+				Config:   entityConfig,
+			})
+			continue
+		}
+
+		min, max, step := sc.publishedRange()
+		entityConfig := &homeassistant.NumberConfig{
+			BaseConfig:   base,
+			CommandTopic: commandTopic,
+			StateTopic:   stateTopic,
+			Min:          min,
+			Max:          max,
+			Step:         step,
+			Mode:         "slider",
+		}
+		if unit, ok := numberUnits[ch.output.Attributes.Type]; ok {
+			entityConfig.UnitOfMeasurement = unit[0]
+			entityConfig.DeviceClass = unit[1]
+		} else if sc.kelvin {
+			entityConfig.UnitOfMeasurement = "K"
+		} else if min == 0 && max == 100 {
+			entityConfig.UnitOfMeasurement = "%"
+		}
+		configs = append(configs, homeassistant.DiscoveryConfig{
+			Domain:   homeassistant.Number,
+			DeviceId: device.DeviceId,
+			ObjectId: objectId,
+			Config:   entityConfig,
+		})
+	}
+	return configs
+}
+
+// Returns the fan entity of a ventilation unit, whose speed is the air flow
+// intensity. It is switched on and off by its power state when it has one,
+// by the intensity otherwise.
+func (c *DeviceModule) fanConfig(device *digitalstrom.Device, functionBlock digitalstrom.FunctionBlock, settings config.DeviceSettings, topicName string, intensity channel, power *channel, objectId string) homeassistant.DiscoveryConfig {
+	minIntensity, maxIntensity, _ := c.scalingOf(settings, intensity.output).publishedRange()
+	entityConfig := &homeassistant.FanConfig{
+		BaseConfig: homeassistant.BaseConfig{
+			Device: homeassistant.Device{
+				Identifiers: []string{
+					device.DeviceId,
+				},
+				Model: functionBlock.Attributes.TechnicalName,
+				Name:  device.Attributes.Name,
+			},
+			Name:     objectId,
+			UniqueId: device.DeviceId + "_" + objectId,
+		},
+		PercentageCommandTopic: c.mqttClient.GetFullTopic(c.deviceCommandTopic(topicName, intensity.name)),
+		PercentageStateTopic:   c.mqttClient.GetFullTopic(c.deviceStateTopic(topicName, intensity.name)),
+		SpeedRangeMin:          int(math.Max(1, math.Round(minIntensity))),
+		SpeedRangeMax:          int(math.Round(maxIntensity)),
+	}
+	switchChannel := intensity
+	onValue := fmt.Sprintf("%.2f", maxIntensity)
+	offValue := fmt.Sprintf("%.2f", minIntensity)
+	if power != nil {
+		sc := c.scalingOf(settings, power.output)
+		switchChannel = *power
+		onValue = fmt.Sprintf("%.2f", sc.toPublished(1))
+		offValue = fmt.Sprintf("%.2f", sc.toPublished(0))
+		entityConfig.StateValueTemplate = "{% if value == '" + onValue + "' %}" + onValue + "{% else %}" + offValue + "{% endif %}"
+	} else {
+		entityConfig.StateValueTemplate = "{% if value|float > " + offValue + " %}" + onValue + "{% else %}" + offValue + "{% endif %}"
+	}
+	entityConfig.CommandTopic = c.mqttClient.GetFullTopic(c.deviceCommandTopic(topicName, switchChannel.name))
+	entityConfig.StateTopic = c.mqttClient.GetFullTopic(c.deviceStateTopic(topicName, switchChannel.name))
+	entityConfig.PayloadOn = onValue
+	entityConfig.PayloadOff = offValue
+	return homeassistant.DiscoveryConfig{
+		Domain:   homeassistant.Fan,
+		DeviceId: device.DeviceId,
+		ObjectId: objectId,
+		Config:   entityConfig,
+	}
+}
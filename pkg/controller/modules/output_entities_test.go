@@ -0,0 +1,104 @@
+package modules
+
+import (
+	"testing"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/homeassistant"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectTemplates(t *testing.T) {
+	valueTemplate, commandTemplate := selectTemplates(scaling{scale: 1, min: 0, max: 2}, selectOptions[digitalstrom.OutputTypeAirFlowDirection])
+	assert.Equal(t, "{{ {'0.00': 'both', '1.00': 'in', '2.00': 'out'}.get(value) }}", valueTemplate)
+	assert.Equal(t, "{{ {'both': 0, 'in': 1, 'out': 2}[value] }}", commandTemplate)
+
+	// Switched outputs scaled to 0..1.
+	valueTemplate, commandTemplate = selectTemplates(scaling{scale: 0.01, min: 0, max: 100}, []selectOption{{"off", 0}, {"on", 100}})
+	assert.Equal(t, "{{ {'0.00': 'off', '1.00': 'on'}.get(value) }}", valueTemplate)
+	assert.Equal(t, "{{ {'off': 0, 'on': 1}[value] }}", commandTemplate)
+}
+
+func outputWithRange(outputId string, outputType digitalstrom.OutputType, min float64, max float64, resolution float64) digitalstrom.Output {
+	return digitalstrom.Output{OutputId: outputId, Attributes: digitalstrom.OutputAttributes{
+		Type: outputType, Mode: digitalstrom.OutputModeGradual, Min: min, Max: max, Resolution: resolution,
+	}}
+}
+
+func TestOutputEntities(t *testing.T) {
+	module, _, _ := newTestDeviceModule(config.Overrides{})
+	device := digitalstrom.Device{DeviceId: "dev1", Attributes: digitalstrom.DeviceAttributes{Name: "Heating"}}
+	functionBlock := digitalstrom.FunctionBlock{FunctionBlockId: "fb1"}
+	functionBlock.Attributes.Outputs = []digitalstrom.Output{
+		outputWithRange("heatingPower", digitalstrom.OutputTypeHeatingPower, 0, 100, 1),
+		outputWithRange("waterTemperature", digitalstrom.OutputTypeWaterTemperature, 10, 80, 0.5),
+		outputWithRange("powerState", digitalstrom.OutputTypePowerState, 0, 1, 1),
+	}
+	channels := channelsOf([]digitalstrom.FunctionBlock{functionBlock})
+
+	entities := module.outputEntities(&device, config.DeviceSettings{}, "Heating", functionBlock, channels, nil)
+	assert.Len(t, entities, 3)
+
+	power := entities[0].Config.(*homeassistant.NumberConfig)
+	assert.Equal(t, homeassistant.Number, entities[0].Domain)
+	assert.Equal(t, []float64{0, 100, 1}, []float64{power.Min, power.Max, power.Step})
+	assert.Equal(t, "%", power.UnitOfMeasurement)
+	assert.Equal(t, "digitalstrom/devices/Heating/heatingPower/command", power.CommandTopic)
+
+	temperature := entities[1].Config.(*homeassistant.NumberConfig)
+	assert.Equal(t, []float64{10, 80, 0.5}, []float64{temperature.Min, temperature.Max, temperature.Step})
+	assert.Equal(t, "°C", temperature.UnitOfMeasurement)
+	assert.Equal(t, "temperature", temperature.DeviceClass)
+
+	// Only the power states in the range of the output.
+	state := entities[2].Config.(*homeassistant.SelectConfig)
+	assert.Equal(t, homeassistant.Select, entities[2].Domain)
+	assert.Equal(t, []string{"off", "on"}, state.Options)
+	assert.Equal(t, "{{ {'off': 0, 'on': 1}[value] }}", state.CommandTemplate)
+
+	// The scale of the device applies to the range.
+	entities = module.outputEntities(&device, config.DeviceSettings{Scale: 2.55}, "Heating", functionBlock, channels, []string{"waterTemperature", "powerState"})
+	assert.Len(t, entities, 1)
+	power = entities[0].Config.(*homeassistant.NumberConfig)
+	assert.InDeltaSlice(t, []float64{0, 255, 2.55}, []float64{power.Min, power.Max, power.Step}, 1e-9)
+	assert.Empty(t, power.UnitOfMeasurement)
+}
+
+func TestOptionsInRange(t *testing.T) {
+	options := selectOptions[digitalstrom.OutputTypePowerState]
+	assert.Equal(t, options[:2], optionsInRange(scaling{ranged: true, min: 0, max: 1}, options))
+	assert.Equal(t, options, optionsInRange(scaling{ranged: true, min: 0, max: 3}, options))
+	// Range unknown.
+	assert.Equal(t, options, optionsInRange(scaling{min: 0, max: 100}, options))
+}
+
+func TestFanConfig(t *testing.T) {
+	module, _, _ := newTestDeviceModule(config.Overrides{})
+	device := digitalstrom.Device{DeviceId: "dev1", Attributes: digitalstrom.DeviceAttributes{Name: "Vent"}}
+	functionBlock := digitalstrom.FunctionBlock{FunctionBlockId: "fb1"}
+	functionBlock.Attributes.Outputs = []digitalstrom.Output{
+		outputWithRange("airFlowIntensity", digitalstrom.OutputTypeAirFlowIntensity, 0, 100, 1),
+		outputWithRange("powerState", digitalstrom.OutputTypePowerState, 0, 3, 1),
+	}
+	channels := channelsOf([]digitalstrom.FunctionBlock{functionBlock})
+
+	// Switched by the power state.
+	cfg := module.fanConfig(&device, functionBlock, config.DeviceSettings{}, "Vent", channels[0], &channels[1], "fan")
+	fan := cfg.Config.(*homeassistant.FanConfig)
+	assert.Equal(t, homeassistant.Fan, cfg.Domain)
+	assert.Equal(t, "digitalstrom/devices/Vent/powerState/command", fan.CommandTopic)
+	assert.Equal(t, "1.00", fan.PayloadOn)
+	assert.Equal(t, "0.00", fan.PayloadOff)
+	assert.Equal(t, "{% if value == '1.00' %}1.00{% else %}0.00{% endif %}", fan.StateValueTemplate)
+	assert.Equal(t, "digitalstrom/devices/Vent/airFlowIntensity/command", fan.PercentageCommandTopic)
+	assert.Equal(t, []int{1, 100}, []int{fan.SpeedRangeMin, fan.SpeedRangeMax})
+
+	// Switched by the intensity.
+	cfg = module.fanConfig(&device, functionBlock, config.DeviceSettings{}, "Vent", channels[0], nil, "fan")
+	fan = cfg.Config.(*homeassistant.FanConfig)
+	assert.Equal(t, "digitalstrom/devices/Vent/airFlowIntensity/command", fan.CommandTopic)
+	assert.Equal(t, "100.00", fan.PayloadOn)
+	assert.Equal(t, "0.00", fan.PayloadOff)
+	assert.Equal(t, "{% if value|float > 0.00 %}100.00{% else %}0.00{% endif %}", fan.StateValueTemplate)
+}
@@ -12,6 +12,13 @@ type Module interface {
 	Stop() error
 }
 
+// Reloadable is implemented by the modules able to apply a new config while
+// running. Only the settings which can be changed live are updated in the
+// given config, see config.Update.
+type Reloadable interface {
+	Reload(config *config.Config) error
+}
+
 type ModuleBuilder func(mqtt.Client, digitalstrom.Client, digitalstrom.Registry, *config.Config) Module
 
 // Register stores a builder function into the registry for external access.
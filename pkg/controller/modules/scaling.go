@@ -0,0 +1,126 @@
+package modules
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+)
+
+// scaling converts the values of an output between the dSS and MQTT, and
+// checks the commands against the range of the output.
+type scaling struct {
+	// Factor applied to the values published.
+	scale float64
+	// The values are published in Kelvin, the dSS using mireds.
+	kelvin bool
+	// The position of the blinds is inverted.
+	invert bool
+	// Range and resolution of the output in the dSS.
+	min        float64
+	max        float64
+	resolution float64
+	// Whether the dSS reported the range of the output. Otherwise 0..100 is
+	// used for the entities and the inversion, but the commands are not
+	// checked against it.
+	ranged bool
+}
+
+// Returns the scaling of an output of a device. The scale of the device, when
+// set, takes precedence over the one of the output type.
+func (c *DeviceModule) scalingOf(settings config.DeviceSettings, output digitalstrom.Output) scaling {
+	outputSettings := c.overrides.Output(string(output.Attributes.Type))
+	s := scaling{
+		scale:      1,
+		kelvin:     outputSettings.Kelvin,
+		invert:     settings.InvertBlindsPosition && strings.HasPrefix(strings.ToLower(output.OutputId), "shadeposition"),
+		min:        output.Attributes.Min,
+		max:        output.Attributes.Max,
+		resolution: output.Attributes.Resolution,
+		ranged:     output.Attributes.Max > output.Attributes.Min,
+	}
+	if settings.Scale != 0 {
+		s.scale = settings.Scale
+	} else if outputSettings.Scale != nil {
+		s.scale = *outputSettings.Scale
+	}
+	if !s.ranged {
+		// Most outputs are percentages.
+		s.min = 0
+		s.max = 100
+	}
+	return s
+}
+
+// Converts a value of the dSS into the value published.
+func (s scaling) toPublished(value float64) float64 {
+	if s.invert {
+		value = s.min + s.max - value
+	}
+	if s.kelvin {
+		if value <= 0 {
+			return 0
+		}
+		return math.Round(1e6 / value)
+	}
+	return value * s.scale
+}
+
+// Converts a value received as command into the value of the dSS.
+func (s scaling) fromCommand(value float64) float64 {
+	if s.kelvin {
+		value = 1e6 / value
+	} else {
+		value = value / s.scale
+	}
+	if s.invert {
+		value = s.min + s.max - value
+	}
+	return value
+}
+
+// Checks that the value of the dSS converted from a command is in the range
+// of the output, returning the value limited to the range to ignore the
+// rounding errors of the conversion. The value received is used in the
+// errors. Only the numbers are checked when the range is unknown, e.g. for the
+// color temperatures in mireds.
+func (s scaling) check(name string, received float64, value float64) (float64, error) {
+	if !s.ranged {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return 0, &commandError{code: resultOutOfRange, err: fmt.Errorf("value %g of output '%s' out of range", received, name)}
+		}
+		return value, nil
+	}
+	// Half the resolution is accepted, the value being rounded to it.
+	tolerance := 0.5
+	if s.resolution > 0 {
+		tolerance = s.resolution / 2
+	}
+	if math.IsNaN(value) || value < s.min-tolerance || value > s.max+tolerance {
+		publishedMin, publishedMax, _ := s.publishedRange()
+		return 0, &commandError{code: resultOutOfRange, err: fmt.Errorf("value %g of output '%s' out of range [%g, %g]", received, name, publishedMin, publishedMax)}
+	}
+	return math.Min(math.Max(value, s.min), s.max), nil
+}
+
+// Returns the range of the published values and the step between two values.
+func (s scaling) publishedRange() (float64, float64, float64) {
+	// Rounded to hide the errors of the scale, e.g. 100 * 2.55.
+	min := math.Round(s.toPublished(s.min)*1e6) / 1e6
+	max := math.Round(s.toPublished(s.max)*1e6) / 1e6
+	if min > max {
+		min, max = max, min
+	}
+	step := 1.0
+	if !s.kelvin {
+		resolution := s.resolution
+		if resolution <= 0 {
+			// Integer values.
+			resolution = 1
+		}
+		step = resolution * s.scale
+	}
+	return min, max, step
+}
@@ -0,0 +1,72 @@
+package modules
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScaling(t *testing.T) {
+	brightnessScale := 2.55
+	c := &DeviceModule{overrides: config.Overrides{Outputs: []config.OutputOverride{
+		{Type: string(digitalstrom.OutputTypeLightBrightness), Scale: &brightnessScale},
+		{Type: string(digitalstrom.OutputTypeLightTemperature), Kelvin: true},
+	}}}
+	brightness := digitalstrom.Output{OutputId: "brightness", Attributes: digitalstrom.OutputAttributes{
+		Type: digitalstrom.OutputTypeLightBrightness, Max: 100, Resolution: 0.1,
+	}}
+	temperature := digitalstrom.Output{OutputId: "colortemp", Attributes: digitalstrom.OutputAttributes{
+		Type: digitalstrom.OutputTypeLightTemperature, Min: 100, Max: 1000, Resolution: 1,
+	}}
+
+	// Scale of the output type.
+	sc := c.scalingOf(config.DeviceSettings{}, brightness)
+	assert.InDelta(t, 255.0, sc.toPublished(100), 1e-9)
+	value, err := sc.check("brightness", 255, sc.fromCommand(255))
+	assert.NoError(t, err)
+	assert.Equal(t, 100.0, value)
+	_, err = sc.check("brightness", 300, sc.fromCommand(300))
+	var commandErr *commandError
+	assert.True(t, errors.As(err, &commandErr))
+	assert.Equal(t, resultOutOfRange, commandErr.code)
+	assert.ErrorContains(t, err, "out of range [0, 255]")
+	min, max, step := sc.publishedRange()
+	assert.Equal(t, []float64{0, 255}, []float64{min, max})
+	assert.InDelta(t, 0.255, step, 1e-9)
+
+	// The scale of the device takes precedence.
+	sc = c.scalingOf(config.DeviceSettings{Scale: 0.01}, brightness)
+	assert.Equal(t, 0.5, sc.toPublished(50))
+
+	// Kelvin.
+	sc = c.scalingOf(config.DeviceSettings{}, temperature)
+	assert.Equal(t, 4000.0, sc.toPublished(250))
+	assert.Equal(t, 250.0, sc.fromCommand(4000))
+	min, max, _ = sc.publishedRange()
+	assert.Equal(t, []float64{1000, 10000}, []float64{min, max})
+	_, err = sc.check("colortemp", 0, sc.fromCommand(0))
+	assert.ErrorContains(t, err, "out of range")
+
+	// Range not reported by the dSS, e.g. for the color temperature in
+	// mireds: only the numbers are checked.
+	unranged := digitalstrom.Output{OutputId: "colortemp", Attributes: digitalstrom.OutputAttributes{
+		Type: digitalstrom.OutputTypeLightTemperature,
+	}}
+	sc = (&DeviceModule{}).scalingOf(config.DeviceSettings{}, unranged)
+	assert.False(t, sc.ranged)
+	value, err = sc.check("colortemp", 370, sc.fromCommand(370))
+	assert.NoError(t, err)
+	assert.Equal(t, 370.0, value)
+	sc = c.scalingOf(config.DeviceSettings{}, unranged)
+	_, err = sc.check("colortemp", 0, sc.fromCommand(0))
+	assert.ErrorContains(t, err, "out of range")
+
+	// Inverted position of the blinds.
+	position := digitalstrom.Output{OutputId: "shadePositionOutside"}
+	sc = c.scalingOf(config.DeviceSettings{InvertBlindsPosition: true}, position)
+	assert.Equal(t, 30.0, sc.toPublished(70))
+	assert.Equal(t, 70.0, sc.fromCommand(30))
+}
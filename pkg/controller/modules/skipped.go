@@ -0,0 +1,48 @@
+package modules
+
+import "sync"
+
+// SkippedDevice describes a device (or metering) for which a module does not
+// export any Home Assistant entity.
+type SkippedDevice struct {
+	DeviceId string `json:"deviceId"`
+	Name     string `json:"name"`
+	Module   string `json:"module"`
+	Reason   string `json:"reason"`
+}
+
+// SkippedDevicesProvider is implemented by the modules reporting the devices
+// skipped by their last call to GetHomeAssistantEntities.
+type SkippedDevicesProvider interface {
+	GetSkippedDevices() []SkippedDevice
+}
+
+// List of the devices skipped while building the discovery configs.
+type skippedDevices struct {
+	module  string
+	devices []SkippedDevice
+	mutex   sync.Mutex
+}
+
+func (s *skippedDevices) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.devices = nil
+}
+
+func (s *skippedDevices) add(deviceId string, name string, reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.devices = append(s.devices, SkippedDevice{
+		DeviceId: deviceId,
+		Name:     name,
+		Module:   s.module,
+		Reason:   reason,
+	})
+}
+
+func (s *skippedDevices) list() []SkippedDevice {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]SkippedDevice{}, s.devices...)
+}
@@ -0,0 +1,350 @@
+package modules
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/homeassistant"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/mqtt"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	states           string = "states"
+	operationsLocked string = "operationsLocked"
+)
+
+// Values of the states telling that the binary sensor is on, e.g. a window
+// being open or a smoke alarm being active.
+var activeStateValues = []string{"1", "true", "on", "yes", "active", "open", "opened", "tilted", "alarm", "detected", "present"}
+
+// binaryState is a well-known state of the devices announced as a binary
+// sensor.
+type binaryState struct {
+	// Words of the state id, compared in lower case.
+	keywords    []string
+	deviceClass string
+	icon        string
+}
+
+// States announced as binary sensors, the first one having a word of the
+// state id being used.
+var binaryStates = []binaryState{
+	{keywords: []string{"window"}, deviceClass: "window"},
+	{keywords: []string{"smoke", "fire"}, deviceClass: "smoke"},
+	{keywords: []string{"motion", "movement"}, deviceClass: "motion"},
+	{keywords: []string{"presence", "occupancy"}, deviceClass: "occupancy"},
+	{keywords: []string{"rain"}, deviceClass: "moisture", icon: "mdi:weather-rainy"},
+	{keywords: []string{"wind"}, deviceClass: "safety", icon: "mdi:weather-windy"},
+}
+
+// Returns the words of a state id in lower case, split at the upper case
+// letters and at the separators, e.g. "rain", "sensor" and "1" for
+// "rainSensor_1". A word can hence not match inside another one, like the
+// rain in "trainDoor".
+func stateWords(stateId string) []string {
+	words := []string{}
+	word := []rune{}
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	var previous rune
+	for _, r := range stateId {
+		switch {
+		case r == '_' || r == '-' || r == '.' || unicode.IsSpace(r):
+			flush()
+		case unicode.IsUpper(r) && (unicode.IsLower(previous) || unicode.IsDigit(previous)):
+			flush()
+			word = append(word, r)
+		case unicode.IsDigit(r) != unicode.IsDigit(previous) && len(word) > 0:
+			flush()
+			word = append(word, r)
+		default:
+			word = append(word, r)
+		}
+		previous = r
+	}
+	flush()
+	return words
+}
+
+// Returns the binary sensor of a state, if it is a well-known one.
+func binaryStateOf(stateId string) (binaryState, bool) {
+	words := stateWords(stateId)
+	for _, state := range binaryStates {
+		for _, keyword := range state.keywords {
+			if slices.Contains(words, keyword) {
+				return state, true
+			}
+		}
+	}
+	return binaryState{}, false
+}
+
+// Returns the template converting the value of a state into the payload of a
+// binary sensor, on when the value is one of the given ones.
+func binaryStateTemplate(values []string) string {
+	return "{{ 'ON' if value | lower in ['" + strings.Join(values, "', '") + "'] else 'OFF' }}"
+}
+
+// StatesModule publishes the states of the devices, e.g. window contacts,
+// smoke alarms or presence detectors, and whether their operations are
+// locked.
+type StatesModule struct {
+	mqttClient mqtt.Client
+	dsRegistry digitalstrom.Registry
+
+	normalizeDeviceName bool
+	overrides           config.Overrides
+}
+
+func (c *StatesModule) Start() error {
+	err := c.dsRegistry.Subscribe(states, c.handleEvent)
+	if err != nil {
+		return err
+	}
+
+	devices, err := c.dsRegistry.GetDevices()
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if err := c.publishDeviceStates(&device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Publishes all the states of the device and whether its operations are
+// locked, returning an error only when the states cannot be read.
+func (c *StatesModule) publishDeviceStates(device *digitalstrom.Device) error {
+	deviceStates, err := c.dsRegistry.GetStatesOfDevice(device.DeviceId)
+	if err != nil {
+		return err
+	}
+	for _, state := range deviceStates {
+		if err := c.publishState(device.DeviceId, state.StateId, state.Value); err != nil {
+			log.Error().Err(err).Msgf("Error publishing state of device '%s'", device.Attributes.Name)
+		}
+	}
+	if err := c.publishOperationsLocked(device.DeviceId); err != nil {
+		log.Error().Err(err).Msgf("Error publishing lock of device '%s'", device.Attributes.Name)
+	}
+	return nil
+}
+
+// Handles the events of the registry, publishing the states on the topics of
+// the devices added or renamed.
+func (c *StatesModule) handleEvent(event digitalstrom.Event) {
+	switch changed := event.(type) {
+	case digitalstrom.StateChanged:
+		if err := c.publishState(changed.DeviceId, changed.StateId, changed.NewValue); err != nil {
+			log.Error().Err(err).Str("deviceid", changed.DeviceId).Msg("Error publishing device state")
+		}
+	case digitalstrom.OperationsLockedChanged:
+		if err := c.publishOperationsLocked(changed.DeviceId); err != nil {
+			log.Error().Err(err).Str("deviceid", changed.DeviceId).Msg("Error publishing device lock")
+		}
+	case digitalstrom.DeviceAdded:
+		if err := c.publishDeviceStates(&changed.Device); err != nil {
+			log.Error().Err(err).Str("deviceid", changed.Device.DeviceId).Msg("Error publishing device states")
+		}
+	case digitalstrom.DeviceRenamed:
+		// The states are published on the topics of the new name.
+		device, err := c.dsRegistry.GetDevice(changed.DeviceId)
+		if err == nil {
+			err = c.publishDeviceStates(&device)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("deviceid", changed.DeviceId).Msg("Error publishing device states")
+		}
+	}
+}
+
+func (c *StatesModule) Stop() error {
+	return c.dsRegistry.Unsubscribe(states)
+}
+
+// Returns the settings of the device, of which only the exclusion and the
+// topic name are used.
+func (c *StatesModule) deviceSettings(device *digitalstrom.Device) config.DeviceSettings {
+	return resolveDeviceSettings(c.dsRegistry, c.overrides, config.DeviceSettings{}, device)
+}
+
+func (c *StatesModule) stateTopic(device *digitalstrom.Device, settings config.DeviceSettings, stateId string) string {
+	return deviceTopic(c.normalizeDeviceName, deviceTopicName(device, settings), states, stateId, mqtt.State)
+}
+
+func (c *StatesModule) operationsLockedTopic(device *digitalstrom.Device, settings config.DeviceSettings) string {
+	return deviceTopic(c.normalizeDeviceName, deviceTopicName(device, settings), operationsLocked, mqtt.State)
+}
+
+// Publishes the value of a state as received from the dSS.
+func (c *StatesModule) publishState(deviceId string, stateId string, value string) error {
+	device, err := c.dsRegistry.GetDevice(deviceId)
+	if err != nil {
+		return err
+	}
+	settings := c.deviceSettings(&device)
+	if settings.Exclude {
+		return nil
+	}
+	return c.mqttClient.Publish(c.stateTopic(&device, settings, stateId), value)
+}
+
+// Publishes whether the operations of the device are locked, which is the
+// case when any of its submodules is locked.
+func (c *StatesModule) publishOperationsLocked(deviceId string) error {
+	device, err := c.dsRegistry.GetDevice(deviceId)
+	if err != nil {
+		return err
+	}
+	settings := c.deviceSettings(&device)
+	if settings.Exclude {
+		return nil
+	}
+	submodules, err := c.dsRegistry.GetSubmoduleStatusOfDevice(deviceId)
+	if err != nil {
+		return err
+	}
+	if len(submodules) == 0 {
+		return nil
+	}
+	locked := false
+	for _, submodule := range submodules {
+		locked = locked || submodule.OperationsLocked
+	}
+	return c.mqttClient.Publish(c.operationsLockedTopic(&device, settings), strconv.FormatBool(locked))
+}
+
+func (c *StatesModule) GetHomeAssistantEntities() ([]homeassistant.DiscoveryConfig, error) {
+	configs := []homeassistant.DiscoveryConfig{}
+
+	devices, err := c.dsRegistry.GetDevices()
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		settings := c.deviceSettings(&device)
+		if settings.Exclude {
+			continue
+		}
+		deviceStates, err := c.dsRegistry.GetStatesOfDevice(device.DeviceId)
+		if err != nil {
+			return nil, err
+		}
+		for _, state := range deviceStates {
+			configs = append(configs, c.stateEntities(&device, settings, state.StateId)...)
+		}
+
+		submodules, err := c.dsRegistry.GetSubmoduleStatusOfDevice(device.DeviceId)
+		if err != nil {
+			return nil, err
+		}
+		if len(submodules) > 0 {
+			base := c.baseConfig(&device, "Operations locked", operationsLocked)
+			base.EntityCategory = "diagnostic"
+			configs = append(configs, homeassistant.DiscoveryConfig{
+				Domain:   homeassistant.BinarySensor,
+				DeviceId: device.DeviceId,
+				ObjectId: operationsLocked,
+				Config: &homeassistant.BinarySensorConfig{
+					BaseConfig: base,
+					StateTopic: c.mqttClient.GetFullTopic(c.operationsLockedTopic(&device, settings)),
+					PayloadOn:  "true",
+					PayloadOff: "false",
+					Icon:       "mdi:lock",
+				},
+			})
+		}
+	}
+	return configs, nil
+}
+
+// Returns the entities of a state: a binary sensor for the well-known states,
+// with a second one telling whether a window handle is tilted, and a
+// diagnostic sensor reporting the raw value otherwise.
+func (c *StatesModule) stateEntities(device *digitalstrom.Device, settings config.DeviceSettings, stateId string) []homeassistant.DiscoveryConfig {
+	objectId := "state_" + normalizeForTopicName(stateId)
+	stateTopic := c.mqttClient.GetFullTopic(c.stateTopic(device, settings, stateId))
+
+	known, ok := binaryStateOf(stateId)
+	if !ok {
+		base := c.baseConfig(device, stateId, objectId)
+		base.EntityCategory = "diagnostic"
+		return []homeassistant.DiscoveryConfig{{
+			Domain:   homeassistant.Sensor,
+			DeviceId: device.DeviceId,
+			ObjectId: objectId,
+			Config: &homeassistant.SensorConfig{
+				BaseConfig: base,
+				StateTopic: stateTopic,
+			},
+		}}
+	}
+
+	configs := []homeassistant.DiscoveryConfig{{
+		Domain:   homeassistant.BinarySensor,
+		DeviceId: device.DeviceId,
+		ObjectId: objectId,
+		Config: &homeassistant.BinarySensorConfig{
+			BaseConfig:    c.baseConfig(device, stateId, objectId),
+			StateTopic:    stateTopic,
+			DeviceClass:   known.deviceClass,
+			PayloadOn:     "ON",
+			PayloadOff:    "OFF",
+			Icon:          known.icon,
+			ValueTemplate: binaryStateTemplate(activeStateValues),
+		},
+	}}
+	if slices.Contains(stateWords(stateId), "handle") {
+		configs = append(configs, homeassistant.DiscoveryConfig{
+			Domain:   homeassistant.BinarySensor,
+			DeviceId: device.DeviceId,
+			ObjectId: objectId + "_tilted",
+			Config: &homeassistant.BinarySensorConfig{
+				BaseConfig:    c.baseConfig(device, stateId+" tilted", objectId+"_tilted"),
+				StateTopic:    stateTopic,
+				DeviceClass:   known.deviceClass,
+				PayloadOn:     "ON",
+				PayloadOff:    "OFF",
+				ValueTemplate: binaryStateTemplate([]string{"tilted"}),
+			},
+		})
+	}
+	return configs
+}
+
+func (c *StatesModule) baseConfig(device *digitalstrom.Device, name string, objectId string) homeassistant.BaseConfig {
+	return homeassistant.BaseConfig{
+		Device: homeassistant.Device{
+			Identifiers: []string{
+				device.DeviceId,
+			},
+			Name: device.Attributes.Name,
+		},
+		Name:     name,
+		UniqueId: device.DeviceId + "_" + objectId,
+	}
+}
+
+func NewStatesModule(mqttClient mqtt.Client, dsClient digitalstrom.Client, dsRegistry digitalstrom.Registry, config *config.Config) Module {
+	return &StatesModule{
+		mqttClient:          mqttClient,
+		dsRegistry:          dsRegistry,
+		normalizeDeviceName: config.Mqtt.NormalizeDeviceName,
+		overrides:           config.Overrides,
+	}
+}
+
+func init() {
+	Register("states", NewStatesModule)
+}
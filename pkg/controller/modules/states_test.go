@@ -0,0 +1,138 @@
+package modules
+
+import (
+	"testing"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/homeassistant"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinaryStateOf(t *testing.T) {
+	window, ok := binaryStateOf("windowHandle")
+	assert.True(t, ok)
+	assert.Equal(t, "window", window.deviceClass)
+
+	smoke, ok := binaryStateOf("SmokeAlarm")
+	assert.True(t, ok)
+	assert.Equal(t, "smoke", smoke.deviceClass)
+
+	wind, ok := binaryStateOf("windAlarm")
+	assert.True(t, ok)
+	assert.Equal(t, "safety", wind.deviceClass)
+
+	rain, ok := binaryStateOf("rain_sensor.1")
+	assert.True(t, ok)
+	assert.Equal(t, "moisture", rain.deviceClass)
+
+	_, ok = binaryStateOf("operatingState")
+	assert.False(t, ok)
+	// The keywords only match whole words.
+	_, ok = binaryStateOf("trainDoor")
+	assert.False(t, ok)
+	_, ok = binaryStateOf("windowsUpdate")
+	assert.False(t, ok)
+
+	assert.Equal(t, "{{ 'ON' if value | lower in ['open', 'tilted'] else 'OFF' }}", binaryStateTemplate([]string{"open", "tilted"}))
+}
+
+func TestStateWords(t *testing.T) {
+	assert.Equal(t, []string{"window", "handle"}, stateWords("windowHandle"))
+	assert.Equal(t, []string{"smoke", "alarm"}, stateWords("SmokeAlarm"))
+	assert.Equal(t, []string{"rain", "sensor", "1"}, stateWords("rain_sensor.1"))
+	assert.Equal(t, []string{"presence", "2", "detected"}, stateWords("presence2-detected"))
+	assert.Equal(t, []string{"motion"}, stateWords("motion"))
+}
+
+func newTestStatesModule(overrides config.Overrides) (*StatesModule, *fakeMqttClient) {
+	registry := &fakeRegistry{
+		devices: []digitalstrom.Device{
+			{DeviceId: "dev1", Attributes: digitalstrom.DeviceAttributes{Name: "Kitchen window"}},
+		},
+		states: map[string][]digitalstrom.DeviceState{
+			"dev1": {{StateId: "windowHandle", Value: "tilted"}, {StateId: "operatingState", Value: "2"}},
+		},
+		submodules: map[string][]digitalstrom.SubmoduleStatus{
+			"dev1": {{SubmoduleId: "s1"}, {SubmoduleId: "s2", OperationsLocked: true}},
+		},
+	}
+	mqttClient := &fakeMqttClient{published: map[string]string{}}
+	module := NewStatesModule(mqttClient, nil, registry, &config.Config{Overrides: overrides}).(*StatesModule)
+	return module, mqttClient
+}
+
+func TestStatesModuleTopics(t *testing.T) {
+	module, mqttClient := newTestStatesModule(config.Overrides{})
+
+	assert.NoError(t, module.publishState("dev1", "windowHandle", "tilted"))
+	assert.NoError(t, module.publishOperationsLocked("dev1"))
+	assert.Equal(t, map[string]string{
+		"devices/Kitchen window/states/windowHandle/state": "tilted",
+		"devices/Kitchen window/operationsLocked/state":    "true",
+	}, mqttClient.published)
+
+	// The topic name of the device applies to its states.
+	module, mqttClient = newTestStatesModule(config.Overrides{Devices: []config.DeviceOverride{
+		{Name: "Kitchen window", Override: config.Override{TopicName: "kitchen"}},
+	}})
+	assert.NoError(t, module.publishState("dev1", "windowHandle", "open"))
+	assert.Equal(t, "open", mqttClient.published["devices/kitchen/states/windowHandle/state"])
+
+	// Nothing is published for the excluded devices.
+	exclude := true
+	module, mqttClient = newTestStatesModule(config.Overrides{Devices: []config.DeviceOverride{
+		{Name: "Kitchen window", Override: config.Override{Exclude: &exclude}},
+	}})
+	assert.NoError(t, module.publishState("dev1", "windowHandle", "open"))
+	assert.NoError(t, module.publishOperationsLocked("dev1"))
+	assert.Empty(t, mqttClient.published)
+}
+
+func TestStatesModulePublishesTheRenamedDevices(t *testing.T) {
+	module, mqttClient := newTestStatesModule(config.Overrides{})
+	registry := module.dsRegistry.(*fakeRegistry)
+
+	registry.devices[0].Attributes.Name = "Bedroom window"
+	module.handleEvent(digitalstrom.DeviceRenamed{DeviceId: "dev1", OldName: "Kitchen window", NewName: "Bedroom window"})
+	assert.Equal(t, map[string]string{
+		"devices/Bedroom window/states/windowHandle/state":   "tilted",
+		"devices/Bedroom window/states/operatingState/state": "2",
+		"devices/Bedroom window/operationsLocked/state":      "true",
+	}, mqttClient.published)
+}
+
+func TestStatesModuleDiscovery(t *testing.T) {
+	module, _ := newTestStatesModule(config.Overrides{})
+
+	entities, err := module.GetHomeAssistantEntities()
+	assert.NoError(t, err)
+	byObjectId := map[string]homeassistant.DiscoveryConfig{}
+	for _, entity := range entities {
+		byObjectId[entity.ObjectId] = entity
+	}
+	assert.Len(t, byObjectId, 4)
+
+	handle := byObjectId["state_windowHandle"]
+	assert.Equal(t, homeassistant.BinarySensor, handle.Domain)
+	handleConfig := handle.Config.(*homeassistant.BinarySensorConfig)
+	assert.Equal(t, "digitalstrom/devices/Kitchen window/states/windowHandle/state", handleConfig.StateTopic)
+	assert.Equal(t, "window", handleConfig.DeviceClass)
+	assert.Equal(t, "dev1_state_windowHandle", handleConfig.UniqueId)
+	assert.Equal(t, binaryStateTemplate(activeStateValues), handleConfig.ValueTemplate)
+
+	tilted := byObjectId["state_windowHandle_tilted"].Config.(*homeassistant.BinarySensorConfig)
+	assert.Equal(t, handleConfig.StateTopic, tilted.StateTopic)
+	assert.Equal(t, "{{ 'ON' if value | lower in ['tilted'] else 'OFF' }}", tilted.ValueTemplate)
+
+	// Unknown states are diagnostic sensors.
+	operating := byObjectId["state_operatingState"]
+	assert.Equal(t, homeassistant.Sensor, operating.Domain)
+	assert.Equal(t, "diagnostic", operating.Config.(*homeassistant.SensorConfig).EntityCategory)
+
+	locked := byObjectId[operationsLocked]
+	assert.Equal(t, homeassistant.BinarySensor, locked.Domain)
+	lockedConfig := locked.Config.(*homeassistant.BinarySensorConfig)
+	assert.Equal(t, "digitalstrom/devices/Kitchen window/operationsLocked/state", lockedConfig.StateTopic)
+	assert.Equal(t, []string{"true", "false"}, []string{lockedConfig.PayloadOn, lockedConfig.PayloadOff})
+}
@@ -14,7 +14,8 @@ import (
 )
 
 /**
- * This file is here only to generate a new API key for the integration. It should never be used for another purpose.
+ * This file is here only to manage the API keys (application tokens) of the integration. It should never be used for
+ * another purpose.
  */
 
 type NewApiKeyRequest struct {
@@ -29,14 +30,34 @@ type NewApiKeyRequestAttributes struct {
 	Name string `json:"name"`
 }
 
-func GetApiKey(host string, port int, user string, password string, integrationName string) (string, error) {
-	httpClient := http.Client{
+// ApplicationToken is an API key registered on the dSS, its id being the key
+// itself.
+type ApplicationToken struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// MaskedId returns the id with only its first and last characters, enough to
+// recognize a key without disclosing it.
+func (t ApplicationToken) MaskedId() string {
+	if len(t.Id) <= 8 {
+		return "****"
+	}
+	return t.Id[:4] + "..." + t.Id[len(t.Id)-4:]
+}
+
+func newApiKeyHttpClient() http.Client {
+	return http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: true,
 			},
 		},
 	}
+}
+
+func GetApiKey(host string, port int, user string, password string, integrationName string) (string, error) {
+	httpClient := newApiKeyHttpClient()
 
 	token, err := getToken(httpClient, host, port, user, password)
 	if err != nil {
@@ -111,6 +132,82 @@ func getApiKey(httpClient http.Client, host string, port int, token string, inte
 	return apiKey, nil
 }
 
+// ListApiKeys returns the application tokens registered on the dSS.
+func ListApiKeys(host string, port int, user string, password string) ([]ApplicationToken, error) {
+	httpClient := newApiKeyHttpClient()
+	token, err := getToken(httpClient, host, port, user, password)
+	if err != nil {
+		return nil, err
+	}
+	return listApiKeys(httpClient, host, port, token)
+}
+
+// RevokeApiKey removes the application token with the given id, masked id or
+// name from the dSS. A masked id or a name must match a single token.
+func RevokeApiKey(host string, port int, user string, password string, idOrName string) (ApplicationToken, error) {
+	httpClient := newApiKeyHttpClient()
+	token, err := getToken(httpClient, host, port, user, password)
+	if err != nil {
+		return ApplicationToken{}, err
+	}
+	tokens, err := listApiKeys(httpClient, host, port, token)
+	if err != nil {
+		return ApplicationToken{}, err
+	}
+	matches := []ApplicationToken{}
+	for _, applicationToken := range tokens {
+		if applicationToken.Id == idOrName {
+			matches = []ApplicationToken{applicationToken}
+			break
+		}
+		if applicationToken.Name == idOrName || applicationToken.MaskedId() == idOrName {
+			matches = append(matches, applicationToken)
+		}
+	}
+	if len(matches) == 0 {
+		return ApplicationToken{}, fmt.Errorf("no api key found with id or name '%s'", idOrName)
+	}
+	if len(matches) > 1 {
+		return ApplicationToken{}, fmt.Errorf("%d api keys match '%s', use the id instead", len(matches), idOrName)
+	}
+
+	params := url.Values{}
+	params.Set("token", token)
+	path := "api/v1/apartment/applicationTokens/" + url.PathEscape(matches[0].Id)
+	if _, _, err := doRequest(httpClient, http.MethodDelete, host, port, path, params, nil); err != nil {
+		return ApplicationToken{}, fmt.Errorf("error when revoking api key: %w", err)
+	}
+	return matches[0], nil
+}
+
+func listApiKeys(httpClient http.Client, host string, port int, token string) ([]ApplicationToken, error) {
+	params := url.Values{}
+	params.Set("token", token)
+	response, _, err := doRequest(httpClient, http.MethodGet, host, port, "api/v1/apartment/applicationTokens", params, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error when listing api keys: %w", err)
+	}
+	data, ok := response["data"].([]interface{})
+	if !ok {
+		return nil, errors.New("no 'data' list present, cannot get api keys from request")
+	}
+
+	tokens := []ApplicationToken{}
+	for _, item := range data {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		applicationToken := ApplicationToken{}
+		applicationToken.Id, _ = entry["id"].(string)
+		if attributes, ok := entry["attributes"].(map[string]interface{}); ok {
+			applicationToken.Name, _ = attributes["name"].(string)
+		}
+		tokens = append(tokens, applicationToken)
+	}
+	return tokens, nil
+}
+
 func doRequest(httpClient http.Client, method string, host string, port int, path string, params url.Values, body interface{}) (map[string]interface{}, *http.Response, error) {
 	var bodyReader io.Reader = nil
 	if body != nil {
@@ -231,15 +231,24 @@ type DeviceStatusAttributes struct {
 	FunctionBlocks []struct {
 		FunctionBlockId string        `mapstructure:"id"`
 		Outputs         []OutputValue `mapstructure:"outputs,omitempty"`
+		SensorInputs    []InputValue  `mapstructure:"sensorInputs,omitempty"`
+		ButtonInputs    []InputValue  `mapstructure:"buttonInputs,omitempty"`
 	} `mapstructure:"functionBlocks"`
-	Submodules []struct {
-		SubmoduleId      string `mapstructure:"id"`
-		OperationsLocked bool   `mapstructure:"operationsLocked"`
-	} `mapstructure:"submodules"`
-	States []struct {
-		StateId string `mapstructure:"id"`
-		Value   string `mapstructure:"value"`
-	} `mapstructure:"states,omitempty"`
+	Submodules []SubmoduleStatus `mapstructure:"submodules"`
+	States     []DeviceState     `mapstructure:"states,omitempty"`
+}
+
+// Status of a submodule, whose operations can be locked, e.g. by a safety
+// function.
+type SubmoduleStatus struct {
+	SubmoduleId      string `mapstructure:"id"`
+	OperationsLocked bool   `mapstructure:"operationsLocked"`
+}
+
+// State of a device, e.g. a window handle being open or a smoke alarm.
+type DeviceState struct {
+	StateId string `mapstructure:"id"`
+	Value   string `mapstructure:"value"`
 }
 
 type OutputValue struct {
@@ -250,12 +259,36 @@ type OutputValue struct {
 	Level       int               `mapstructure:"level,omitempty"`
 }
 
+// Value of a sensor or button input.
+type InputValue struct {
+	InputId string  `mapstructure:"id"`
+	Value   float64 `mapstructure:"value"`
+}
+
+type ScenarioInvocation struct {
+	Context     string              `json:"context,omitempty"`
+	ActionId    string              `json:"actionId"`
+	Application ScenarioApplication `json:"application,omitempty"`
+	Zone        string              `json:"zone,omitempty"`
+	Device      string              `json:"dsDevice,omitempty"`
+}
+
 type SetOutputValue struct {
 	Op    SetOutputValueOperation `json:"op"`
 	Path  string                  `json:"path"`
 	Value string                  `json:"value"`
 }
 
+// OutputTarget is a value to set on an output of a function block.
+type OutputTarget struct {
+	FunctionBlockId string
+	OutputId        string
+	Value           float64
+	// Resolution of the output, used to format the value. The value is sent
+	// as an integer when 0.
+	Resolution float64
+}
+
 // Websocket
 
 type NotificationType string
@@ -278,4 +311,6 @@ type WebsocketNotification struct {
 
 type WebsocketNotificationArgument struct {
 	Type NotificationType `json:"type"`
+	// Device whose status changed, when the notification identifies it.
+	DeviceId string `json:"dsDevice,omitempty"`
 }
@@ -0,0 +1,151 @@
+package digitalstrom
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type CaptureEntryType string
+
+const (
+	CaptureEntryRequest      CaptureEntryType = "request"
+	CaptureEntryNotification CaptureEntryType = "notification"
+)
+
+// CaptureEntry is a single line of a capture file, either a request to the
+// dSS with its response or a notification received on the websocket.
+type CaptureEntry struct {
+	Time time.Time        `json:"time"`
+	Type CaptureEntryType `json:"type"`
+
+	// Set for requests.
+	Method       string          `json:"method,omitempty"`
+	Path         string          `json:"path,omitempty"`
+	Query        string          `json:"query,omitempty"`
+	RequestBody  json.RawMessage `json:"requestBody,omitempty"`
+	Status       int             `json:"status,omitempty"`
+	ResponseBody json.RawMessage `json:"responseBody,omitempty"`
+	Error        string          `json:"error,omitempty"`
+
+	// Set for notifications.
+	Notification json.RawMessage `json:"notification,omitempty"`
+}
+
+// Writes the traffic with the dSS to a capture file, one JSON entry per line.
+// The API key is redacted from everything written.
+type recorder struct {
+	file   *os.File
+	writer *bufio.Writer
+	apiKey string
+	mutex  sync.Mutex
+}
+
+func newRecorder(path string, apiKey string) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open capture file: %w", err)
+	}
+	return &recorder{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		apiKey: apiKey,
+	}, nil
+}
+
+func (r *recorder) request(method string, path string, query string, requestBody []byte, status int, responseBody []byte, err error) {
+	entry := CaptureEntry{
+		Time:         time.Now(),
+		Type:         CaptureEntryRequest,
+		Method:       method,
+		Path:         path,
+		Query:        query,
+		RequestBody:  r.toJSON(requestBody),
+		Status:       status,
+		ResponseBody: r.toJSON(responseBody),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	r.write(entry)
+}
+
+func (r *recorder) notification(notification []byte) {
+	r.write(CaptureEntry{
+		Time:         time.Now(),
+		Type:         CaptureEntryNotification,
+		Notification: r.toJSON(notification),
+	})
+}
+
+// Returns the content as JSON, wrapped in a string when it is not valid JSON
+// (e.g. an error message).
+func (r *recorder) toJSON(content []byte) json.RawMessage {
+	if len(content) == 0 {
+		return nil
+	}
+	if json.Valid(content) {
+		return content
+	}
+	wrapped, _ := json.Marshal(string(content))
+	return wrapped
+}
+
+func (r *recorder) write(entry CaptureEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if r.apiKey != "" {
+		line = []byte(strings.ReplaceAll(string(line), r.apiKey, "REDACTED"))
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.writer.Write(line)
+	r.writer.WriteByte('\n')
+	// Flush every entry so that the capture is usable even if the bridge
+	// crashes.
+	r.writer.Flush()
+}
+
+func (r *recorder) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.writer.Flush()
+	return r.file.Close()
+}
+
+// ReadCapture reads all the entries of a capture file.
+func ReadCapture(path string) ([]CaptureEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open capture file: %w", err)
+	}
+	defer file.Close()
+
+	entries := []CaptureEntry{}
+	scanner := bufio.NewScanner(file)
+	// The apartment structure can be large.
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry CaptureEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid capture entry on line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading capture file: %w", err)
+	}
+	return entries, nil
+}
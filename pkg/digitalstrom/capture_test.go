@@ -0,0 +1,101 @@
+package digitalstrom
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	captureFile := filepath.Join(t.TempDir(), "capture.jsonl")
+	recorder, err := newRecorder(captureFile, "secret-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := apartmentStatusParams().Encode()
+	recorder.request(http.MethodGet, "api/v1/apartment/status", status, nil, 200, []byte(`{"data": {"id": "first"}}`), nil)
+	recorder.request(http.MethodGet, "api/v1/apartment/status", status, nil, 200, []byte(`{"data": {"id": "second"}}`), nil)
+	recorder.request(http.MethodGet, "api/v1/apartment/meterings", "", nil, 0, nil, errors.New("timeout"))
+	recorder.request(http.MethodPost, "api/v1/apartment/applicationTokens", "", []byte(`{"token": "secret-key"}`), 200, []byte(`not json`), nil)
+	recorder.notification([]byte(`{"type": 1, "target": "notify", "arguments": [{"type": "apartmentStatusChanged"}]}`))
+	if err := recorder.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := os.ReadFile(captureFile)
+	if strings.Contains(string(content), "secret-key") {
+		t.Errorf("API key not redacted from capture: %s", content)
+	}
+	entries, err := ReadCapture(captureFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 || string(entries[3].ResponseBody) != `"not json"` {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+
+	client := NewReplayClient(captureFile)
+	notified := make(chan WebsocketNotification, 1)
+	client.NotificationSubscribe("test", func(notification WebsocketNotification) {
+		notified <- notification
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	// Responses are served in order, the last one being repeated.
+	for _, expected := range []string{"first", "second", "second"} {
+		apartmentStatus, err := client.GetApartmentStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if apartmentStatus.ApartmentId != expected {
+			t.Errorf("Expected apartment status '%s' but got '%s'", expected, apartmentStatus.ApartmentId)
+		}
+	}
+	if _, err := client.GetMeterings(); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("Expected recorded error but got %v", err)
+	}
+	select {
+	case notification := <-notified:
+		if notification.Arguments[0].Type != NotificationTypeApartmentStatusChanged {
+			t.Errorf("Unexpected notification: %+v", notification)
+		}
+	case <-time.After(time.Second):
+		t.Error("Notification not replayed")
+	}
+}
+
+func TestReplayWaitsForSubscriber(t *testing.T) {
+	captureFile := filepath.Join(t.TempDir(), "capture.jsonl")
+	recorder, err := newRecorder(captureFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.notification([]byte(`{"type": 1, "target": "notify", "arguments": [{"type": "apartmentStatusChanged"}]}`))
+	if err := recorder.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewReplayClient(captureFile)
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+	// Subscribed after connecting, like the registry.
+	time.Sleep(50 * time.Millisecond)
+	notified := make(chan WebsocketNotification, 1)
+	client.NotificationSubscribe("test", func(notification WebsocketNotification) {
+		notified <- notification
+	})
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Error("Notification replayed before the subscription")
+	}
+}
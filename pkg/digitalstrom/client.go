@@ -5,19 +5,29 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/metrics"
 	"github.com/gorilla/websocket"
 	"github.com/mitchellh/mapstructure"
 	"github.com/rs/zerolog/log"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const WEBSOCKET_RECONNECT_DELAY = 5 * time.Second
 
+var (
+	// Returned when the dSS rejects the API key.
+	ErrUnauthorized = errors.New("unauthorized, the API key is invalid or was revoked")
+	// Returned when the dSS cannot be reached.
+	ErrUnreachable = errors.New("dSS unreachable")
+)
+
 type NotificationCallback func(notification WebsocketNotification)
 
 // Client is the interface definition as used by this library, the
@@ -33,14 +43,37 @@ type Client interface {
 
 	GetApartment() (*Apartment, error)
 	GetApartmentStatus() (*ApartmentStatus, error)
+	// GetDeviceStatus returns the status of a single device, much faster than
+	// the status of the whole apartment on large installations.
+	GetDeviceStatus(deviceId string) (*DeviceStatus, error)
 	GetMeterings() (*Meterings, error)
 	GetMeteringStatus() (*MeteringValues, error)
+	GetScenarios() ([]Scenarios, error)
+	// GetApartmentRaw and GetApartmentStatusRaw return the apartment
+	// structure and status as JSON, exactly as returned by the dSS.
+	GetApartmentRaw() ([]byte, error)
+	GetApartmentStatusRaw() ([]byte, error)
+
+	// Ping checks that the dSS is reachable and accepts the API key.
+	Ping() error
 
 	// DeviceSetOutputValue Sets a list of outputs to a give values
 	DeviceSetOutputValue(deviceId string, functionBlockId string, outputId string, value float64) error
+	// DeviceSetOutputValues sets several outputs of a device in a single
+	// request, so that they change together.
+	DeviceSetOutputValues(deviceId string, targets []OutputTarget) error
+	// InvokeScenario invokes an action, e.g. on a single device.
+	InvokeScenario(invocation ScenarioInvocation) error
 
 	NotificationSubscribe(id string, callback NotificationCallback) error
 	NotificationUnsubscribe(id string) error
+
+	// WebsocketConnected returns whether the notification websocket is
+	// currently connected.
+	WebsocketConnected() bool
+	// LastNotification returns the time at which the last notification was
+	// received, or the zero time if none was received yet.
+	LastNotification() time.Time
 }
 
 // client implements the DigitalStrom interface.
@@ -50,6 +83,9 @@ type client struct {
 	options                 ClientOptions
 	websocketConnection     *websocket.Conn
 	websocketConnectionOpen bool
+	websocketConnected      atomic.Bool
+	lastNotification        atomic.Int64
+	recorder                *recorder
 
 	notificationCallbacks map[string]NotificationCallback
 }
@@ -91,10 +127,19 @@ func (c *client) websocketConnect() error {
 	}
 	log.Info().Msg("Connected to websocket for notifications")
 	c.websocketConnectionOpen = true
+	c.websocketConnected.Store(true)
 	return nil
 }
 
 func (c *client) Connect() error {
+	if c.options.CaptureFile != "" && c.recorder == nil {
+		recorder, err := newRecorder(c.options.CaptureFile, c.options.ApiKey)
+		if err != nil {
+			return err
+		}
+		c.recorder = recorder
+		log.Warn().Str("file", c.options.CaptureFile).Msg("Recording all the traffic with the dSS")
+	}
 	c.websocketConnectionOpen = false
 	err := c.websocketConnect()
 	if err != nil {
@@ -106,28 +151,40 @@ func (c *client) Connect() error {
 		firstMessage := true
 		for {
 			var notification WebsocketNotification
-			err := c.websocketConnection.ReadJSON(&notification)
+			_, message, err := c.websocketConnection.ReadMessage()
+			if err == nil {
+				if c.recorder != nil {
+					c.recorder.notification(message)
+				}
+				err = json.Unmarshal(message, &notification)
+			}
 			if err != nil {
 				if !c.websocketConnectionOpen {
 					// we're closing, ignore read errors
 					break
 				} else {
+					c.websocketConnected.Store(false)
 					log.Error().Err(err).Msg("Websocket reading error, will try to reconnect")
 					time.Sleep(WEBSOCKET_RECONNECT_DELAY)
+					metrics.WebsocketReconnects.Inc()
 					err = c.websocketConnect()
 					if err != nil {
 						log.Error().Err(err).Msg("Websocket reconnect error")
 					}
 				}
-			} else if notification.Arguments == nil || len(notification.Arguments) == 0 {
-				if !firstMessage {
-					log.Warn().Msg("No argument received in notification")
-				}
 			} else {
-				for _, callback := range c.notificationCallbacks {
-					callback(notification)
+				c.lastNotification.Store(time.Now().UnixNano())
+				if len(notification.Arguments) == 0 {
+					if !firstMessage {
+						log.Warn().Msg("No argument received in notification")
+					}
+				} else {
+					metrics.WebsocketNotifications.WithLabelValues(string(notification.Arguments[0].Type)).Inc()
+					for _, callback := range c.notificationCallbacks {
+						callback(notification)
+					}
+					log.Trace().Str("target", notification.Target).Str("type", string(notification.Arguments[0].Type)).Msg("Websocket received")
 				}
-				log.Trace().Str("target", notification.Target).Str("type", string(notification.Arguments[0].Type)).Msg("Websocket received")
 			}
 			firstMessage = false
 		}
@@ -140,25 +197,72 @@ func (c *client) Connect() error {
 // Disconnect stops all the ongoing calls and unsubscribe from the notification websocket
 func (c *client) Disconnect() error {
 	c.websocketConnectionOpen = false
+	c.websocketConnected.Store(false)
 	c.httpClient.CloseIdleConnections()
-	_ = c.websocketConnection.Close()
+	if c.websocketConnection != nil {
+		_ = c.websocketConnection.Close()
+	}
+	if c.recorder != nil {
+		if err := c.recorder.close(); err != nil {
+			return fmt.Errorf("error closing capture file: %w", err)
+		}
+		c.recorder = nil
+	}
 	return nil
 }
 
+func (c *client) Ping() error {
+	_, err := c.doRequest(http.MethodGet, "api/v1/apartment", nil, nil)
+	return err
+}
+
+func (c *client) WebsocketConnected() bool {
+	return c.websocketConnected.Load()
+}
+
+func (c *client) LastNotification() time.Time {
+	last := c.lastNotification.Load()
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
 func (c *client) GetApartment() (*Apartment, error) {
+	response, err := c.getRequest("api/v1/apartment", apartmentParams())
+	return wrapApiResponse[Apartment](response, err)
+}
+
+func (c *client) GetApartmentRaw() ([]byte, error) {
+	return c.doRequest(http.MethodGet, "api/v1/apartment", apartmentParams(), nil)
+}
+
+func apartmentParams() url.Values {
 	params := url.Values{}
 	params.Set("include", "installation,dsDevices,submodules,functionBlocks,zones,controllers,meterings")
-	response, err := c.getRequest("api/v1/apartment", params)
-	return wrapApiResponse[Apartment](response, err)
+	return params
 }
 
-func (c *client) GetApartmentStatus() (*ApartmentStatus, error) {
+func apartmentStatusParams() url.Values {
 	params := url.Values{}
 	params.Set("include", "dsDevices,zones")
-	response, err := c.getRequest("api/v1/apartment/status", params)
+	return params
+}
+
+func (c *client) GetApartmentStatus() (*ApartmentStatus, error) {
+	response, err := c.getRequest("api/v1/apartment/status", apartmentStatusParams())
 	return wrapApiResponse[ApartmentStatus](response, err)
 }
 
+func (c *client) GetDeviceStatus(deviceId string) (*DeviceStatus, error) {
+	response, err := c.getRequest(fmt.Sprintf("api/v1/apartment/dsDevices/%s/status", deviceId), nil)
+	return wrapApiResponse[DeviceStatus](response, err)
+}
+
+func (c *client) GetApartmentStatusRaw() ([]byte, error) {
+	return c.doRequest(http.MethodGet, "api/v1/apartment/status", apartmentStatusParams(), nil)
+}
+
 func (c *client) GetMeterings() (*Meterings, error) {
 	response, err := c.getRequest("api/v1/apartment/meterings", nil)
 	return wrapApiResponse[Meterings](response, err)
@@ -169,18 +273,58 @@ func (c *client) GetMeteringStatus() (*MeteringValues, error) {
 	return wrapApiResponse[MeteringValues](response, err)
 }
 
+func (c *client) GetScenarios() ([]Scenarios, error) {
+	response, err := c.getRequest("api/v1/apartment/scenarios", nil)
+	scenarios, err := wrapApiResponse[[]Scenarios](response, err)
+	if err != nil {
+		return nil, err
+	}
+	return *scenarios, nil
+}
+
 func (c *client) DeviceSetOutputValue(deviceId string, functionBlockId string, outputId string, value float64) error {
-	var contents []SetOutputValue
-	contents = append(contents, SetOutputValue{
-		Op:    SetOutputValueOperationReplace,
-		Path:  fmt.Sprintf("/functionBlocks/%s/outputs/%s/value", functionBlockId, outputId),
-		Value: fmt.Sprintf("%.0f", value),
-	})
+	return c.DeviceSetOutputValues(deviceId, []OutputTarget{{
+		FunctionBlockId: functionBlockId,
+		OutputId:        outputId,
+		Value:           value,
+	}})
+}
+
+func (c *client) DeviceSetOutputValues(deviceId string, targets []OutputTarget) error {
+	if len(targets) == 0 {
+		return nil
+	}
+	contents := make([]SetOutputValue, 0, len(targets))
+	for _, target := range targets {
+		contents = append(contents, SetOutputValue{
+			Op:    SetOutputValueOperationReplace,
+			Path:  fmt.Sprintf("/functionBlocks/%s/outputs/%s/value", target.FunctionBlockId, target.OutputId),
+			Value: formatOutputValue(target.Value, target.Resolution),
+		})
+	}
 
 	path := fmt.Sprintf("api/v1/apartment/dsDevices/%s/status", deviceId)
 	return c.patchRequest(path, contents)
 }
 
+// Formats a value rounded to the resolution of the output, with as many
+// decimals as the resolution has, e.g. 2 for 0.01 or 0.25.
+func formatOutputValue(value float64, resolution float64) string {
+	if resolution <= 0 {
+		return strconv.FormatFloat(value, 'f', 0, 64)
+	}
+	decimals := 0
+	if _, fraction, ok := strings.Cut(strconv.FormatFloat(resolution, 'f', -1, 64), "."); ok {
+		decimals = len(fraction)
+	}
+	return strconv.FormatFloat(math.Round(value/resolution)*resolution, 'f', decimals, 64)
+}
+
+func (c *client) InvokeScenario(invocation ScenarioInvocation) error {
+	_, err := c.doRequest(http.MethodPost, "api/v1/apartment/scenarios/invoke", nil, invocation)
+	return err
+}
+
 func (c *client) NotificationSubscribe(id string, callback NotificationCallback) error {
 	_, exists := c.notificationCallbacks[id]
 	if exists {
@@ -201,8 +345,10 @@ func (c *client) NotificationUnsubscribe(id string) error {
 
 func (c *client) doRequest(method string, path string, params url.Values, body interface{}) ([]byte, error) {
 	var bodyReader io.Reader = nil
+	var jsonBody []byte
 	if body != nil {
-		jsonBody, err := json.Marshal(body)
+		var err error
+		jsonBody, err = json.Marshal(body)
 		if err != nil {
 			return nil, err
 		}
@@ -214,23 +360,37 @@ func (c *client) doRequest(method string, path string, params url.Values, body i
 	}
 
 	request, err := http.NewRequest(method, callUrl, bodyReader)
-	request.Header.Set("Authorization", "Bearer "+c.options.ApiKey)
 	if err != nil {
 		return nil, fmt.Errorf("error building the request: %w", err)
 	}
+	request.Header.Set("Authorization", "Bearer "+c.options.ApiKey)
+	endpoint := metrics.Endpoint(path)
+	start := time.Now()
 	resp, err := c.httpClient.Do(request)
+	metrics.DigitalstromRequestDuration.WithLabelValues(method, endpoint).Observe(time.Since(start).Seconds())
 	if err != nil {
-		return nil, fmt.Errorf("error doing the request: %w", err)
+		metrics.DigitalstromRequests.WithLabelValues(method, endpoint, "error").Inc()
+		if c.recorder != nil {
+			c.recorder.request(method, path, params.Encode(), jsonBody, 0, nil, err)
+		}
+		return nil, fmt.Errorf("error doing the request: %w: %w", ErrUnreachable, err)
 	}
+	metrics.DigitalstromRequests.WithLabelValues(method, endpoint, strconv.Itoa(resp.StatusCode)).Inc()
 	if resp.Body != nil {
 		defer resp.Body.Close()
 	}
 
 	responseBody, readErr := io.ReadAll(resp.Body)
+	if c.recorder != nil {
+		c.recorder.request(method, path, params.Encode(), jsonBody, resp.StatusCode, responseBody, readErr)
+	}
 	if readErr != nil {
 		return nil, fmt.Errorf("error reading the request: %w", err)
 	}
 
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("error response from server, httpStatus=%d: %w", resp.StatusCode, ErrUnauthorized)
+	}
 	if resp.StatusCode >= 300 {
 		return nil, fmt.Errorf("error response from server, httpStatus=%d: %s", resp.StatusCode, responseBody)
 	}
@@ -256,9 +416,13 @@ func (c *client) getRequest(path string, params url.Values) (interface{}, error)
 	if err != nil {
 		return nil, err
 	}
+	return decodeData(path, body)
+}
 
+// decodeData returns the content of the "data" field of a response.
+func decodeData(path string, body []byte) (interface{}, error) {
 	var jsonResponse map[string]interface{}
-	err = json.Unmarshal(body, &jsonResponse)
+	err := json.Unmarshal(body, &jsonResponse)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing response for path %s: %w", path, err)
 	}
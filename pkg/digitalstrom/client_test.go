@@ -0,0 +1,25 @@
+package digitalstrom
+
+import "testing"
+
+func TestFormatOutputValue(t *testing.T) {
+	tests := []struct {
+		value      float64
+		resolution float64
+		expected   string
+	}{
+		{42.6, 0, "43"},
+		{42.6, 0.1, "42.6"},
+		{42.549, 0.01, "42.55"},
+		{42.6, 0.5, "42.5"},
+		{10.25, 0.25, "10.25"},
+		{10.3, 0.25, "10.25"},
+		{42.63, 0.05, "42.65"},
+		{3012, 100, "3000"},
+	}
+	for _, test := range tests {
+		if formatted := formatOutputValue(test.value, test.resolution); formatted != test.expected {
+			t.Errorf("formatOutputValue(%g, %g) = %s, expected %s", test.value, test.resolution, formatted, test.expected)
+		}
+	}
+}
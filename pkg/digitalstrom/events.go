@@ -0,0 +1,177 @@
+package digitalstrom
+
+import (
+	"errors"
+	"sync"
+)
+
+// Event is a change in the apartment published by the registry. The handlers
+// use a type switch on the concrete event types below.
+type Event interface {
+	isEvent()
+}
+
+// OutputChanged is published when the target value of an output changed.
+type OutputChanged struct {
+	DeviceId        string
+	FunctionBlockId string
+	OutputId        string
+	OldValue        float64
+	NewValue        float64
+}
+
+// DeviceAdded is published when a device appears in the structure of the
+// apartment.
+type DeviceAdded struct {
+	Device Device
+}
+
+// DeviceRemoved is published when a device disappears from the structure of
+// the apartment.
+type DeviceRemoved struct {
+	Device Device
+}
+
+// DeviceRenamed is published when the name of a device changed.
+type DeviceRenamed struct {
+	DeviceId string
+	OldName  string
+	NewName  string
+}
+
+// SensorChanged is published when the value of a sensor input changed.
+type SensorChanged struct {
+	DeviceId      string
+	SensorInputId string
+	OldValue      float64
+	NewValue      float64
+}
+
+// ButtonChanged is published when the value of a button input changed.
+type ButtonChanged struct {
+	DeviceId      string
+	ButtonInputId string
+	OldValue      float64
+	NewValue      float64
+}
+
+// StateChanged is published when the value of a state of a device changed or
+// the state appeared.
+type StateChanged struct {
+	DeviceId string
+	StateId  string
+	OldValue string
+	NewValue string
+}
+
+// OperationsLockedChanged is published when the operations of a submodule of
+// a device were locked or unlocked.
+type OperationsLockedChanged struct {
+	DeviceId    string
+	SubmoduleId string
+	Locked      bool
+}
+
+// MeteringChanged is published when the value of a metering changed.
+type MeteringChanged struct {
+	MeteringId string
+	OldValue   float64
+	NewValue   float64
+}
+
+func (OutputChanged) isEvent()           {}
+func (DeviceAdded) isEvent()             {}
+func (DeviceRemoved) isEvent()           {}
+func (DeviceRenamed) isEvent()           {}
+func (SensorChanged) isEvent()           {}
+func (ButtonChanged) isEvent()           {}
+func (StateChanged) isEvent()            {}
+func (OperationsLockedChanged) isEvent() {}
+func (MeteringChanged) isEvent()         {}
+
+type EventHandler func(event Event)
+
+// eventBus delivers the events to several subscribers. Each subscriber has
+// its own goroutine receiving the events in the order they were published,
+// so that a slow handler neither blocks the publisher nor the other
+// subscribers.
+type eventBus struct {
+	mutex       sync.Mutex
+	subscribers map[string]*subscriber
+}
+
+type subscriber struct {
+	handler EventHandler
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queue   []Event
+	closed  bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: map[string]*subscriber{}}
+}
+
+func (b *eventBus) subscribe(subscriberId string, handler EventHandler) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, exists := b.subscribers[subscriberId]; exists {
+		return errors.New("Subscriber " + subscriberId + " already registered")
+	}
+	s := &subscriber{handler: handler}
+	s.cond = sync.NewCond(&s.mutex)
+	b.subscribers[subscriberId] = s
+	go s.deliver()
+	return nil
+}
+
+// Unsubscribes the subscriber, the events not delivered yet are dropped.
+func (b *eventBus) unsubscribe(subscriberId string) error {
+	b.mutex.Lock()
+	s, exists := b.subscribers[subscriberId]
+	delete(b.subscribers, subscriberId)
+	b.mutex.Unlock()
+	if !exists {
+		return errors.New("No subscriber registered with id " + subscriberId)
+	}
+	s.mutex.Lock()
+	s.closed = true
+	s.queue = nil
+	s.cond.Signal()
+	s.mutex.Unlock()
+	return nil
+}
+
+func (b *eventBus) publish(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, s := range b.subscribers {
+		s.mutex.Lock()
+		s.queue = append(s.queue, events...)
+		s.cond.Signal()
+		s.mutex.Unlock()
+	}
+}
+
+func (s *subscriber) deliver() {
+	for {
+		s.mutex.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mutex.Unlock()
+			return
+		}
+		events := s.queue
+		s.queue = nil
+		s.mutex.Unlock()
+
+		for _, event := range events {
+			s.handler(event)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package digitalstrom
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventBusDeliversToEverySubscriber(t *testing.T) {
+	bus := newEventBus()
+	block := make(chan struct{})
+	slow := make(chan Event, 10)
+	fast := make(chan Event, 10)
+	if err := bus.subscribe("slow", func(event Event) {
+		<-block
+		slow <- event
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.subscribe("fast", func(event Event) {
+		fast <- event
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.subscribe("fast", func(event Event) {}); err == nil {
+		t.Error("Expected an error subscribing twice")
+	}
+
+	first := OutputChanged{DeviceId: "a", OutputId: "brightness", NewValue: 50}
+	second := DeviceRenamed{DeviceId: "a", OldName: "Lamp", NewName: "Desk"}
+	bus.publish(first, second)
+
+	// The slow subscriber does not delay the others.
+	for _, expected := range []Event{first, second} {
+		select {
+		case event := <-fast:
+			if event != expected {
+				t.Errorf("Unexpected event %v, expected %v", event, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Event not delivered")
+		}
+	}
+	close(block)
+	for _, expected := range []Event{first, second} {
+		if event := <-slow; event != expected {
+			t.Errorf("Unexpected event %v, expected %v", event, expected)
+		}
+	}
+
+	if err := bus.unsubscribe("fast"); err != nil {
+		t.Fatal(err)
+	}
+	bus.publish(first)
+	select {
+	case event := <-fast:
+		t.Errorf("Unexpected event after unsubscribing: %v", event)
+	case <-slow:
+	}
+}
+
+func TestStructureChanges(t *testing.T) {
+	lamp := Device{DeviceId: "a", Attributes: DeviceAttributes{Name: "Lamp"}}
+	blind := Device{DeviceId: "b", Attributes: DeviceAttributes{Name: "Blind"}}
+	renamed := Device{DeviceId: "a", Attributes: DeviceAttributes{Name: "Desk"}}
+	added := Device{DeviceId: "c", Attributes: DeviceAttributes{Name: "Fan"}}
+
+	events := structureChanges(
+		map[string]Device{"a": lamp, "b": blind},
+		map[string]Device{"a": renamed, "c": added},
+	)
+	expected := []Event{
+		DeviceRenamed{DeviceId: "a", OldName: "Lamp", NewName: "Desk"},
+		DeviceAdded{Device: added},
+		DeviceRemoved{Device: blind},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Unexpected events %v", events)
+	}
+	for _, event := range expected {
+		found := false
+		for _, e := range events {
+			found = found || reflect.DeepEqual(e, event)
+		}
+		if !found {
+			t.Errorf("Missing event %v in %v", event, events)
+		}
+	}
+}
+
+func TestStateChanges(t *testing.T) {
+	old := DeviceStatus{DeviceId: "a", Attributes: DeviceStatusAttributes{
+		Submodules: []SubmoduleStatus{{SubmoduleId: "s1"}},
+		States:     []DeviceState{{StateId: "windowHandle", Value: "closed"}, {StateId: "smokeAlarm", Value: "inactive"}},
+	}}
+	updated := DeviceStatus{DeviceId: "a", Attributes: DeviceStatusAttributes{
+		Submodules: []SubmoduleStatus{{SubmoduleId: "s1", OperationsLocked: true}},
+		States:     []DeviceState{{StateId: "windowHandle", Value: "tilted"}, {StateId: "smokeAlarm", Value: "inactive"}, {StateId: "rain", Value: ""}},
+	}}
+
+	events := changeEvents(map[string]DeviceStatus{"a": old}, []DeviceStatus{updated})
+	expected := []Event{
+		StateChanged{DeviceId: "a", StateId: "windowHandle", OldValue: "closed", NewValue: "tilted"},
+		StateChanged{DeviceId: "a", StateId: "rain", OldValue: "", NewValue: ""},
+		OperationsLockedChanged{DeviceId: "a", SubmoduleId: "s1", Locked: true},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Unexpected events %v", events)
+	}
+}
@@ -1,19 +1,48 @@
 package digitalstrom
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
-// Returns the device type given its hardware technicalName
-func (functionBlock *FunctionBlock) DeviceType() DeviceType {
-	switch {
-	case strings.HasPrefix(functionBlock.Attributes.TechnicalName, "GE"):
+// Returns the device type given the application of the submodule of the
+// function block. The types of the outputs are used for the applications not
+// telling what the device drives, e.g. a joker relay switching a lamp.
+func (functionBlock *FunctionBlock) DeviceType(application SubmoduleApplication) DeviceType {
+	switch application {
+	case SubmoduleTypeLights:
 		return DeviceTypeLight
-	case strings.HasPrefix(functionBlock.Attributes.TechnicalName, "GR"):
+	case SubmoduleTypeShades:
 		return DeviceTypeBlind
-	case strings.HasPrefix(functionBlock.Attributes.TechnicalName, "SW"):
+	case SubmoduleTypeAwnings:
+		return DeviceTypeAwning
+	case SubmoduleTypeWindow:
+		return DeviceTypeWindow
+	case SubmoduleTypeHeating, SubmoduleTypeCooling, SubmoduleTypeTemperature:
+		return DeviceTypeHeating
+	case SubmoduleTypeVentilation, SubmoduleTypeRecirculation:
+		return DeviceTypeVentilation
+	}
+
+	for _, output := range functionBlock.Attributes.Outputs {
+		switch output.Attributes.Type {
+		case OutputTypeLightBrightness, OutputTypeLightHue, OutputTypeLightSaturation,
+			OutputTypeLightTemperature, OutputTypeLightCieX, OutputTypeLightCieY:
+			return DeviceTypeLight
+		case OutputTypeShadePositionOutside, OutputTypeShadePositionIndoor,
+			OutputTypeShadeOpeningAngleOutside, OutputTypeShadeOpeningAngleIndoor:
+			return DeviceTypeBlind
+		case OutputTypeHeatingPower, OutputTypeCoolingCapacity:
+			return DeviceTypeHeating
+		case OutputTypeAirFlowIntensity, OutputTypeAirFlowDirection, OutputTypeAirFlapOpeningAngle,
+			OutputTypeVentilationLouverPosition, OutputTypeVentilationSwingMode, OutputTypeVentilationAutoIntensity:
+			return DeviceTypeVentilation
+		}
+	}
+	if application == SubmoduleTypeJoker {
 		return DeviceTypeJoker
-	default:
-		return DeviceTypeUnknown
 	}
+	return DeviceTypeUnknown
 }
 
 // Properties a device can have and helps us better understand how it works.
@@ -48,3 +77,36 @@ func (functionBlock *FunctionBlock) Properties() DeviceProperties {
 		TiltChannel:     tiltChannel,
 	}
 }
+
+// Returns the target setting the output of the function block to the value,
+// with the resolution of the output.
+func (functionBlock *FunctionBlock) OutputTarget(outputId string, value float64) (OutputTarget, error) {
+	for _, output := range functionBlock.Attributes.Outputs {
+		if output.OutputId == outputId {
+			return OutputTarget{
+				FunctionBlockId: functionBlock.FunctionBlockId,
+				OutputId:        outputId,
+				Value:           value,
+				Resolution:      output.Attributes.Resolution,
+			}, nil
+		}
+	}
+	return OutputTarget{}, fmt.Errorf("no output '%s' in function block %s", outputId, functionBlock.FunctionBlockId)
+}
+
+// DeviceActionInvocation returns the invocation of an action of a device,
+// e.g. app.moveUp, in the application of its first submodule.
+func DeviceActionInvocation(registry Registry, device Device, actionId string) ScenarioInvocation {
+	invocation := ScenarioInvocation{
+		Context:  "deviceStandard",
+		ActionId: actionId,
+		Zone:     device.Attributes.Zone,
+		Device:   device.DeviceId,
+	}
+	if len(device.Attributes.Submodules) > 0 {
+		if submodule, err := registry.GetSubmodule(device.Attributes.Submodules[0]); err == nil {
+			invocation.Application = ScenarioApplication(submodule.Attributes.Application)
+		}
+	}
+	return invocation
+}
@@ -0,0 +1,34 @@
+package digitalstrom
+
+import "testing"
+
+func TestDeviceType(t *testing.T) {
+	withOutput := func(technicalName string, outputType OutputType) FunctionBlock {
+		functionBlock := FunctionBlock{}
+		functionBlock.Attributes.TechnicalName = technicalName
+		functionBlock.Attributes.Outputs = []Output{{Attributes: OutputAttributes{Type: outputType}}}
+		return functionBlock
+	}
+
+	tests := []struct {
+		name          string
+		functionBlock FunctionBlock
+		application   SubmoduleApplication
+		expected      DeviceType
+	}{
+		{"light", withOutput("GE-KM200", OutputTypeLightBrightness), SubmoduleTypeLights, DeviceTypeLight},
+		{"awning", withOutput("GR-KL200", OutputTypeShadePositionOutside), SubmoduleTypeAwnings, DeviceTypeAwning},
+		{"window", withOutput("GR-KL200", OutputTypeShadePositionOutside), SubmoduleTypeWindow, DeviceTypeWindow},
+		{"joker relay configured as light", withOutput("SW-KL200", OutputTypePowerState), SubmoduleTypeLights, DeviceTypeLight},
+		{"joker relay driving a lamp", withOutput("SW-KL200", OutputTypeLightBrightness), SubmoduleTypeJoker, DeviceTypeLight},
+		{"joker", withOutput("SW-TKM200", OutputTypePowerState), SubmoduleTypeJoker, DeviceTypeJoker},
+		{"heating actuator", withOutput("GN-KM200", OutputTypeHeatingPower), "", DeviceTypeHeating},
+		{"ventilation", withOutput("GN-KM200", OutputTypeAirFlowIntensity), SubmoduleTypeVentilation, DeviceTypeVentilation},
+		{"unknown", FunctionBlock{}, "", DeviceTypeUnknown},
+	}
+	for _, test := range tests {
+		if deviceType := test.functionBlock.DeviceType(test.application); deviceType != test.expected {
+			t.Errorf("%s: expected %s but got %s", test.name, test.expected, deviceType)
+		}
+	}
+}
@@ -7,9 +7,10 @@ import (
 
 // ClientOptions contains configurable options for a Digitalstrom Client.
 type ClientOptions struct {
-	Host   string
-	Port   int
-	ApiKey string
+	Host        string
+	Port        int
+	ApiKey      string
+	CaptureFile string
 }
 
 // NewClientOptions will create a new ClientClientOptions type with some
@@ -47,3 +48,11 @@ func (o *ClientOptions) SetApiKey(u string) *ClientOptions {
 	o.ApiKey = u
 	return o
 }
+
+// SetCaptureFile will set the file in which all the requests to the
+// DigitalStrom server and all the notifications are recorded. Nothing is
+// recorded when empty.
+func (o *ClientOptions) SetCaptureFile(path string) *ClientOptions {
+	o.CaptureFile = path
+	return o
+}
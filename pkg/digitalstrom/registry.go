@@ -2,57 +2,109 @@ package digitalstrom
 
 import (
 	"errors"
+	"fmt"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/metrics"
 	"github.com/rs/zerolog/log"
+	"slices"
 	"sync"
+	"sync/atomic"
 )
 
-type DeviceChangeCallback func(deviceId string, outputId string, oldValue float64, newValue float64)
-
 // Registry The registry hold the current structure of the appartement and the latest known state
 type Registry interface {
 	Start() error
 
 	Stop() error
 
+	// Reload fetches again the structure of the apartment and the meterings.
+	Reload() error
+
 	GetDevices() ([]Device, error)
 
 	GetDevice(deviceId string) (Device, error)
 
+	// GetFunctionBlockForDevice returns the function block of a device,
+	// failing when the device has several of them.
 	GetFunctionBlockForDevice(deviceId string) (FunctionBlock, error)
+	// GetFunctionBlocksOfDevice returns the function blocks of all the
+	// submodules of a device, e.g. the two channels of a dual relay.
+	GetFunctionBlocksOfDevice(deviceId string) ([]FunctionBlock, error)
 
 	GetOutputsOfDevice(deviceId string) ([]Output, error)
 	GetOutputValuesOfDevice(deviceId string) ([]OutputValue, error)
+	GetOutputValuesOfFunctionBlock(deviceId string, functionBlockId string) ([]OutputValue, error)
+
+	// GetStatesOfDevice returns the states of a device, e.g. the position of a
+	// window handle.
+	GetStatesOfDevice(deviceId string) ([]DeviceState, error)
+	// GetSubmoduleStatusOfDevice returns the status of the submodules of a
+	// device, telling whether their operations are locked.
+	GetSubmoduleStatusOfDevice(deviceId string) ([]SubmoduleStatus, error)
+
+	GetZones() ([]Zone, error)
+	GetZone(zoneId string) (Zone, error)
+	GetSubmodule(submoduleId string) (Submodule, error)
+	// GetSubmoduleOfFunctionBlock returns the submodule of a function block,
+	// the one listing the function block when not referenced by it.
+	GetSubmoduleOfFunctionBlock(functionBlock FunctionBlock) (Submodule, error)
+	// GetDeviceType returns the type of a function block, given the
+	// application of its submodule and the types of its outputs.
+	GetDeviceType(functionBlock FunctionBlock) DeviceType
 
 	GetControllers() ([]Controller, error)
 	GetControllerById(controllerId string) (Controller, error)
 	GetMeterings() ([]Metering, error)
 
-	DeviceChangeSubscribe(deviceId string, callback DeviceChangeCallback) error
-	DeviceChangeUnsubscribe(deviceId string) error
-}
+	// UpdateMeteringValues records the latest values of the meterings,
+	// publishing a MeteringChanged event for the ones which changed.
+	UpdateMeteringValues(values []MeteringValue)
 
-type registry struct {
-	digitalstromClient Client
+	// Subscribe registers a handler receiving all the events of the registry.
+	// The events are delivered asynchronously and in order, on a goroutine
+	// per subscriber.
+	Subscribe(subscriberId string, handler EventHandler) error
+	Unsubscribe(subscriberId string) error
+}
 
+// snapshot is the state of the apartment at a given time. It is never
+// modified once stored in the registry, the updates creating a new snapshot
+// instead, so that it can be read without locking.
+type snapshot struct {
 	apartment       *Apartment
 	apartmentStatus *ApartmentStatus
 	meterings       *Meterings
+	meteringValues  map[string]float64
 
 	controllersLookup    map[string]Controller
+	zonesLookup          map[string]Zone
 	devicesLookup        map[string]Device
 	submoduleLookup      map[string]Submodule
 	functionBlocksLookup map[string]FunctionBlock
+	// Status of the devices by id.
+	statusLookup map[string]DeviceStatus
+}
 
-	deviceChangeCallbacks map[string]DeviceChangeCallback
+type registry struct {
+	digitalstromClient Client
 
-	registryLoading sync.Mutex
+	current atomic.Pointer[snapshot]
+	// Serializes the updates of the snapshot.
+	updating        sync.Mutex
+	statusRefresher *statusRefresher
+	events          *eventBus
 }
 
 func NewRegistry(digitalstromClient Client) Registry {
-	return &registry{
-		digitalstromClient:    digitalstromClient,
-		deviceChangeCallbacks: make(map[string]DeviceChangeCallback),
+	r := &registry{
+		digitalstromClient: digitalstromClient,
+		events:             newEventBus(),
 	}
+	r.current.Store(&snapshot{
+		apartment: &Apartment{},
+		meterings: &Meterings{},
+	})
+	r.statusRefresher = newStatusRefresher(r.updateDevicesStatusAndFireChangeEvents, r.updateApartmentStatusAndFireChangeEvents)
+	return r
 }
 
 func (r *registry) Start() error {
@@ -68,8 +120,8 @@ func (r *registry) Start() error {
 	}
 	callback := func(notification WebsocketNotification) {
 		// TODO handle structure changes
-		if err := r.updateApartmentStatusAndFireChangeEvents(); err != nil {
-			log.Err(err).Msg("Error updating apartment status")
+		for _, argument := range notification.Arguments {
+			r.statusRefresher.request(argument.DeviceId)
 		}
 	}
 	if err := r.digitalstromClient.NotificationSubscribe("registry", callback); err != nil {
@@ -82,12 +134,23 @@ func (r *registry) Stop() error {
 	return nil
 }
 
+func (r *registry) Reload() error {
+	log.Info().Msg("Reloading registry")
+	if err := r.updateApartment(); err != nil {
+		return err
+	}
+	if err := r.updateMeterings(); err != nil {
+		return err
+	}
+	return r.updateApartmentStatusAndFireChangeEvents()
+}
+
 func (r *registry) GetDevices() ([]Device, error) {
-	return r.apartment.Included.Devices, nil
+	return r.current.Load().apartment.Included.Devices, nil
 }
 
 func (r *registry) GetDevice(deviceId string) (Device, error) {
-	device, ok := r.devicesLookup[deviceId]
+	device, ok := r.current.Load().devicesLookup[deviceId]
 	if ok {
 		return device, nil
 	}
@@ -95,16 +158,17 @@ func (r *registry) GetDevice(deviceId string) (Device, error) {
 }
 
 func (r *registry) GetOutputsOfDevice(deviceId string) ([]Output, error) {
-	device, err := r.GetDevice(deviceId)
-	if err != nil {
-		return nil, err
+	current := r.current.Load()
+	device, ok := current.devicesLookup[deviceId]
+	if !ok {
+		return nil, errors.New("No device found with id " + deviceId)
 	}
 
 	outputs := []Output{}
 	for _, submoduleId := range device.Attributes.Submodules {
-		submodule := r.submoduleLookup[submoduleId]
+		submodule := current.submoduleLookup[submoduleId]
 		for _, functionBlockId := range submodule.Attributes.FunctionBlocks {
-			functionBlock := r.functionBlocksLookup[functionBlockId]
+			functionBlock := current.functionBlocksLookup[functionBlockId]
 			for _, output := range functionBlock.Attributes.Outputs {
 				outputs = append(outputs, output)
 			}
@@ -116,12 +180,10 @@ func (r *registry) GetOutputsOfDevice(deviceId string) ([]Output, error) {
 
 func (r *registry) GetOutputValuesOfDevice(deviceId string) ([]OutputValue, error) {
 	outputs := []OutputValue{}
-	for _, device := range r.apartmentStatus.Included.Devices {
-		if device.DeviceId == deviceId {
-			for _, functionBlockValue := range device.Attributes.FunctionBlocks {
-				for _, outputValue := range functionBlockValue.Outputs {
-					outputs = append(outputs, outputValue)
-				}
+	if device, ok := r.current.Load().statusLookup[deviceId]; ok {
+		for _, functionBlockValue := range device.Attributes.FunctionBlocks {
+			for _, outputValue := range functionBlockValue.Outputs {
+				outputs = append(outputs, outputValue)
 			}
 		}
 	}
@@ -129,38 +191,115 @@ func (r *registry) GetOutputValuesOfDevice(deviceId string) ([]OutputValue, erro
 	return outputs, nil
 }
 
-func (r *registry) GetFunctionBlockForDevice(deviceId string) (FunctionBlock, error) {
-	device, err := r.GetDevice(deviceId)
-	if err != nil {
-		return FunctionBlock{}, err
+func (r *registry) GetOutputValuesOfFunctionBlock(deviceId string, functionBlockId string) ([]OutputValue, error) {
+	outputs := []OutputValue{}
+	if device, ok := r.current.Load().statusLookup[deviceId]; ok {
+		for _, functionBlockValue := range device.Attributes.FunctionBlocks {
+			if functionBlockValue.FunctionBlockId == functionBlockId {
+				outputs = append(outputs, functionBlockValue.Outputs...)
+			}
+		}
+	}
+
+	return outputs, nil
+}
+
+func (r *registry) GetStatesOfDevice(deviceId string) ([]DeviceState, error) {
+	states := []DeviceState{}
+	if device, ok := r.current.Load().statusLookup[deviceId]; ok {
+		states = append(states, device.Attributes.States...)
+	}
+	return states, nil
+}
+
+func (r *registry) GetSubmoduleStatusOfDevice(deviceId string) ([]SubmoduleStatus, error) {
+	submodules := []SubmoduleStatus{}
+	if device, ok := r.current.Load().statusLookup[deviceId]; ok {
+		submodules = append(submodules, device.Attributes.Submodules...)
 	}
+	return submodules, nil
+}
 
-	var functionBlocks []FunctionBlock
+func (r *registry) GetFunctionBlocksOfDevice(deviceId string) ([]FunctionBlock, error) {
+	current := r.current.Load()
+	device, ok := current.devicesLookup[deviceId]
+	if !ok {
+		return nil, errors.New("No device found with id " + deviceId)
+	}
 
+	functionBlocks := []FunctionBlock{}
 	for _, submoduleId := range device.Attributes.Submodules {
-		submodule := r.submoduleLookup[submoduleId]
+		submodule := current.submoduleLookup[submoduleId]
 		for _, functionBlockId := range submodule.Attributes.FunctionBlocks {
-			functionBlock := r.functionBlocksLookup[functionBlockId]
+			functionBlock := current.functionBlocksLookup[functionBlockId]
 			functionBlocks = append(functionBlocks, functionBlock)
 		}
 	}
+	return functionBlocks, nil
+}
+
+func (r *registry) GetFunctionBlockForDevice(deviceId string) (FunctionBlock, error) {
+	functionBlocks, err := r.GetFunctionBlocksOfDevice(deviceId)
+	if err != nil {
+		return FunctionBlock{}, err
+	}
 
 	length := len(functionBlocks)
 	if length == 0 {
-		return FunctionBlock{}, errors.New("Multiple function blocks found for device " + deviceId)
+		return FunctionBlock{}, errors.New("No function block found for device " + deviceId)
 	}
 	if length > 1 {
-		return FunctionBlock{}, errors.New("No function block found for device " + deviceId)
+		return FunctionBlock{}, errors.New("Multiple function blocks found for device " + deviceId)
 	}
 	return functionBlocks[0], nil
 }
 
+func (r *registry) GetZones() ([]Zone, error) {
+	return r.current.Load().apartment.Included.Zones, nil
+}
+
+func (r *registry) GetSubmodule(submoduleId string) (Submodule, error) {
+	submodule, ok := r.current.Load().submoduleLookup[submoduleId]
+	if ok {
+		return submodule, nil
+	}
+	return Submodule{}, errors.New("No submodule found with id " + submoduleId)
+}
+
+func (r *registry) GetSubmoduleOfFunctionBlock(functionBlock FunctionBlock) (Submodule, error) {
+	current := r.current.Load()
+	if submodule, ok := current.submoduleLookup[functionBlock.Attributes.Submodule]; ok {
+		return submodule, nil
+	}
+	// Submodule not referenced by the function block.
+	for _, submodule := range current.submoduleLookup {
+		if slices.Contains(submodule.Attributes.FunctionBlocks, functionBlock.FunctionBlockId) {
+			return submodule, nil
+		}
+	}
+	return Submodule{}, errors.New("No submodule found for function block " + functionBlock.FunctionBlockId)
+}
+
+func (r *registry) GetDeviceType(functionBlock FunctionBlock) DeviceType {
+	// The type is inferred from the outputs when the submodule is unknown.
+	submodule, _ := r.GetSubmoduleOfFunctionBlock(functionBlock)
+	return functionBlock.DeviceType(submodule.Attributes.Application)
+}
+
+func (r *registry) GetZone(zoneId string) (Zone, error) {
+	zone, ok := r.current.Load().zonesLookup[zoneId]
+	if ok {
+		return zone, nil
+	}
+	return Zone{}, errors.New("No zone found with id " + zoneId)
+}
+
 func (r *registry) GetControllers() ([]Controller, error) {
-	return r.apartment.Included.Controllers, nil
+	return r.current.Load().apartment.Included.Controllers, nil
 }
 
 func (r *registry) GetControllerById(controllerId string) (Controller, error) {
-	controller, ok := r.controllersLookup[controllerId]
+	controller, ok := r.current.Load().controllersLookup[controllerId]
 	if ok {
 		return controller, nil
 	}
@@ -168,115 +307,283 @@ func (r *registry) GetControllerById(controllerId string) (Controller, error) {
 }
 
 func (r *registry) GetMeterings() ([]Metering, error) {
-	return r.meterings.Meterings, nil
+	return r.current.Load().meterings.Meterings, nil
 }
 
-func (r *registry) updateApartment() error {
-	r.registryLoading.Lock()
-	defer r.registryLoading.Unlock()
+func (r *registry) Subscribe(subscriberId string, handler EventHandler) error {
+	return r.events.subscribe(subscriberId, handler)
+}
+
+func (r *registry) Unsubscribe(subscriberId string) error {
+	return r.events.unsubscribe(subscriberId)
+}
 
+// Stores the snapshot modified by the update, which receives a copy of the
+// current one, then publishes the events returned. The lookup maps must be
+// replaced, not modified.
+func (r *registry) update(update func(next *snapshot) ([]Event, error)) error {
+	r.updating.Lock()
+	defer r.updating.Unlock()
+	next := *r.current.Load()
+	events, err := update(&next)
+	if err != nil {
+		return err
+	}
+	r.current.Store(&next)
+	// Published once stored for the subscribers to read the new state.
+	r.events.publish(events...)
+	return nil
+}
+
+func (r *registry) updateApartment() error {
 	apartment, err := r.digitalstromClient.GetApartment()
 	if err != nil {
 		return err
 	}
 
-	r.apartment = apartment
+	return r.update(func(next *snapshot) ([]Event, error) {
+		previous := next.devicesLookup
+		next.apartment = apartment
 
-	r.controllersLookup = make(map[string]Controller)
-	r.devicesLookup = make(map[string]Device)
-	r.submoduleLookup = make(map[string]Submodule)
-	r.functionBlocksLookup = make(map[string]FunctionBlock)
+		next.controllersLookup = make(map[string]Controller)
+		next.zonesLookup = make(map[string]Zone)
+		next.devicesLookup = make(map[string]Device)
+		next.submoduleLookup = make(map[string]Submodule)
+		next.functionBlocksLookup = make(map[string]FunctionBlock)
 
-	// Create lookup tables for fast access.
-	for _, controller := range apartment.Included.Controllers {
-		r.controllersLookup[controller.ControllerId] = controller
-	}
-	for _, device := range apartment.Included.Devices {
-		r.devicesLookup[device.DeviceId] = device
-	}
-	for _, submodule := range apartment.Included.Submodules {
-		r.submoduleLookup[submodule.SubmoduleId] = submodule
+		// Create lookup tables for fast access.
+		for _, controller := range apartment.Included.Controllers {
+			next.controllersLookup[controller.ControllerId] = controller
+		}
+		for _, zone := range apartment.Included.Zones {
+			next.zonesLookup[zone.ZoneId] = zone
+		}
+		for _, device := range apartment.Included.Devices {
+			next.devicesLookup[device.DeviceId] = device
+		}
+		for _, submodule := range apartment.Included.Submodules {
+			next.submoduleLookup[submodule.SubmoduleId] = submodule
+		}
+		for _, functionBlock := range apartment.Included.FunctionBlocks {
+			next.functionBlocksLookup[functionBlock.FunctionBlockId] = functionBlock
+		}
+
+		metrics.RegistrySize.WithLabelValues("devices").Set(float64(len(next.devicesLookup)))
+		metrics.RegistrySize.WithLabelValues("zones").Set(float64(len(next.zonesLookup)))
+		metrics.RegistrySize.WithLabelValues("controllers").Set(float64(len(next.controllersLookup)))
+		metrics.RegistrySize.WithLabelValues("functionBlocks").Set(float64(len(next.functionBlocksLookup)))
+
+		if previous == nil {
+			return nil, nil
+		}
+		return structureChanges(previous, next.devicesLookup), nil
+	})
+}
+
+// Returns the devices added, removed and renamed.
+func structureChanges(previous map[string]Device, devices map[string]Device) []Event {
+	events := []Event{}
+	for deviceId, device := range devices {
+		old, ok := previous[deviceId]
+		if !ok {
+			events = append(events, DeviceAdded{Device: device})
+		} else if old.Attributes.Name != device.Attributes.Name {
+			events = append(events, DeviceRenamed{DeviceId: deviceId, OldName: old.Attributes.Name, NewName: device.Attributes.Name})
+		}
 	}
-	for _, functionBlock := range apartment.Included.FunctionBlocks {
-		r.functionBlocksLookup[functionBlock.FunctionBlockId] = functionBlock
+	for deviceId, device := range previous {
+		if _, ok := devices[deviceId]; !ok {
+			events = append(events, DeviceRemoved{Device: device})
+		}
 	}
-
-	return nil
+	return events
 }
 
 func (r *registry) updateMeterings() error {
-	r.registryLoading.Lock()
-	defer r.registryLoading.Unlock()
-
 	meterings, err := r.digitalstromClient.GetMeterings()
 	if err != nil {
 		return err
 	}
 
-	r.meterings = meterings
-
-	return nil
-}
-
-func (r *registry) DeviceChangeSubscribe(deviceId string, callback DeviceChangeCallback) error {
-	_, exists := r.deviceChangeCallbacks[deviceId]
-	if exists {
-		return errors.New("Callback already registered for device " + deviceId)
-	}
-	r.deviceChangeCallbacks[deviceId] = callback
-	return nil
+	return r.update(func(next *snapshot) ([]Event, error) {
+		next.meterings = meterings
+		metrics.RegistrySize.WithLabelValues("meterings").Set(float64(len(meterings.Meterings)))
+		return nil, nil
+	})
 }
 
-func (r *registry) DeviceChangeUnsubscribe(deviceId string) error {
-	_, exists := r.deviceChangeCallbacks[deviceId]
-	if !exists {
-		return errors.New("No callback registered for device " + deviceId)
-	}
-	delete(r.deviceChangeCallbacks, deviceId)
-	return nil
+func (r *registry) UpdateMeteringValues(values []MeteringValue) {
+	_ = r.update(func(next *snapshot) ([]Event, error) {
+		previous := next.meteringValues
+		next.meteringValues = make(map[string]float64, len(values))
+		events := []Event{}
+		for _, value := range values {
+			next.meteringValues[value.Id] = value.Attributes.Value
+			if old, ok := previous[value.Id]; !ok || old != value.Attributes.Value {
+				events = append(events, MeteringChanged{MeteringId: value.Id, OldValue: old, NewValue: value.Attributes.Value})
+			}
+		}
+		return events, nil
+	})
 }
 
 func (r *registry) updateApartmentStatusAndFireChangeEvents() error {
-	oldStatus := r.apartmentStatus
 	newStatus, err := r.digitalstromClient.GetApartmentStatus()
 	if err != nil {
 		return err
 	}
-	r.apartmentStatus = newStatus
 
-	if oldStatus != nil {
-		// Check diff and broadcast events
+	return r.update(func(next *snapshot) ([]Event, error) {
+		oldStatus := next.statusLookup
+		next.apartmentStatus = newStatus
+		next.statusLookup = make(map[string]DeviceStatus, len(newStatus.Included.Devices))
+		for _, device := range newStatus.Included.Devices {
+			next.statusLookup[device.DeviceId] = device
+		}
+
+		if oldStatus == nil {
+			return nil, nil
+		}
+		return changeEvents(oldStatus, newStatus.Included.Devices), nil
+	})
+}
+
+// Fetches the status of the given devices only and broadcasts their changes.
+func (r *registry) updateDevicesStatusAndFireChangeEvents(deviceIds []string) error {
+	devices := make([]DeviceStatus, 0, len(deviceIds))
+	for _, deviceId := range deviceIds {
+		device, err := r.digitalstromClient.GetDeviceStatus(deviceId)
+		if err != nil {
+			return fmt.Errorf("error getting the status of device %s: %w", deviceId, err)
+		}
+		devices = append(devices, *device)
+	}
+
+	return r.update(func(next *snapshot) ([]Event, error) {
+		oldStatus := next.statusLookup
+		if next.apartmentStatus == nil {
+			return nil, errors.New("apartment status not loaded yet")
+		}
+		newStatus := &ApartmentStatus{
+			ApartmentId: next.apartmentStatus.ApartmentId,
+			Included: ApartmentStatusIncluded{
+				Devices: slices.Clone(next.apartmentStatus.Included.Devices),
+			},
+		}
+		next.statusLookup = make(map[string]DeviceStatus, len(oldStatus)+len(devices))
+		for deviceId, device := range oldStatus {
+			next.statusLookup[deviceId] = device
+		}
+		for _, device := range devices {
+			index := slices.IndexFunc(newStatus.Included.Devices, func(d DeviceStatus) bool {
+				return d.DeviceId == device.DeviceId
+			})
+			if index < 0 {
+				newStatus.Included.Devices = append(newStatus.Included.Devices, device)
+			} else {
+				newStatus.Included.Devices[index] = device
+			}
+			next.statusLookup[device.DeviceId] = device
+		}
+		next.apartmentStatus = newStatus
+
+		return changeEvents(oldStatus, devices), nil
+	})
+}
 
-		oldStatusLookup := make(map[string]map[string]OutputValue)
-		for _, device := range oldStatus.Included.Devices {
-			oldStatusLookup[device.DeviceId] = make(map[string]OutputValue)
-			for _, functionBlock := range device.Attributes.FunctionBlocks {
-				for _, output := range functionBlock.Outputs {
-					oldStatusLookup[device.DeviceId][output.OutputId] = output
+// Returns the changes of the outputs, inputs, states and locks of the devices
+// compared to the old status.
+func changeEvents(oldStatus map[string]DeviceStatus, devices []DeviceStatus) []Event {
+	events := []Event{}
+	for _, device := range devices {
+		// Values by function block and id.
+		oldOutputs := map[string]float64{}
+		oldSensors := map[string]float64{}
+		oldButtons := map[string]float64{}
+		for _, functionBlock := range oldStatus[device.DeviceId].Attributes.FunctionBlocks {
+			for _, output := range functionBlock.Outputs {
+				oldOutputs[functionBlock.FunctionBlockId+"/"+output.OutputId] = output.TargetValue
+			}
+			for _, input := range functionBlock.SensorInputs {
+				oldSensors[functionBlock.FunctionBlockId+"/"+input.InputId] = input.Value
+			}
+			for _, input := range functionBlock.ButtonInputs {
+				oldButtons[functionBlock.FunctionBlockId+"/"+input.InputId] = input.Value
+			}
+		}
+
+		for _, state := range device.Attributes.States {
+			oldValue, found := "", false
+			for _, oldState := range oldStatus[device.DeviceId].Attributes.States {
+				if oldState.StateId == state.StateId {
+					oldValue, found = oldState.Value, true
+				}
+			}
+			if !found || oldValue != state.Value {
+				events = append(events, StateChanged{
+					DeviceId: device.DeviceId,
+					StateId:  state.StateId,
+					OldValue: oldValue,
+					NewValue: state.Value,
+				})
+			}
+		}
+		for _, submodule := range device.Attributes.Submodules {
+			oldLocked := false
+			for _, oldSubmodule := range oldStatus[device.DeviceId].Attributes.Submodules {
+				if oldSubmodule.SubmoduleId == submodule.SubmoduleId {
+					oldLocked = oldSubmodule.OperationsLocked
 				}
 			}
+			if oldLocked != submodule.OperationsLocked {
+				events = append(events, OperationsLockedChanged{
+					DeviceId:    device.DeviceId,
+					SubmoduleId: submodule.SubmoduleId,
+					Locked:      submodule.OperationsLocked,
+				})
+			}
 		}
 
-		for _, device := range newStatus.Included.Devices {
-			for _, functionBlock := range device.Attributes.FunctionBlocks {
-				for _, newOutput := range functionBlock.Outputs {
-					oldOutput := oldStatusLookup[device.DeviceId][newOutput.OutputId]
-					if oldOutput.TargetValue != newOutput.TargetValue {
-						log.Info().
-							Str("DeviceId", device.DeviceId).
-							Str("Output", newOutput.OutputId).
-							Float64("oldValue", oldOutput.TargetValue).
-							Float64("newValue", newOutput.TargetValue).
-							Msg("Output value changed")
-
-						callback, exists := r.deviceChangeCallbacks[device.DeviceId]
-						if exists {
-							callback(device.DeviceId, newOutput.OutputId, oldOutput.TargetValue, newOutput.TargetValue)
-						}
-					}
+		for _, functionBlock := range device.Attributes.FunctionBlocks {
+			for _, newOutput := range functionBlock.Outputs {
+				oldValue := oldOutputs[functionBlock.FunctionBlockId+"/"+newOutput.OutputId]
+				if oldValue != newOutput.TargetValue {
+					log.Info().
+						Str("DeviceId", device.DeviceId).
+						Str("Output", newOutput.OutputId).
+						Float64("oldValue", oldValue).
+						Float64("newValue", newOutput.TargetValue).
+						Msg("Output value changed")
+					events = append(events, OutputChanged{
+						DeviceId:        device.DeviceId,
+						FunctionBlockId: functionBlock.FunctionBlockId,
+						OutputId:        newOutput.OutputId,
+						OldValue:        oldValue,
+						NewValue:        newOutput.TargetValue,
+					})
+				}
+			}
+			for _, input := range functionBlock.SensorInputs {
+				if oldValue := oldSensors[functionBlock.FunctionBlockId+"/"+input.InputId]; oldValue != input.Value {
+					events = append(events, SensorChanged{
+						DeviceId:      device.DeviceId,
+						SensorInputId: input.InputId,
+						OldValue:      oldValue,
+						NewValue:      input.Value,
+					})
+				}
+			}
+			for _, input := range functionBlock.ButtonInputs {
+				if oldValue := oldButtons[functionBlock.FunctionBlockId+"/"+input.InputId]; oldValue != input.Value {
+					events = append(events, ButtonChanged{
+						DeviceId:      device.DeviceId,
+						ButtonInputId: input.InputId,
+						OldValue:      oldValue,
+						NewValue:      input.Value,
+					})
 				}
 			}
 		}
 	}
-	return nil
+	return events
 }
@@ -0,0 +1,273 @@
+package digitalstrom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// replayClient implements the Client interface by replaying a capture file
+// instead of talking to a dSS. Responses are served in the recorded order for
+// every request, the last one being repeated when exhausted, and the
+// notifications are replayed at the recorded pace, starting when the first
+// callback is subscribed so that the registry does not miss them. Requests
+// modifying the installation are logged and answered with the recorded
+// response if any.
+type replayClient struct {
+	captureFile string
+
+	responses     map[string][]CaptureEntry
+	notifications []CaptureEntry
+
+	connected        atomic.Bool
+	lastNotification atomic.Int64
+	stop             chan struct{}
+
+	// Guards the responses, the callbacks and the start of the replay.
+	mutex                 sync.Mutex
+	notificationCallbacks map[string]NotificationCallback
+	replaying             bool
+}
+
+// NewReplayClient creates a client replaying the given capture file. The file
+// is read when calling Connect.
+func NewReplayClient(captureFile string) Client {
+	return &replayClient{
+		captureFile:           captureFile,
+		responses:             map[string][]CaptureEntry{},
+		notificationCallbacks: map[string]NotificationCallback{},
+	}
+}
+
+func requestKey(method string, path string, query string) string {
+	return method + " " + path + "?" + query
+}
+
+func (c *replayClient) Connect() error {
+	entries, err := ReadCapture(c.captureFile)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		switch entry.Type {
+		case CaptureEntryRequest:
+			key := requestKey(entry.Method, entry.Path, entry.Query)
+			c.responses[key] = append(c.responses[key], entry)
+		case CaptureEntryNotification:
+			c.notifications = append(c.notifications, entry)
+		}
+	}
+	log.Info().
+		Str("file", c.captureFile).
+		Int("requests", len(entries)-len(c.notifications)).
+		Int("notifications", len(c.notifications)).
+		Msg("Replaying capture")
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stop = make(chan struct{})
+	c.connected.Store(true)
+	c.replaying = false
+	if len(c.notificationCallbacks) > 0 {
+		c.startReplay()
+	}
+	return nil
+}
+
+// Starts replaying the notifications, once connected and a callback is
+// subscribed. Must be called with the mutex held.
+func (c *replayClient) startReplay() {
+	if c.replaying || !c.connected.Load() {
+		return
+	}
+	c.replaying = true
+	go c.replayNotifications(c.stop)
+}
+
+func (c *replayClient) Disconnect() error {
+	if c.connected.CompareAndSwap(true, false) {
+		close(c.stop)
+	}
+	return nil
+}
+
+func (c *replayClient) replayNotifications(stop chan struct{}) {
+	for i, entry := range c.notifications {
+		if i > 0 {
+			select {
+			case <-time.After(entry.Time.Sub(c.notifications[i-1].Time)):
+			case <-stop:
+				return
+			}
+		}
+		var notification WebsocketNotification
+		if err := json.Unmarshal(entry.Notification, &notification); err != nil {
+			log.Warn().Err(err).Msg("Skipping invalid notification from capture")
+			continue
+		}
+		c.lastNotification.Store(time.Now().UnixNano())
+		for _, callback := range c.callbacks() {
+			callback(notification)
+		}
+	}
+	log.Info().Msg("All the notifications of the capture were replayed")
+}
+
+// Returns a copy of the callbacks, called without holding the mutex as they
+// may subscribe or unsubscribe.
+func (c *replayClient) callbacks() []NotificationCallback {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	callbacks := make([]NotificationCallback, 0, len(c.notificationCallbacks))
+	for _, callback := range c.notificationCallbacks {
+		callbacks = append(callbacks, callback)
+	}
+	return callbacks
+}
+
+// Returns the next recorded response for the request.
+func (c *replayClient) doRequest(method string, path string, params url.Values) ([]byte, error) {
+	key := requestKey(method, path, params.Encode())
+	c.mutex.Lock()
+	responses := c.responses[key]
+	var entry *CaptureEntry
+	if len(responses) > 0 {
+		entry = &responses[0]
+		if len(responses) > 1 {
+			c.responses[key] = responses[1:]
+		}
+	}
+	c.mutex.Unlock()
+
+	if method != http.MethodGet {
+		log.Info().Str("method", method).Str("path", path).Msg("Replayed request not sent to any dSS")
+	}
+	if entry == nil {
+		if method != http.MethodGet {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("no response recorded for %s", key)
+	}
+	if entry.Error != "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnreachable, entry.Error)
+	}
+	if entry.Status == http.StatusUnauthorized || entry.Status == http.StatusForbidden {
+		return nil, fmt.Errorf("error response from server, httpStatus=%d: %w", entry.Status, ErrUnauthorized)
+	}
+	if entry.Status >= 300 {
+		return nil, fmt.Errorf("error response from server, httpStatus=%d: %s", entry.Status, entry.ResponseBody)
+	}
+	return entry.ResponseBody, nil
+}
+
+func (c *replayClient) getRequest(path string, params url.Values) (interface{}, error) {
+	body, err := c.doRequest(http.MethodGet, path, params)
+	if err != nil {
+		return nil, err
+	}
+	return decodeData(path, body)
+}
+
+func (c *replayClient) GetApartment() (*Apartment, error) {
+	response, err := c.getRequest("api/v1/apartment", apartmentParams())
+	return wrapApiResponse[Apartment](response, err)
+}
+
+func (c *replayClient) GetApartmentRaw() ([]byte, error) {
+	return c.doRequest(http.MethodGet, "api/v1/apartment", apartmentParams())
+}
+
+func (c *replayClient) GetApartmentStatus() (*ApartmentStatus, error) {
+	response, err := c.getRequest("api/v1/apartment/status", apartmentStatusParams())
+	return wrapApiResponse[ApartmentStatus](response, err)
+}
+
+func (c *replayClient) GetDeviceStatus(deviceId string) (*DeviceStatus, error) {
+	response, err := c.getRequest(fmt.Sprintf("api/v1/apartment/dsDevices/%s/status", deviceId), nil)
+	return wrapApiResponse[DeviceStatus](response, err)
+}
+
+func (c *replayClient) GetApartmentStatusRaw() ([]byte, error) {
+	return c.doRequest(http.MethodGet, "api/v1/apartment/status", apartmentStatusParams())
+}
+
+func (c *replayClient) GetMeterings() (*Meterings, error) {
+	response, err := c.getRequest("api/v1/apartment/meterings", nil)
+	return wrapApiResponse[Meterings](response, err)
+}
+
+func (c *replayClient) GetMeteringStatus() (*MeteringValues, error) {
+	response, err := c.getRequest("api/v1/apartment/meterings/values", nil)
+	return wrapApiResponse[MeteringValues](response, err)
+}
+
+func (c *replayClient) GetScenarios() ([]Scenarios, error) {
+	response, err := c.getRequest("api/v1/apartment/scenarios", nil)
+	scenarios, err := wrapApiResponse[[]Scenarios](response, err)
+	if err != nil {
+		return nil, err
+	}
+	return *scenarios, nil
+}
+
+// Ping always succeeds as the capture plays the role of the dSS.
+func (c *replayClient) Ping() error {
+	return nil
+}
+
+func (c *replayClient) DeviceSetOutputValue(deviceId string, functionBlockId string, outputId string, value float64) error {
+	_, err := c.doRequest(http.MethodPatch, fmt.Sprintf("api/v1/apartment/dsDevices/%s/status", deviceId), nil)
+	return err
+}
+
+func (c *replayClient) DeviceSetOutputValues(deviceId string, targets []OutputTarget) error {
+	_, err := c.doRequest(http.MethodPatch, fmt.Sprintf("api/v1/apartment/dsDevices/%s/status", deviceId), nil)
+	return err
+}
+
+func (c *replayClient) InvokeScenario(invocation ScenarioInvocation) error {
+	_, err := c.doRequest(http.MethodPost, "api/v1/apartment/scenarios/invoke", nil)
+	return err
+}
+
+func (c *replayClient) NotificationSubscribe(id string, callback NotificationCallback) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, exists := c.notificationCallbacks[id]
+	if exists {
+		return errors.New("Notification callback with id " + id + " already exists")
+	}
+	c.notificationCallbacks[id] = callback
+	c.startReplay()
+	return nil
+}
+
+func (c *replayClient) NotificationUnsubscribe(id string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, exists := c.notificationCallbacks[id]
+	if !exists {
+		return errors.New("Notification callback with id " + id + " does not exist")
+	}
+	delete(c.notificationCallbacks, id)
+	return nil
+}
+
+func (c *replayClient) WebsocketConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *replayClient) LastNotification() time.Time {
+	last := c.lastNotification.Load()
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
@@ -0,0 +1,98 @@
+package digitalstrom
+
+import (
+	"github.com/rs/zerolog/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Delay without notification before refreshing the status, a scene
+	// moving many devices sending a burst of notifications.
+	STATUS_REFRESH_DEBOUNCE = 250 * time.Millisecond
+	// Maximum delay between a notification and the refresh, even if the
+	// notifications keep coming.
+	STATUS_REFRESH_MAX_DELAY = 2 * time.Second
+	// Above this number of devices to refresh, the status of the whole
+	// apartment is fetched instead.
+	STATUS_REFRESH_MAX_DEVICES = 10
+)
+
+// statusRefresher collects the devices whose status changed and refreshes
+// them once the notifications stop, fetching the status of each device or of
+// the whole apartment when a notification does not identify the device.
+type statusRefresher struct {
+	refreshDevices   func(deviceIds []string) error
+	refreshApartment func() error
+	debounce         time.Duration
+	maxDelay         time.Duration
+
+	mutex     sync.Mutex
+	deviceIds map[string]bool
+	apartment bool
+	timer     *time.Timer
+	// Time of the first request since the last refresh.
+	first time.Time
+	// Serializes the refreshes.
+	running sync.Mutex
+}
+
+func newStatusRefresher(refreshDevices func(deviceIds []string) error, refreshApartment func() error) *statusRefresher {
+	return &statusRefresher{
+		refreshDevices:   refreshDevices,
+		refreshApartment: refreshApartment,
+		debounce:         STATUS_REFRESH_DEBOUNCE,
+		maxDelay:         STATUS_REFRESH_MAX_DELAY,
+		deviceIds:        map[string]bool{},
+	}
+}
+
+// Requests the refresh of the status of the device, or of the whole
+// apartment when the device id is empty.
+func (s *statusRefresher) request(deviceId string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if deviceId == "" {
+		s.apartment = true
+	} else {
+		s.deviceIds[deviceId] = true
+	}
+	if s.timer == nil {
+		s.first = time.Now()
+		s.timer = time.AfterFunc(s.debounce, s.refresh)
+	} else if time.Since(s.first)+s.debounce < s.maxDelay {
+		s.timer.Reset(s.debounce)
+	}
+}
+
+func (s *statusRefresher) refresh() {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	s.mutex.Lock()
+	apartment := s.apartment || len(s.deviceIds) > STATUS_REFRESH_MAX_DEVICES
+	deviceIds := make([]string, 0, len(s.deviceIds))
+	for deviceId := range s.deviceIds {
+		deviceIds = append(deviceIds, deviceId)
+	}
+	s.apartment = false
+	s.deviceIds = map[string]bool{}
+	s.timer = nil
+	s.mutex.Unlock()
+
+	if !apartment {
+		if len(deviceIds) == 0 {
+			return
+		}
+		sort.Strings(deviceIds)
+		err := s.refreshDevices(deviceIds)
+		if err == nil {
+			return
+		}
+		log.Warn().Err(err).Msg("Error updating the status of the devices, updating the apartment status instead")
+	}
+	if err := s.refreshApartment(); err != nil {
+		log.Err(err).Msg("Error updating apartment status")
+	}
+}
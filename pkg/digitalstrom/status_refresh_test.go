@@ -0,0 +1,65 @@
+package digitalstrom
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatusRefresherCoalescesNotifications(t *testing.T) {
+	var mutex sync.Mutex
+	refreshed := [][]string{}
+	apartmentRefreshes := 0
+	done := make(chan struct{}, 10)
+	refresher := newStatusRefresher(func(deviceIds []string) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		refreshed = append(refreshed, deviceIds)
+		done <- struct{}{}
+		if deviceIds[0] == "failing" {
+			return errors.New("not found")
+		}
+		return nil
+	}, func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		apartmentRefreshes++
+		done <- struct{}{}
+		return nil
+	})
+	refresher.debounce = 10 * time.Millisecond
+
+	refresher.request("b")
+	refresher.request("a")
+	refresher.request("b")
+	<-done
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	if !reflect.DeepEqual(refreshed, [][]string{{"a", "b"}}) || apartmentRefreshes != 0 {
+		t.Errorf("Unexpected refreshes: %v, %d", refreshed, apartmentRefreshes)
+	}
+	mutex.Unlock()
+
+	// Notification without device.
+	refresher.request("a")
+	refresher.request("")
+	<-done
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	if len(refreshed) != 1 || apartmentRefreshes != 1 {
+		t.Errorf("Unexpected refreshes: %v, %d", refreshed, apartmentRefreshes)
+	}
+	mutex.Unlock()
+
+	// Falls back to the apartment when the status of a device fails.
+	refresher.request("failing")
+	<-done
+	<-done
+	mutex.Lock()
+	if len(refreshed) != 2 || apartmentRefreshes != 2 {
+		t.Errorf("Unexpected refreshes: %v, %d", refreshed, apartmentRefreshes)
+	}
+	mutex.Unlock()
+}
@@ -3,12 +3,29 @@ package digitalstrom
 type DeviceType string
 
 const (
-	DeviceTypeLight   DeviceType = "GE"
-	DeviceTypeBlind   DeviceType = "GR"
-	DeviceTypeJoker   DeviceType = "SW"
-	DeviceTypeUnknown DeviceType = "Unknown"
+	DeviceTypeLight  DeviceType = "light"
+	DeviceTypeBlind  DeviceType = "blind"
+	DeviceTypeAwning DeviceType = "awning"
+	DeviceTypeWindow DeviceType = "window"
+	// Heating or cooling actuator.
+	DeviceTypeHeating     DeviceType = "heating"
+	DeviceTypeVentilation DeviceType = "ventilation"
+	DeviceTypeJoker       DeviceType = "joker"
+	DeviceTypeUnknown     DeviceType = "unknown"
 )
 
+// DeviceTypes lists the known device types.
+var DeviceTypes = []DeviceType{
+	DeviceTypeLight,
+	DeviceTypeBlind,
+	DeviceTypeAwning,
+	DeviceTypeWindow,
+	DeviceTypeHeating,
+	DeviceTypeVentilation,
+	DeviceTypeJoker,
+	DeviceTypeUnknown,
+}
+
 type Action string
 
 const (
@@ -63,33 +80,63 @@ type OutputType string
 
 const (
 	OutputTypeLightBrightness           OutputType = "lightBrightness"
-	OutputTypeLightHue                  OutputType = " lightHue"
-	OutputTypeLightSaturation           OutputType = " lightSaturation"
-	OutputTypeLightTemperature          OutputType = " lightTemperature"
-	OutputTypeLightCieX                 OutputType = " lightCieX"
-	OutputTypeLightCieY                 OutputType = " lightCieY"
-	OutputTypeShadePositionOutside      OutputType = " shadePositionOutside"
-	OutputTypeShadePositionIndoor       OutputType = " shadePositionIndoor"
-	OutputTypeShadeOpeningAngleOutside  OutputType = " shadeOpeningAngleOutside"
-	OutputTypeShadeOpeningAngleIndoor   OutputType = " shadeOpeningAngleIndoor"
-	OutputTypeShadeTransparency         OutputType = " shadeTransparency"
-	OutputTypeAirFlowIntensity          OutputType = " airFlowIntensity"
-	OutputTypeAirFlowDirection          OutputType = " airFlowDirection"
-	OutputTypeAirFlapOpeningAngle       OutputType = " airFlapOpeningAngle"
-	OutputTypeVentilationLouverPosition OutputType = " ventilationLouverPosition"
-	OutputTypeHeatingPower              OutputType = " heatingPower"
-	OutputTypeCoolingCapacity           OutputType = " coolingCapacity"
-	OutputTypeAudioVolume               OutputType = " audioVolume"
-	OutputTypePowerState                OutputType = " powerState"
-	OutputTypeVentilationSwingMode      OutputType = " ventilationSwingMode"
-	OutputTypeVentilationAutoIntensity  OutputType = " ventilationAutoIntensity"
-	OutputTypeWaterTemperature          OutputType = " waterTemperature"
-	OutputTypeWaterFlowRate             OutputType = " waterFlowRate"
-	OutputTypePowerLevel                OutputType = " powerLevel"
-	OutputTypeVideoStation              OutputType = " videoStation"
-	OutputTypeVideoInputSource          OutputType = " videoInputSource"
+	OutputTypeLightHue                  OutputType = "lightHue"
+	OutputTypeLightSaturation           OutputType = "lightSaturation"
+	OutputTypeLightTemperature          OutputType = "lightTemperature"
+	OutputTypeLightCieX                 OutputType = "lightCieX"
+	OutputTypeLightCieY                 OutputType = "lightCieY"
+	OutputTypeShadePositionOutside      OutputType = "shadePositionOutside"
+	OutputTypeShadePositionIndoor       OutputType = "shadePositionIndoor"
+	OutputTypeShadeOpeningAngleOutside  OutputType = "shadeOpeningAngleOutside"
+	OutputTypeShadeOpeningAngleIndoor   OutputType = "shadeOpeningAngleIndoor"
+	OutputTypeShadeTransparency         OutputType = "shadeTransparency"
+	OutputTypeAirFlowIntensity          OutputType = "airFlowIntensity"
+	OutputTypeAirFlowDirection          OutputType = "airFlowDirection"
+	OutputTypeAirFlapOpeningAngle       OutputType = "airFlapOpeningAngle"
+	OutputTypeVentilationLouverPosition OutputType = "ventilationLouverPosition"
+	OutputTypeHeatingPower              OutputType = "heatingPower"
+	OutputTypeCoolingCapacity           OutputType = "coolingCapacity"
+	OutputTypeAudioVolume               OutputType = "audioVolume"
+	OutputTypePowerState                OutputType = "powerState"
+	OutputTypeVentilationSwingMode      OutputType = "ventilationSwingMode"
+	OutputTypeVentilationAutoIntensity  OutputType = "ventilationAutoIntensity"
+	OutputTypeWaterTemperature          OutputType = "waterTemperature"
+	OutputTypeWaterFlowRate             OutputType = "waterFlowRate"
+	OutputTypePowerLevel                OutputType = "powerLevel"
+	OutputTypeVideoStation              OutputType = "videoStation"
+	OutputTypeVideoInputSource          OutputType = "videoInputSource"
 )
 
+// OutputTypes lists the known output types.
+var OutputTypes = []OutputType{
+	OutputTypeLightBrightness,
+	OutputTypeLightHue,
+	OutputTypeLightSaturation,
+	OutputTypeLightTemperature,
+	OutputTypeLightCieX,
+	OutputTypeLightCieY,
+	OutputTypeShadePositionOutside,
+	OutputTypeShadePositionIndoor,
+	OutputTypeShadeOpeningAngleOutside,
+	OutputTypeShadeOpeningAngleIndoor,
+	OutputTypeShadeTransparency,
+	OutputTypeAirFlowIntensity,
+	OutputTypeAirFlowDirection,
+	OutputTypeAirFlapOpeningAngle,
+	OutputTypeVentilationLouverPosition,
+	OutputTypeHeatingPower,
+	OutputTypeCoolingCapacity,
+	OutputTypeAudioVolume,
+	OutputTypePowerState,
+	OutputTypeVentilationSwingMode,
+	OutputTypeVentilationAutoIntensity,
+	OutputTypeWaterTemperature,
+	OutputTypeWaterFlowRate,
+	OutputTypePowerLevel,
+	OutputTypeVideoStation,
+	OutputTypeVideoInputSource,
+}
+
 type OutputMode string
 
 const (
@@ -5,58 +5,270 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/digitalstrom"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/mqtt"
 	"github.com/rs/zerolog/log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	healthgo "github.com/hellofresh/health-go/v5"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Probe defines which endpoint a check contributes to.
+type Probe int
+
+const (
+	// The application finished starting (/health/started).
+	Startup Probe = 1 << iota
+	// The application is able to do its job (/health/ready).
+	Readiness
+	// The application is not stuck and does not need to be restarted
+	// (/health/live).
+	Liveness
+)
+
+// Check is a single health check, contributing to one or more probes.
+type Check struct {
+	Name   string
+	Probes Probe
+	Check  func(ctx context.Context) error
+}
+
+// Checker is implemented by the components (e.g. modules) exposing their own
+// health checks.
+type Checker interface {
+	HealthChecks() []Check
+}
+
+// Duration during which the result of the ping of the dSS is reused.
+const pingCacheDuration = 30 * time.Second
+
+// Returns a check reusing the result of the given one for the given duration.
+func cached(duration time.Duration, check func(ctx context.Context) error) func(ctx context.Context) error {
+	var mutex sync.Mutex
+	var lastRun time.Time
+	var lastErr error
+	return func(ctx context.Context) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !lastRun.IsZero() && time.Since(lastRun) < duration {
+			return lastErr
+		}
+		lastErr = check(ctx)
+		lastRun = time.Now()
+		return lastErr
+	}
+}
+
+// Returns a check failing once the websocket was disconnected for longer than
+// the given duration, as observed when the check runs. The start counts as a
+// disconnection, giving the websocket the same delay to connect.
+func websocketDowntime(maxDowntime time.Duration, connected func() bool) func(ctx context.Context) error {
+	var mutex sync.Mutex
+	disconnectedSince := time.Now()
+	return func(ctx context.Context) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if connected() {
+			disconnectedSince = time.Time{}
+			return nil
+		}
+		if disconnectedSince.IsZero() {
+			disconnectedSince = time.Now()
+		}
+		if downtime := time.Since(disconnectedSince); downtime > maxDowntime {
+			return fmt.Errorf("notification websocket disconnected for %s", downtime.Round(time.Second))
+		}
+		return nil
+	}
+}
+
 type Health interface {
 	Start() error
 	Stop() error
+
+	// Registers additional checks.
+	AddChecks(checks []Check) error
+	// Marks the application as started, which is reported by the startup
+	// probe.
+	SetStarted(started bool)
+	// Serves an additional handler on the same server. Must be called before
+	// Start.
+	Mount(pattern string, handler http.Handler)
+	// Pings the dSS like the readiness probe, sharing its cached result.
+	PingDigitalstrom(ctx context.Context) error
 }
 
 type health struct {
-	config     config.HealthCheckConfig
-	mqttClient mqtt.Client
-	health     *healthgo.Health
+	config config.HealthCheckConfig
+	// All the checks, served on /health.
+	health *healthgo.Health
+	// Checks per probe.
+	probes map[Probe]*healthgo.Health
 
-	server *http.Server
+	started atomic.Bool
+	mounts  map[string]http.Handler
+	server  *http.Server
+	// Ping of the dSS, cached.
+	pingDigitalstrom func(ctx context.Context) error
 }
 
-func NewHealth(config config.HealthCheckConfig, mqttClient mqtt.Client) Health {
-	h, _ := healthgo.New(healthgo.WithComponent(healthgo.Component{
-		Name:    "digitalstrom-mqtt",
-		Version: "v1.0",
-	}),
-	)
-
-	// and then add some more if needed
-	err := h.Register(healthgo.Config{
-		Name:      "mqtt",
-		Timeout:   time.Second * 2,
-		SkipOnErr: false,
-		Check: func(ctx context.Context) error {
-			if mqttClient.RawClient().IsConnectionOpen() {
-				log.Trace().Msg("MQTT client is connected")
-				return nil
-			}
-			return errors.New("MQTT client is not connected")
-		},
-	})
+func NewHealth(config config.HealthCheckConfig, mqttClient mqtt.Client, dsClient digitalstrom.Client) Health {
+	h, err := newHealth(config)
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to register MQTT healthcheck")
+		log.Error().Err(err).Msg("Unable to create healthcheck")
 		return nil
 	}
 
-	return &health{
-		config:     config,
-		mqttClient: mqttClient,
-		health:     h,
+	// The dSS is not queried on every probe.
+	h.pingDigitalstrom = cached(pingCacheDuration, func(ctx context.Context) error {
+		err := dsClient.Ping()
+		if errors.Is(err, digitalstrom.ErrUnauthorized) {
+			return errors.New("digitalSTROM API key rejected")
+		}
+		if err != nil {
+			return fmt.Errorf("digitalSTROM API unreachable: %w", err)
+		}
+		return nil
+	})
+
+	checks := []Check{
+		{
+			Name:   "started",
+			Probes: Startup,
+			Check: func(ctx context.Context) error {
+				if h.started.Load() {
+					return nil
+				}
+				return errors.New("application is starting")
+			},
+		},
+		{
+			Name:   "mqtt",
+			Probes: Readiness,
+			Check: func(ctx context.Context) error {
+				if mqttClient.RawClient().IsConnectionOpen() {
+					log.Trace().Msg("MQTT client is connected")
+					return nil
+				}
+				return errors.New("MQTT client is not connected")
+			},
+		},
+		{
+			Name:   "digitalstrom",
+			Probes: Readiness,
+			Check:  h.pingDigitalstrom,
+		},
+		{
+			// Not part of the liveness, the websocket being disconnected
+			// for a few seconds while reconnecting.
+			Name:   "websocket",
+			Probes: Readiness,
+			Check: func(ctx context.Context) error {
+				if dsClient.WebsocketConnected() {
+					return nil
+				}
+				return errors.New("notification websocket is not connected")
+			},
+		},
+	}
+	if config.WebsocketMaxDowntime > 0 {
+		// A websocket which does not reconnect requires a restart.
+		checks = append(checks, Check{
+			Name:   "websocket_downtime",
+			Probes: Liveness,
+			Check:  websocketDowntime(time.Duration(config.WebsocketMaxDowntime)*time.Second, dsClient.WebsocketConnected),
+		})
 	}
+	if config.NotificationMaxAge > 0 {
+		maxAge := time.Duration(config.NotificationMaxAge) * time.Second
+		startTime := time.Now()
+		checks = append(checks, Check{
+			Name:   "notifications",
+			Probes: Liveness,
+			Check: func(ctx context.Context) error {
+				last := dsClient.LastNotification()
+				if last.IsZero() {
+					// Give the websocket some time after the start.
+					last = startTime
+				}
+				if age := time.Since(last); age > maxAge {
+					return fmt.Errorf("no notification received for %s", age.Round(time.Second))
+				}
+				return nil
+			},
+		})
+	}
+
+	if err := h.AddChecks(checks); err != nil {
+		log.Error().Err(err).Msg("Unable to register healthchecks")
+		return nil
+	}
+	return h
+}
+
+func newHealth(config config.HealthCheckConfig) (*health, error) {
+	h := &health{
+		config: config,
+		probes: map[Probe]*healthgo.Health{},
+		mounts: map[string]http.Handler{},
+	}
+	var err error
+	if h.health, err = newHealthGo(); err != nil {
+		return nil, err
+	}
+	for _, probe := range []Probe{Startup, Readiness, Liveness} {
+		if h.probes[probe], err = newHealthGo(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func newHealthGo() (*healthgo.Health, error) {
+	return healthgo.New(healthgo.WithComponent(healthgo.Component{
+		Name:    "digitalstrom-mqtt",
+		Version: "v1.0",
+	}))
+}
+
+func (h *health) AddChecks(checks []Check) error {
+	for _, check := range checks {
+		cfg := healthgo.Config{
+			Name:      check.Name,
+			Timeout:   time.Second * 5,
+			SkipOnErr: false,
+			Check:     check.Check,
+		}
+		if err := h.health.Register(cfg); err != nil {
+			return fmt.Errorf("unable to register healthcheck '%s': %w", check.Name, err)
+		}
+		for probe, probeHealth := range h.probes {
+			if check.Probes&probe == 0 {
+				continue
+			}
+			if err := probeHealth.Register(cfg); err != nil {
+				return fmt.Errorf("unable to register healthcheck '%s': %w", check.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (h *health) SetStarted(started bool) {
+	h.started.Store(started)
+}
+
+func (h *health) Mount(pattern string, handler http.Handler) {
+	h.mounts[pattern] = handler
+}
+
+func (h *health) PingDigitalstrom(ctx context.Context) error {
+	return h.pingDigitalstrom(ctx)
 }
 
 func (h *health) Start() error {
@@ -90,8 +302,12 @@ func shutdownHTTPServer(server *http.Server, timeout time.Duration) error {
 func (h *health) service() http.Handler {
 	r := chi.NewRouter()
 	r.Get("/health", h.health.HandlerFunc)
-	r.Get("/health/started", h.health.HandlerFunc)
-	r.Get("/health/ready", h.health.HandlerFunc)
-	r.Get("/health/live", h.health.HandlerFunc)
+	r.Get("/health/started", h.probes[Startup].HandlerFunc)
+	r.Get("/health/ready", h.probes[Readiness].HandlerFunc)
+	r.Get("/health/live", h.probes[Liveness].HandlerFunc)
+	r.Handle("/metrics", promhttp.Handler())
+	for pattern, handler := range h.mounts {
+		r.Mount(pattern, handler)
+	}
 	return r
 }
@@ -5,9 +5,13 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
 )
 
 func TestShutdownHTTPServerStartsFreshTimeout(t *testing.T) {
@@ -72,3 +76,89 @@ func TestShutdownHTTPServerStartsFreshTimeout(t *testing.T) {
 		t.Fatal("request did not finish")
 	}
 }
+
+func TestProbesHaveDistinctChecks(t *testing.T) {
+	h, err := newHealth(config.HealthCheckConfig{})
+	if err != nil {
+		t.Fatalf("new health: %v", err)
+	}
+	failing := func(ctx context.Context) error { return errors.New("failing") }
+	err = h.AddChecks([]Check{
+		{Name: "started", Probes: Startup, Check: func(ctx context.Context) error {
+			if h.started.Load() {
+				return nil
+			}
+			return errors.New("starting")
+		}},
+		{Name: "ready", Probes: Readiness, Check: failing},
+	})
+	if err != nil {
+		t.Fatalf("add checks: %v", err)
+	}
+
+	server := httptest.NewServer(h.service())
+	defer server.Close()
+
+	expectStatus(t, server.URL+"/health/started", http.StatusServiceUnavailable)
+	h.SetStarted(true)
+	expectStatus(t, server.URL+"/health/started", http.StatusOK)
+	expectStatus(t, server.URL+"/health/ready", http.StatusServiceUnavailable)
+	expectStatus(t, server.URL+"/health/live", http.StatusOK)
+	expectStatus(t, server.URL+"/health", http.StatusServiceUnavailable)
+}
+
+func expectStatus(t *testing.T, url string, status int) {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("get %s: %v", url, err)
+	}
+	response.Body.Close()
+	if response.StatusCode != status {
+		t.Errorf("%s: expected status %d but got %d", url, status, response.StatusCode)
+	}
+}
+
+func TestCachedCheck(t *testing.T) {
+	calls := 0
+	check := cached(time.Hour, func(ctx context.Context) error {
+		calls++
+		return errors.New("unreachable")
+	})
+	for i := 0; i < 3; i++ {
+		if err := check(context.Background()); err == nil {
+			t.Error("Expected the cached error")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single call but got %d", calls)
+	}
+}
+
+func TestWebsocketDowntime(t *testing.T) {
+	var connected atomic.Bool
+	maxDowntime := 50 * time.Millisecond
+	check := websocketDowntime(maxDowntime, connected.Load)
+
+	if err := check(context.Background()); err != nil {
+		t.Errorf("Expected the websocket to be given some time to connect, got %v", err)
+	}
+	time.Sleep(2 * maxDowntime)
+	if err := check(context.Background()); err == nil {
+		t.Error("Expected an error when the websocket never connected")
+	}
+
+	connected.Store(true)
+	if err := check(context.Background()); err != nil {
+		t.Errorf("Expected no error once connected, got %v", err)
+	}
+	// The downtime starts again at the disconnection.
+	connected.Store(false)
+	if err := check(context.Background()); err != nil {
+		t.Errorf("Expected no error right after the disconnection, got %v", err)
+	}
+	time.Sleep(2 * maxDowntime)
+	if err := check(context.Background()); err == nil {
+		t.Error("Expected an error when the websocket stays disconnected")
+	}
+}
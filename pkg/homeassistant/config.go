@@ -27,6 +27,22 @@ type Device struct {
 	Name             string   `json:"name"`
 }
 
+// Structure that describes the application publishing the discovery messages.
+// It is required by the device-based discovery payloads.
+type Origin struct {
+	Name string `json:"name"`
+	Url  string `json:"url,omitempty"`
+}
+
+// Device-based discovery payload, grouping all the entities of a device in a
+// single message:
+// https://www.home-assistant.io/integrations/mqtt/#device-discovery-payload
+type DeviceDiscoveryConfig struct {
+	Device     Device                            `json:"device"`
+	Origin     Origin                            `json:"origin"`
+	Components map[string]map[string]interface{} `json:"components"`
+}
+
 // Structure that encapsulates the information to retrieve availability of
 // devices and entities.
 type Availability struct {
@@ -44,6 +60,8 @@ type BaseConfig struct {
 	Availability     []Availability `json:"availability,omitempty"`
 	AvailabilityMode string         `json:"availability_mode,omitempty"`
 	QoS              int            `json:"qos"`
+	// Category of the entities which are not controls, e.g. "diagnostic".
+	EntityCategory string `json:"entity_category,omitempty"`
 }
 
 // Returns a pointer to the device object.
@@ -93,12 +111,20 @@ type LightConfig struct {
 	BrightnessScale        int    `json:"brightness_scale,omitempty"`
 	BrightnessStateTopic   string `json:"brightness_state_topic,omitempty"`
 	BrightnessCommandTopic string `json:"brightness_command_topic,omitempty"`
+	ColorTempStateTopic    string `json:"color_temp_state_topic,omitempty"`
+	ColorTempCommandTopic  string `json:"color_temp_command_topic,omitempty"`
+	ColorTempKelvin        bool   `json:"color_temp_kelvin,omitempty"`
+	MinMireds              int    `json:"min_mireds,omitempty"`
+	MaxMireds              int    `json:"max_mireds,omitempty"`
+	MinKelvin              int    `json:"min_kelvin,omitempty"`
+	MaxKelvin              int    `json:"max_kelvin,omitempty"`
 }
 
 // Cover configuration:
 // https://www.home-assistant.io/integrations/cover.mqtt/
 type CoverConfig struct {
 	BaseConfig
+	DeviceClass        string `json:"device_class,omitempty"`
 	StateTopic         string `json:"state_topic,omitempty"`
 	StateClosed        string `json:"state_closed,omitempty"`
 	StateOpen          string `json:"state_open,omitempty"`
@@ -109,9 +135,55 @@ type CoverConfig struct {
 	PositionTopic      string `json:"position_topic,omitempty"`
 	SetPositionTopic   string `json:"set_position_topic,omitempty"`
 	PositionTemplate   string `json:"position_template,omitempty"`
+	PositionOpen       int    `json:"position_open,omitempty"`
+	PositionClosed     int    `json:"position_closed,omitempty"`
 	TiltStatusTopic    string `json:"tilt_status_topic,omitempty"`
 	TiltCommandTopic   string `json:"tilt_command_topic,omitempty"`
 	TiltStatusTemplate string `json:"tilt_status_template,omitempty"`
+	TiltMin            int    `json:"tilt_min,omitempty"`
+	TiltMax            int    `json:"tilt_max,omitempty"`
+}
+
+// Number configuration:
+// https://www.home-assistant.io/integrations/number.mqtt/
+type NumberConfig struct {
+	BaseConfig
+	CommandTopic      string  `json:"command_topic"`
+	StateTopic        string  `json:"state_topic,omitempty"`
+	Min               float64 `json:"min"`
+	Max               float64 `json:"max"`
+	Step              float64 `json:"step,omitempty"`
+	Mode              string  `json:"mode,omitempty"`
+	UnitOfMeasurement string  `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string  `json:"device_class,omitempty"`
+	Icon              string  `json:"icon,omitempty"`
+}
+
+// Fan configuration:
+// https://www.home-assistant.io/integrations/fan.mqtt/
+type FanConfig struct {
+	BaseConfig
+	CommandTopic           string `json:"command_topic"`
+	StateTopic             string `json:"state_topic,omitempty"`
+	StateValueTemplate     string `json:"state_value_template,omitempty"`
+	PayloadOn              string `json:"payload_on,omitempty"`
+	PayloadOff             string `json:"payload_off,omitempty"`
+	PercentageCommandTopic string `json:"percentage_command_topic,omitempty"`
+	PercentageStateTopic   string `json:"percentage_state_topic,omitempty"`
+	SpeedRangeMin          int    `json:"speed_range_min,omitempty"`
+	SpeedRangeMax          int    `json:"speed_range_max,omitempty"`
+}
+
+// Select configuration:
+// https://www.home-assistant.io/integrations/select.mqtt/
+type SelectConfig struct {
+	BaseConfig
+	CommandTopic    string   `json:"command_topic"`
+	CommandTemplate string   `json:"command_template,omitempty"`
+	StateTopic      string   `json:"state_topic,omitempty"`
+	ValueTemplate   string   `json:"value_template,omitempty"`
+	Options         []string `json:"options"`
+	Icon            string   `json:"icon,omitempty"`
 }
 
 // Sensor configuration:
@@ -4,10 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	mqtt_base "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/config"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/mqtt"
 	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/utils"
+	"github.com/rs/zerolog/log"
 )
 
 type Domain string
@@ -19,6 +25,9 @@ const (
 	DeviceAutomation Domain = "device_automation"
 	Cover            Domain = "cover"
 	Scene            Domain = "scene"
+	Number           Domain = "number"
+	Fan              Domain = "fan"
+	Select           Domain = "select"
 	DeviceTrigger    Domain = "device_automation"
 )
 
@@ -37,11 +46,26 @@ type HomeAssistantDiscoveryInterface interface {
 	GetHomeAssistantEntities() ([]DiscoveryConfig, error)
 }
 
+// Time given to the broker to deliver the retained discovery messages.
+const retainedMessagesDelay = time.Second
+
 type HomeAssistantDiscovery struct {
 	mqttClient mqtt.Client
 	config     *config.ConfigHomeAssistant
 
 	discoveryConfigs []DiscoveryConfig
+	// Whether the messages published per entity were removed, when using the
+	// device-based discovery.
+	entityMessagesCleared bool
+	// Topics of the discovery messages last published, to remove the ones of
+	// the devices which disappeared since.
+	publishedTopics map[string]bool
+}
+
+// SetConfig replaces the config, e.g. after a reload. Must not be called
+// while the discovery messages are built.
+func (hass *HomeAssistantDiscovery) SetConfig(config *config.ConfigHomeAssistant) {
+	hass.config = config
 }
 
 func NewHomeAssistantDiscovery(mqttClient mqtt.Client, config *config.ConfigHomeAssistant) *HomeAssistantDiscovery {
@@ -52,6 +76,17 @@ func NewHomeAssistantDiscovery(mqttClient mqtt.Client, config *config.ConfigHome
 	}
 }
 
+// Removes all the configs added so far, e.g. before collecting them again
+// from the modules.
+func (hass *HomeAssistantDiscovery) ClearConfigs() {
+	hass.discoveryConfigs = []DiscoveryConfig{}
+}
+
+// Returns the configs added so far.
+func (hass *HomeAssistantDiscovery) GetConfigs() []DiscoveryConfig {
+	return hass.discoveryConfigs
+}
+
 func (hass *HomeAssistantDiscovery) AddConfigs(configs []DiscoveryConfig) {
 	systemAvailability := Availability{
 		Topic:               hass.mqttClient.ServerStatusTopic(),
@@ -78,11 +113,72 @@ func (hass *HomeAssistantDiscovery) AddConfigs(configs []DiscoveryConfig) {
 	}
 }
 
+// Discovery message, ready to be published.
+type DiscoveryMessage struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+}
+
 func (hass *HomeAssistantDiscovery) PublishDiscoveryMessages() error {
 	if !hass.config.DiscoveryEnabled {
 		return nil
 	}
 
+	messages, err := hass.DiscoveryMessages()
+	if err != nil {
+		return err
+	}
+	if hass.config.DeviceDiscovery && !hass.entityMessagesCleared {
+		// Done before publishing the devices, Home Assistant identifying
+		// their entities the same way as the ones published per entity.
+		if err := hass.clearEntityMessages(); err != nil {
+			return err
+		}
+		hass.entityMessagesCleared = true
+	}
+	for _, message := range messages {
+		if err := hass.publish(message.Topic, message.Payload); err != nil {
+			return err
+		}
+	}
+	for _, topic := range staleTopics(hass.publishedTopics, messages) {
+		log.Info().Str("topic", topic).Msg("Removing discovery message no longer published.")
+		if err := hass.publish(topic, []byte{}); err != nil {
+			return err
+		}
+	}
+	hass.publishedTopics = map[string]bool{}
+	for _, message := range messages {
+		hass.publishedTopics[message.Topic] = true
+	}
+	return nil
+}
+
+// Returns the topics published before which are not part of the messages,
+// sorted.
+func staleTopics(published map[string]bool, messages []DiscoveryMessage) []string {
+	current := map[string]bool{}
+	for _, message := range messages {
+		current[message.Topic] = true
+	}
+	topics := []string{}
+	for topic := range published {
+		if !current[topic] {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Returns the discovery messages for all the configs added so far, in the
+// format selected in the config.
+func (hass *HomeAssistantDiscovery) DiscoveryMessages() ([]DiscoveryMessage, error) {
+	if hass.config.DeviceDiscovery {
+		return hass.deviceDiscoveryMessages()
+	}
+
+	messages := []DiscoveryMessage{}
 	for _, config := range hass.discoveryConfigs {
 		topic := path.Join(
 			hass.config.DiscoveryTopicPrefix,
@@ -92,13 +188,135 @@ func (hass *HomeAssistantDiscovery) PublishDiscoveryMessages() error {
 			"config")
 		json, err := json.Marshal(config.Config)
 		if err != nil {
-			return fmt.Errorf("error serializing dicovery config to JSON: %w", err)
+			return nil, fmt.Errorf("error serializing dicovery config to JSON: %w", err)
+		}
+		messages = append(messages, DiscoveryMessage{Topic: topic, Payload: json})
+	}
+	return messages, nil
+}
+
+// Returns one discovery message per device using the device-based discovery
+// format, where all the entities of a device are grouped in the `components`
+// map of a single payload.
+// https://www.home-assistant.io/integrations/mqtt/#device-discovery-payload
+func (hass *HomeAssistantDiscovery) deviceDiscoveryMessages() ([]DiscoveryMessage, error) {
+	deviceIds := []string{}
+	configsByDevice := map[string][]DiscoveryConfig{}
+	for _, config := range hass.discoveryConfigs {
+		if _, ok := configsByDevice[config.DeviceId]; !ok {
+			deviceIds = append(deviceIds, config.DeviceId)
+		}
+		configsByDevice[config.DeviceId] = append(configsByDevice[config.DeviceId], config)
+	}
+
+	messages := []DiscoveryMessage{}
+	for _, deviceId := range deviceIds {
+		payload, err := deviceDiscoveryPayload(configsByDevice[deviceId])
+		if err != nil {
+			return nil, fmt.Errorf("error building device discovery payload for device '%s': %w", deviceId, err)
+		}
+		json, err := json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("error serializing dicovery config to JSON: %w", err)
 		}
-		t := hass.mqttClient.RawClient().Publish(topic, 0, true, json)
-		<-t.Done()
-		if t.Error() != nil {
-			return fmt.Errorf("error publishing discovery message to MQTT: %w", err)
+		topic := path.Join(
+			hass.config.DiscoveryTopicPrefix,
+			"device",
+			deviceId,
+			"config")
+		messages = append(messages, DiscoveryMessage{Topic: topic, Payload: json})
+	}
+	return messages, nil
+}
+
+// Removes the retained messages published per entity for the devices known,
+// e.g. when switching an existing installation to the device-based discovery,
+// as Home Assistant would keep the entities twice otherwise.
+func (hass *HomeAssistantDiscovery) clearEntityMessages() error {
+	deviceIds := map[string]bool{}
+	for _, config := range hass.discoveryConfigs {
+		deviceIds[config.DeviceId] = true
+	}
+
+	var mutex sync.Mutex
+	topics := []string{}
+	filter := path.Join(hass.config.DiscoveryTopicPrefix, "+", "+", "+", "config")
+	t := hass.mqttClient.RawClient().Subscribe(filter, 0, func(client mqtt_base.Client, message mqtt_base.Message) {
+		if !message.Retained() || len(message.Payload()) == 0 || !deviceIds[entityTopicDeviceId(message.Topic())] {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		topics = append(topics, message.Topic())
+	})
+	<-t.Done()
+	if t.Error() != nil {
+		return fmt.Errorf("error subscribing to the discovery messages: %w", t.Error())
+	}
+	time.Sleep(retainedMessagesDelay)
+	t = hass.mqttClient.RawClient().Unsubscribe(filter)
+	<-t.Done()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, topic := range topics {
+		log.Info().Str("topic", topic).Msg("Removing discovery message published per entity.")
+		if err := hass.publish(topic, []byte{}); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+// Returns the device id of a topic of the discovery per entity,
+// `{prefix}/{domain}/{deviceId}/{objectId}/config`.
+func entityTopicDeviceId(topic string) string {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 4 {
+		return ""
+	}
+	return parts[len(parts)-3]
+}
+
+func (hass *HomeAssistantDiscovery) publish(topic string, payload []byte) error {
+	t := hass.mqttClient.RawClient().Publish(topic, 0, true, payload)
+	<-t.Done()
+	if t.Error() != nil {
+		return fmt.Errorf("error publishing discovery message to MQTT: %w", t.Error())
+	}
+	return nil
+}
+
+// Builds the device-based discovery payload for the given entities, which
+// must all belong to the same device. The device description is taken from
+// the first entity and removed from every component, as Home Assistant
+// expects it only once at the root of the payload.
+func deviceDiscoveryPayload(configs []DiscoveryConfig) (*DeviceDiscoveryConfig, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no entities to publish")
+	}
+	payload := &DeviceDiscoveryConfig{
+		Device: *configs[0].Config.GetDevice(),
+		Origin: Origin{
+			Name: "digitalstrom-mqtt",
+			Url:  "https://github.com/gaetancollaud/digitalstrom-mqtt",
+		},
+		Components: map[string]map[string]interface{}{},
+	}
+	for _, config := range configs {
+		// Round trip through JSON to reuse the serialization of every config
+		// type while being able to alter the resulting fields.
+		raw, err := json.Marshal(config.Config)
+		if err != nil {
+			return nil, err
+		}
+		component := map[string]interface{}{}
+		if err := json.Unmarshal(raw, &component); err != nil {
+			return nil, err
+		}
+		delete(component, "device")
+		component["platform"] = string(config.Domain)
+		payload.Components[config.ObjectId] = component
+	}
+	return payload, nil
+}
@@ -0,0 +1,98 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDeviceDiscoveryPayload(t *testing.T) {
+	device := Device{
+		Identifiers: []string{"controller1"},
+		Model:       "dSM12",
+		Name:        "Kitchen",
+	}
+	configs := []DiscoveryConfig{
+		{
+			Domain:   Sensor,
+			DeviceId: "controller1",
+			ObjectId: "power",
+			Config: &SensorConfig{
+				BaseConfig: BaseConfig{
+					Device:   device,
+					Name:     "Power Kitchen",
+					UniqueId: "controller1_power",
+				},
+				StateTopic:        "digitalstrom/meterings/Kitchen/consumptionW/state",
+				UnitOfMeasurement: "W",
+			},
+		},
+		{
+			Domain:   Sensor,
+			DeviceId: "controller1",
+			ObjectId: "energy",
+			Config: &SensorConfig{
+				BaseConfig: BaseConfig{
+					Device:   device,
+					Name:     "Energy Kitchen",
+					UniqueId: "controller1_energy",
+				},
+				StateTopic: "digitalstrom/meterings/Kitchen/energyWh/state",
+			},
+		},
+	}
+
+	payload, err := deviceDiscoveryPayload(configs)
+	if err != nil {
+		t.Fatalf("Expected device payload to be built: %v", err)
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("Expected device payload to marshal: %v", err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		t.Fatalf("Expected device payload to unmarshal: %v", err)
+	}
+
+	expectEqual(t, result["device"].(map[string]interface{})["name"], "Kitchen")
+	expectEqual(t, result["origin"].(map[string]interface{})["name"], "digitalstrom-mqtt")
+	components := result["components"].(map[string]interface{})
+	expectEqual(t, len(components), 2)
+	power := components["power"].(map[string]interface{})
+	expectEqual(t, power["platform"], "sensor")
+	expectEqual(t, power["unique_id"], "controller1_power")
+	expectEqual(t, power["unit_of_measurement"], "W")
+	expectEqual(t, power["device"], nil)
+	energy := components["energy"].(map[string]interface{})
+	expectEqual(t, energy["state_topic"], "digitalstrom/meterings/Kitchen/energyWh/state")
+}
+
+func TestDeviceDiscoveryPayloadWithoutEntities(t *testing.T) {
+	if _, err := deviceDiscoveryPayload(nil); err == nil {
+		t.Error("Expected an error when no entities are given")
+	}
+}
+
+func TestEntityTopicDeviceId(t *testing.T) {
+	expectEqual(t, entityTopicDeviceId("homeassistant/light/device1/light/config"), "device1")
+	expectEqual(t, entityTopicDeviceId("prefix/ha/sensor/controller1/power/config"), "controller1")
+	expectEqual(t, entityTopicDeviceId("config"), "")
+}
+
+func TestStaleTopics(t *testing.T) {
+	published := map[string]bool{
+		"homeassistant/device/device1/config": true,
+		"homeassistant/device/device2/config": true,
+	}
+	stale := staleTopics(published, []DiscoveryMessage{
+		{Topic: "homeassistant/device/device1/config"},
+		{Topic: "homeassistant/device/device3/config"},
+	})
+	if len(stale) != 1 || stale[0] != "homeassistant/device/device2/config" {
+		t.Errorf("Expected only the topic of the removed device, got %v", stale)
+	}
+	if stale := staleTopics(nil, []DiscoveryMessage{{Topic: "homeassistant/device/device1/config"}}); len(stale) != 0 {
+		t.Errorf("Expected no stale topic on the first publication, got %v", stale)
+	}
+}
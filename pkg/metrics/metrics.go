@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "digitalstrom_mqtt"
+
+// Bridge internals.
+var (
+	DigitalstromRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dss_requests_total",
+		Help:      "Number of HTTP requests sent to the dSS, per endpoint and status.",
+	}, []string{"method", "endpoint", "status"})
+	DigitalstromRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dss_request_duration_seconds",
+		Help:      "Latency of the HTTP requests sent to the dSS, per endpoint.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"method", "endpoint"})
+	WebsocketReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dss_websocket_reconnects_total",
+		Help:      "Number of reconnections of the notification websocket.",
+	})
+	WebsocketNotifications = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dss_websocket_notifications_total",
+		Help:      "Number of notifications received from the dSS websocket, per type.",
+	}, []string{"type"})
+	MqttPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_published_total",
+		Help:      "Number of messages published to the MQTT broker.",
+	})
+	MqttPublishErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_publish_errors_total",
+		Help:      "Number of messages that could not be published to the MQTT broker.",
+	})
+	MqttSubscriptions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_subscriptions_total",
+		Help:      "Number of subscriptions made to the MQTT broker.",
+	})
+	MqttSubscribeErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_subscribe_errors_total",
+		Help:      "Number of subscriptions to the MQTT broker that failed.",
+	})
+	MqttMessagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_messages_received_total",
+		Help:      "Number of messages received from the MQTT broker.",
+	})
+	CommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "command_duration_seconds",
+		Help:      "Round-trip time of the commands received from MQTT until acknowledged by the dSS.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"result"})
+	RegistrySize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "registry_items",
+		Help:      "Number of items known by the registry, per kind.",
+	}, []string{"kind"})
+	ModuleStartFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "module_start_failures_total",
+		Help:      "Number of modules that failed to start.",
+	}, []string{"module"})
+)
+
+// Values of the installation, only exported when enabled in the config.
+var (
+	MeteringValue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "digitalstrom",
+		Name:      "metering_value",
+		Help:      "Last value of the meterings of the dSS.",
+	}, []string{"controller", "unit"})
+	OutputValue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "digitalstrom",
+		Name:      "output_value",
+		Help:      "Last value of the outputs of the devices.",
+	}, []string{"device", "dsid", "zone", "controller", "output"})
+
+	valuesExported = false
+)
+
+// Registers the gauges holding the metering and output values of the
+// installation. They are not exported by default since their cardinality
+// grows with the size of the installation.
+func EnableValuesExport() {
+	if valuesExported {
+		return
+	}
+	prometheus.MustRegister(MeteringValue, OutputValue)
+	valuesExported = true
+}
+
+// Returns whether the metering and output values are exported.
+func ValuesExported() bool {
+	return valuesExported
+}
+
+var idSegment = regexp.MustCompile(`^[0-9a-fA-F]{16,}$|^[0-9]+$`)
+
+// Returns the endpoint of the given API path with the identifiers replaced
+// by a placeholder, to keep the cardinality of the labels low.
+func Endpoint(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		if idSegment.MatchString(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
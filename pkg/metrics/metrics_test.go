@@ -0,0 +1,18 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestEndpoint(t *testing.T) {
+	expect(t, Endpoint("api/v1/apartment"), "/api/v1/apartment")
+	expect(t, Endpoint("/api/v1/apartment/meterings/values"), "/api/v1/apartment/meterings/values")
+	expect(t, Endpoint("api/v1/apartment/dsDevices/303505d7f8000000000000400013befc00/status"), "/api/v1/apartment/dsDevices/{id}/status")
+	expect(t, Endpoint("api/v1/apartment/zones/5/status"), "/api/v1/apartment/zones/{id}/status")
+}
+
+func expect(t *testing.T, result string, expect string) {
+	if expect != result {
+		t.Errorf("Expected='%s' but got '%s'", expect, result)
+	}
+}
@@ -3,8 +3,12 @@ package mqtt
 import (
 	"fmt"
 	"path"
+	"strings"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gaetancollaud/digitalstrom-mqtt/pkg/metrics"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
@@ -20,8 +24,11 @@ const (
 const (
 	State        string = "state"
 	Command      string = "command"
+	Result       string = "result"
 	Event        string = "event"
 	serverStatus string = "server/status"
+	// Root of the topics of the devices.
+	devices string = "devices"
 )
 
 type SubscriptionHandler struct {
@@ -35,13 +42,18 @@ type Client interface {
 	// Disconnect from the MQTT server.
 	Disconnect() error
 
-	// Publishes a message under the prefix topic of DigitalStrom.
+	// Publishes a message under the prefix topic of DigitalStrom. When
+	// deduplication is enabled, device states identical to the last one
+	// published on the same topic are dropped.
 	Publish(topic string, message interface{}) error
 	// Same as publish but force the retain flag regardless of what is in the config
 	PublishAndRetain(topic string, message interface{}) error
 	// Subscribe to a topic and calls the given handler when a message is
 	// received.
 	Subscribe(topic string, messageHandler mqtt.MessageHandler) error
+	// Unsubscribe from a topic subscribed with Subscribe, which is no longer
+	// subscribed again when reconnecting.
+	Unsubscribe(topic string) error
 
 	// Return the full topic for a given subpath.
 	GetFullTopic(topic string) string
@@ -55,21 +67,108 @@ type client struct {
 	mqttClient    mqtt.Client
 	options       ClientOptions
 	subscriptions *Subscriptions
+	deduplicator  *deduplicator
+}
+
+type publishedMessage struct {
+	payload string
+	time    time.Time
+}
+
+// Keeps track of the last message published on every topic to drop the
+// duplicates.
+type deduplicator struct {
+	maxSilence time.Duration
+	last       map[string]publishedMessage
+	mutex      sync.Mutex
+}
+
+// Returns whether the message is a duplicate of the last one published on
+// the topic, and records it otherwise.
+func (d *deduplicator) isDuplicate(topic string, message interface{}) bool {
+	payload := fmt.Sprint(message)
+	if b, ok := message.([]byte); ok {
+		payload = string(b)
+	}
+	now := time.Now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	last, ok := d.last[topic]
+	if ok && last.payload == payload && (d.maxSilence == 0 || now.Sub(last.time) < d.maxSilence) {
+		return true
+	}
+	d.last[topic] = publishedMessage{payload: payload, time: now}
+	return false
+}
+
+// Forgets the message published on the topic, so the next one goes through.
+func (d *deduplicator) forget(topic string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.last, topic)
+}
+
+// Forgets all the published messages, e.g. after a reconnection as the
+// broker may have lost them.
+func (d *deduplicator) reset() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.last = map[string]publishedMessage{}
 }
 
 type Subscriptions struct {
 	shouldReconnect bool
-	list            []SubscriptionHandler
+	// Guards the list, the devices being subscribed while running.
+	mutex sync.Mutex
+	list  []SubscriptionHandler
+}
+
+func (s *Subscriptions) add(subscription SubscriptionHandler) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.list = append(s.list, subscription)
+	return len(s.list)
+}
+
+// Removes the subscriptions of the topic and returns whether there was one.
+func (s *Subscriptions) remove(topic string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := []SubscriptionHandler{}
+	for _, sub := range s.list {
+		if sub.Topic != topic {
+			list = append(list, sub)
+		}
+	}
+	removed := len(list) != len(s.list)
+	s.list = list
+	return removed
+}
+
+func (s *Subscriptions) all() []SubscriptionHandler {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]SubscriptionHandler{}, s.list...)
 }
 
 func NewClient(options *ClientOptions) Client {
 	subscriptions := Subscriptions{
 		list: []SubscriptionHandler{},
 	}
+	var dedup *deduplicator
+	if options.Deduplicate {
+		dedup = &deduplicator{
+			maxSilence: options.MaxSilence,
+			last:       map[string]publishedMessage{},
+		}
+	}
 	mqttOptions := mqtt.NewClientOptions().
 		AddBroker(options.MqttUrl).
 		SetClientID("digitalstrom-mqtt-"+uuid.New().String()).
-		SetOrderMatters(false).
+		// The commands must be handled in the order they were sent, the
+		// handlers only queue them.
+		SetOrderMatters(true).
 		SetUsername(options.Username).
 		SetPassword(options.Password).
 		SetAutoReconnect(true).
@@ -80,11 +179,15 @@ func NewClient(options *ClientOptions) Client {
 		}).
 		SetOnConnectHandler(func(client mqtt.Client) {
 			log.Info().Str("url", options.MqttUrl).Msg("Connected to MQTT server.")
+			if dedup != nil {
+				dedup.reset()
+			}
 
 			if subscriptions.shouldReconnect {
 				subscriptions.shouldReconnect = false
-				log.Info().Int("count", len(subscriptions.list)).Msg("Re-subscribing to topics")
-				for _, sub := range subscriptions.list {
+				list := subscriptions.all()
+				log.Info().Int("count", len(list)).Msg("Re-subscribing to topics")
+				for _, sub := range list {
 					log.Debug().Str("topic", sub.Topic).Msg("Re-subscribing to topic")
 					t := client.Subscribe(
 						sub.Topic,
@@ -102,6 +205,7 @@ func NewClient(options *ClientOptions) Client {
 		mqttClient:    mqtt.NewClient(mqttOptions),
 		options:       *options,
 		subscriptions: &subscriptions,
+		deduplicator:  dedup,
 	}
 }
 
@@ -130,13 +234,35 @@ func (c *client) Disconnect() error {
 }
 
 func (c *client) publish(topic string, message interface{}, forceRetain bool) error {
+	fullTopic := path.Join(c.options.TopicPrefix, topic)
+	if c.deduplicator != nil && !forceRetain && isDeviceStateTopic(topic) {
+		if c.deduplicator.isDuplicate(fullTopic, message) {
+			log.Trace().Str("topic", fullTopic).Msg("Skipping duplicated message")
+			return nil
+		}
+	}
 	t := c.mqttClient.Publish(
-		path.Join(c.options.TopicPrefix, topic),
+		fullTopic,
 		QOS,
 		c.options.Retain || forceRetain,
 		message)
 	<-t.Done()
-	return t.Error()
+	if t.Error() != nil {
+		metrics.MqttPublishErrors.Inc()
+		if c.deduplicator != nil {
+			// Make sure the message is sent again next time.
+			c.deduplicator.forget(fullTopic)
+		}
+		return t.Error()
+	}
+	metrics.MqttPublished.Inc()
+	return nil
+}
+
+// Returns whether the topic, relative to the prefix, is the state of a device
+// output, the only messages deduplicated.
+func isDeviceStateTopic(topic string) bool {
+	return strings.HasPrefix(topic, devices+"/") && path.Base(topic) == State
 }
 
 func (c *client) Publish(topic string, message interface{}) error {
@@ -149,15 +275,35 @@ func (c *client) PublishAndRetain(topic string, message interface{}) error {
 
 func (c *client) Subscribe(topic string, messageHandler mqtt.MessageHandler) error {
 	topic = path.Join(c.options.TopicPrefix, topic)
-	c.subscriptions.list = append(c.subscriptions.list, SubscriptionHandler{
+	handler := func(client mqtt.Client, message mqtt.Message) {
+		metrics.MqttMessagesReceived.Inc()
+		messageHandler(client, message)
+	}
+	count := c.subscriptions.add(SubscriptionHandler{
 		Topic:          topic,
-		MessageHandler: messageHandler,
+		MessageHandler: handler,
 	})
-	log.Debug().Int("count", len(c.subscriptions.list)).Str("topic", topic).Msg("Subscribing to topic")
+	log.Debug().Int("count", count).Str("topic", topic).Msg("Subscribing to topic")
 	t := c.mqttClient.Subscribe(
 		topic,
 		QOS,
-		messageHandler)
+		handler)
+	<-t.Done()
+	if t.Error() != nil {
+		metrics.MqttSubscribeErrors.Inc()
+		return t.Error()
+	}
+	metrics.MqttSubscriptions.Inc()
+	return nil
+}
+
+func (c *client) Unsubscribe(topic string) error {
+	topic = path.Join(c.options.TopicPrefix, topic)
+	if !c.subscriptions.remove(topic) {
+		return nil
+	}
+	log.Debug().Str("topic", topic).Msg("Unsubscribing from topic")
+	t := c.mqttClient.Unsubscribe(topic)
 	<-t.Done()
 	return t.Error()
 }
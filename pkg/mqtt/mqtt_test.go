@@ -2,6 +2,7 @@ package mqtt
 
 import (
 	"testing"
+	"time"
 )
 
 func TestNormalize(t *testing.T) {
@@ -19,3 +20,56 @@ func expect(t *testing.T, result string, expect string, msg string) {
 		t.Errorf("%s Expected='%s' but got '%s'", msg, expect, result)
 	}
 }
+
+func TestDeduplicator(t *testing.T) {
+	d := &deduplicator{last: map[string]publishedMessage{}}
+	if d.isDuplicate("topic", "1.00") {
+		t.Error("First message should not be a duplicate")
+	}
+	if !d.isDuplicate("topic", "1.00") {
+		t.Error("Same message should be a duplicate")
+	}
+	if d.isDuplicate("other", "1.00") {
+		t.Error("Same message on another topic should not be a duplicate")
+	}
+	if d.isDuplicate("topic", []byte("2.00")) {
+		t.Error("Different message should not be a duplicate")
+	}
+	d.forget("topic")
+	if d.isDuplicate("topic", "2.00") {
+		t.Error("Forgotten message should not be a duplicate")
+	}
+}
+
+func TestDeduplicatorMaxSilence(t *testing.T) {
+	d := &deduplicator{maxSilence: time.Millisecond, last: map[string]publishedMessage{}}
+	d.isDuplicate("topic", "1.00")
+	time.Sleep(2 * time.Millisecond)
+	if d.isDuplicate("topic", "1.00") {
+		t.Error("Message should be published again after the max silence")
+	}
+}
+
+func TestIsDeviceStateTopic(t *testing.T) {
+	if !isDeviceStateTopic("devices/Lamp/brightness/state") {
+		t.Error("Device state topic should be deduplicated")
+	}
+	if isDeviceStateTopic("devices/Lamp/result") || isDeviceStateTopic("meterings/apartment/consumptionW/state") {
+		t.Error("Only the device state topics should be deduplicated")
+	}
+}
+
+func TestSubscriptionsRemove(t *testing.T) {
+	s := &Subscriptions{}
+	s.add(SubscriptionHandler{Topic: "devices/Lamp/command"})
+	s.add(SubscriptionHandler{Topic: "devices/Lamp/brightness/command"})
+	if !s.remove("devices/Lamp/command") {
+		t.Error("Subscribed topic should be removed")
+	}
+	if s.remove("devices/Lamp/command") {
+		t.Error("Topic should be removed only once")
+	}
+	if list := s.all(); len(list) != 1 || list[0].Topic != "devices/Lamp/brightness/command" {
+		t.Errorf("Only the other topic should be subscribed again, got %v", list)
+	}
+}
@@ -15,6 +15,8 @@ type ClientOptions struct {
 	Retain              bool
 	QoS                 byte
 	DisconnectTimeout   time.Duration
+	Deduplicate         bool
+	MaxSilence          time.Duration
 }
 
 // NewClientOptions will create a new ClientOptions type with some default
@@ -24,6 +26,7 @@ type ClientOptions struct {
 // 	 Retain: true
 //	 QoS: 0
 //	 DisconnectTimeout: 1 second
+//	 Deduplicate: false
 func NewClientOptions() *ClientOptions {
 	return &ClientOptions{
 		MqttUrl:           "",
@@ -33,6 +36,7 @@ func NewClientOptions() *ClientOptions {
 		Retain:            true,
 		QoS:               0,
 		DisconnectTimeout: 1 * time.Second,
+		Deduplicate:       false,
 	}
 }
 
@@ -69,3 +73,13 @@ func (o *ClientOptions) SetRetain(retain bool) *ClientOptions {
 	o.Retain = retain
 	return o
 }
+
+// SetDeduplicate will enable or disable the deduplication of published
+// messages. When enabled, a message identical to the last one published on
+// the same topic is dropped, unless nothing was published on that topic for
+// longer than maxSilence. A maxSilence of 0 drops duplicates forever.
+func (o *ClientOptions) SetDeduplicate(deduplicate bool, maxSilence time.Duration) *ClientOptions {
+	o.Deduplicate = deduplicate
+	o.MaxSilence = maxSilence
+	return o
+}
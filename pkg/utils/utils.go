@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"io"
 	"regexp"
 	"strings"
 )
@@ -12,3 +13,34 @@ func RemoveRegexp(value string, expression string) string {
 	regex := regexp.MustCompile("(?i)" + expression)
 	return strings.TrimSpace(regex.ReplaceAllString(value, ""))
 }
+
+// Writer replacing secrets before forwarding what is written to another
+// writer.
+type redactingWriter struct {
+	out      io.Writer
+	replacer *strings.Replacer
+}
+
+// NewRedactingWriter returns a writer replacing every occurrence of the given
+// secrets with "REDACTED", e.g. to keep them out of the logs. Each write is
+// redacted on its own, secrets split across writes are not detected.
+func NewRedactingWriter(out io.Writer, secrets ...string) io.Writer {
+	pairs := []string{}
+	for _, secret := range secrets {
+		if secret != "" {
+			pairs = append(pairs, secret, "REDACTED")
+		}
+	}
+	if len(pairs) == 0 {
+		return out
+	}
+	return &redactingWriter{out: out, replacer: strings.NewReplacer(pairs...)}
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, w.replacer.Replace(string(p))); err != nil {
+		return 0, err
+	}
+	// Report the original length, as expected by the callers.
+	return len(p), nil
+}
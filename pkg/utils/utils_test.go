@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -16,6 +17,21 @@ func TestRemoveRegexp(t *testing.T) {
 	expect(t, RemoveRegexp("blind_location", "(light|blind)_"), "location")
 }
 
+func TestRedactingWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := NewRedactingWriter(out, "s3cr3t", "", "4f2a9c")
+	n, err := w.Write([]byte("api_key=4f2a9c password=s3cr3t"))
+	if err != nil || n != 30 {
+		t.Errorf("Unexpected write result %d, %v", n, err)
+	}
+	expect(t, out.String(), "api_key=REDACTED password=REDACTED")
+
+	plain := &bytes.Buffer{}
+	if NewRedactingWriter(plain, "") != plain {
+		t.Error("Writer without secrets should not be wrapped")
+	}
+}
+
 func expect(t *testing.T, result string, expect string) {
 	if expect != result {
 		t.Errorf("Expected='%s' but got '%s'", expect, result)